@@ -140,12 +140,19 @@ APP.c3chart = function (target, data, chart_type, config) {
     ytxt = "IOPS"
   }
 
+  // bins are fixed windows of time, bin_width seconds each
+  var xaxis = { label: { text: "Time Offset (seconds)" } };
+  if (!/^percentiles/.test(config.sample) && data.length > 0 && data[0].bin_width) {
+    var width = data[0].bin_width;
+    xaxis.tick = { format: function (i) { return +(i * width).toFixed(3); } };
+  }
+
   return c3.generate({
     bindto: target,
     data: { columns: cols, type: chart_type, colors: APP.device_colors },
     axis: {
       y: { label: { text: ytxt, position: "outer-middle" } },
-      x: { label: { text: "Time Offset (0-10 minutes)" } }
+      x: xaxis
     }
   });
 };
@@ -488,11 +495,25 @@ APP.build_nav = function() {
 
   devs.append("label")
     .attr("for", function (d) { return d; })
+    .attr("title", function (d) { return APP.snapshot_text(APP.snapshots[d]); })
     .html(function (d) { return d; });
 
   APP.change();
 };
 
+// host & device snapshot as a tooltip, older summaries don't have one
+APP.snapshot_text = function (smry) {
+  if (!smry || !smry.host) { return ""; }
+  var host = smry.host, dev = smry.device_snapshot || {}, queue = dev.queue || {};
+  return [
+    host.hostname + ": " + host.kernel + " " + host.arch,
+    host.cpus + "x " + host.cpu_model + (host.cpu_governor ? " (" + host.cpu_governor + ")" : ""),
+    host.fio_version,
+    "scheduler: " + (queue.scheduler || "?") + ", read_ahead_kb: " + (queue.read_ahead_kb || "?"),
+    dev.fstype ? dev.fstype + " " + dev.mount_options : "not mounted"
+  ].join("\n");
+};
+
 // slow & stupid & effective
 APP.uniq = function (list, fun, category) {
   var out = [];
@@ -572,6 +593,12 @@ APP.build_indices = function () {
   APP.benchmarks = APP.uniq(APP.summaries, function (d) { return d.fio_command.fio_name; }, "benchmark");
   APP.suites = APP.uniq(APP.summaries, function (d) { return d.fio_command.suite_name; });
 
+  // one snapshot per device for the tooltips, they rarely differ within a suite
+  APP.snapshots = {};
+  APP.summaries.forEach(function (d) {
+    if (d.host) { APP.snapshots[d.fio_command.device.name] = d; }
+  });
+
   // assign devices colors at startup so they're consistent across changes
   var colors = d3.scale.category20();
   APP.device_colors = {};
@@ -594,7 +621,7 @@ APP.build_indices = function () {
   var sample_types = {};
   APP.summaries.forEach(function (smry) {
     d3.keys(smry).forEach(function (key) {
-      if (key.length > 1 && key.match(/bin/)) {
+      if (key.length > 1 && key.match(/bin$/)) { // not bin_width
         sample_types[key] = true;
       }
     });
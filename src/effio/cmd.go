@@ -3,7 +3,6 @@ package effio
 import (
 	"flag"
 	"fmt"
-	"log"
 	"os"
 	"regexp"
 	"strings"
@@ -50,23 +49,34 @@ func NewCmd(args []string) (cmd Cmd) {
 	return cmd
 }
 
+// Run the subcommand. The subcommands return errors, this is the only place
+// they are turned into a message and an exit code. See ExitCode().
 func (cmd *Cmd) Run() {
+	var err error
+
 	switch cmd.Command {
 	case "run":
-		cmd.RunSuite()
+		err = cmd.RunSuite()
 	case "inventory":
-		cmd.Inventory()
+		err = cmd.Inventory()
+	case "validate":
+		err = cmd.ValidateSuite()
 	case "summarize":
-		cmd.SummarizeCSV()
+		err = cmd.SummarizeCSV()
 	case "summarize-all":
-		cmd.SummarizeAll()
+		err = cmd.SummarizeAll()
 	case "serve":
-		cmd.ServeHTTP()
+		err = cmd.ServeHTTP()
 	case "help", "-h", "-help", "--help":
 		cmd.Usage()
 	default:
 		cmd.Usage(fmt.Sprintf("Invalid subcommand '%s'.\n", cmd.Command))
 	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "effio %s: %s\n", cmd.Command, err)
+		os.Exit(ExitCode(err))
+	}
 }
 
 func (cmd *Cmd) DefaultFlags() {
@@ -78,7 +88,7 @@ func (cmd *Cmd) DefaultFlags() {
 	cmd.FlagSet.StringVar(&cmd.ExclFlag, "excl", "", "regex matching tests to exclude from graph")
 }
 
-func (cmd *Cmd) ParseArgs() {
+func (cmd *Cmd) ParseArgs() error {
 	var err error
 	cmd.FlagSet.Parse(cmd.Args)
 
@@ -86,7 +96,7 @@ func (cmd *Cmd) ParseArgs() {
 	if cmd.InclFlag != "" {
 		cmd.InclRE, err = regexp.Compile(cmd.InclFlag)
 		if err != nil {
-			log.Fatalf("-incl '%s': regex could not be compiled: %s\n", cmd.InclFlag, err)
+			return fmt.Errorf("-incl '%s': regex could not be compiled: %s", cmd.InclFlag, err)
 		}
 	}
 
@@ -94,14 +104,16 @@ func (cmd *Cmd) ParseArgs() {
 	if cmd.ExclFlag != "" {
 		cmd.ExclRE, err = regexp.Compile(cmd.ExclFlag)
 		if err != nil {
-			log.Fatalf("-excl '%s': regex could not be compiled: %s\n", cmd.ExclFlag, err)
+			return fmt.Errorf("-excl '%s': regex could not be compiled: %s", cmd.ExclFlag, err)
 		}
 	}
+
+	return nil
 }
 
 // TODO: fill in usage when things settle down
 func (cmd *Cmd) Usage(more ...string) {
-	fmt.Fprintf(os.Stderr, strings.Join(more, ""))
+	fmt.Fprint(os.Stderr, strings.Join(more, ""))
 	fmt.Fprintf(os.Stderr, "Usage: %s <command> <args>\n", os.Args[0])
 	os.Exit(2)
 }
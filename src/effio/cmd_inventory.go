@@ -3,27 +3,36 @@ package effio
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"os"
 	"path"
-	"path/filepath"
 	"sort"
 	"strings"
 )
 
 // for some reason by-id doesn't show up on VMware Fusion
 // set -path to /dev/disk/by-path or /dev/disk/by-uuid instead
-func (cmd *Cmd) Inventory() {
+func (cmd *Cmd) Inventory() error {
+	var sysfsFlag string
 	cmd.DefaultFlags()
-	cmd.ParseArgs()
+	cmd.FlagSet.StringVar(&sysfsFlag, "sysfs", "/sys", "where sysfs is mounted")
+	if err := cmd.ParseArgs(); err != nil {
+		return err
+	}
 
 	// default to scanning /dev/disk/by-id
 	if cmd.PathFlag == "" {
 		cmd.PathFlag = "/dev/disk/by-id"
 	}
 
-	// load device data from json
-	devs := InventoryDevs(cmd.PathFlag)
+	// load device data from sysfs, missing info is a warning
+	devs, warnings, err := Sysfs{Root: sysfsFlag}.InventoryDevs(cmd.PathFlag)
+	if err != nil {
+		return err
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
 
 	// filter by -incl / -excl
 	devs = cmd.FilterDevices(devs)
@@ -33,82 +42,232 @@ func (cmd *Cmd) Inventory() {
 
 	js, err := json.MarshalIndent(devs, "", "  ")
 	if err != nil {
-		log.Fatalf("Failed to encode inventory JSON: %s\n", err)
+		return fmt.Errorf("failed to encode inventory JSON: %s", err)
 	}
 
 	fmt.Println(string(js))
+
+	return nil
 }
 
-// in my tests I use whole devices with a single GPT partition and the
-// ext4 filesystem (for now). This finds all the devices and grabs most
-// of the info needed for the device JSON file and dumps it to stdout
-// so it can be put in a file and edited to taste.
-func InventoryDevs(dpath string) (devs Devices) {
-	visitor := func(dpath string, f os.FileInfo, err error) error {
-		if err != nil {
-			log.Fatalf("Encountered an error while inventorying devices '%s': %s", dpath, err)
+// InventoryDevs finds block devices in dpath (normally /dev/disk/by-id) and
+// fills in as much as it can from /sys. See Sysfs.InventoryDevs().
+func InventoryDevs(dpath string) (Devices, []error, error) {
+	return DefaultSysfs.InventoryDevs(dpath)
+}
+
+// InventoryDevs finds all the block devices linked from dpath and grabs most
+// of the info needed for the device JSON file so it can be dumped to stdout,
+// put in a file and edited to taste.
+// Partitions, whole disks without partitions (including NVMe namespaces),
+// md arrays and dm/LVM volumes are listed. Whole disks with partitions are
+// left out in favor of their partitions, as are disks and partitions that
+// are part of an md or dm device.
+// Info that can't be read from sysfs is left empty and reported in warnings
+// rather than stopping the inventory.
+func (sys Sysfs) InventoryDevs(dpath string) (devs Devices, warnings []error, err error) {
+	entries, err := ioutil.ReadDir(dpath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not inventory devices: %w", err)
+	}
+
+	// there are usually several links to each device, pick the most
+	// readable one, e.g. ata-Samsung_SSD_840... over wwn-0x5002...
+	links := make(map[string]string) // kernel name -> link
+	for _, ent := range entries {
+		name := ent.Name()
+		kname := name
+		if ent.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path.Join(dpath, name))
+			if err != nil {
+				warnings = append(warnings, err)
+				continue
+			}
+			kname = path.Base(target)
 		}
 
-		fi, err := os.Stat(dpath)
-		if err != nil {
-			log.Fatal(err)
+		if !sys.IsBlockDevice(kname) {
+			continue
+		}
+
+		if prev, ok := links[kname]; ok && linkRank(path.Base(prev)) <= linkRank(name) {
+			continue
+		}
+		links[kname] = path.Join(dpath, name)
+	}
+
+	knames := make([]string, 0, len(links))
+	for kname := range links {
+		knames = append(knames, kname)
+	}
+	sort.Strings(knames)
+
+	names := make(map[string]bool)
+	for _, kname := range knames {
+		d, ok, warns := sys.inventoryDev(kname, links[kname])
+		warnings = append(warnings, warns...)
+		if !ok {
+			continue
 		}
 
-		// ignore anything that's not a device, os.Stat seems to follow the
-		// link and set mode device which is perfect for this case
-		if fi.Mode()&os.ModeDevice == 0 {
-			return nil
+		// two of the same model would get the same name
+		if names[d.Name] {
+			d.Name = d.Name + "_" + kname
+			d.Mountpoint = path.Join("/mnt/effio", d.Name)
 		}
+		names[d.Name] = true
+
+		devs = append(devs, d)
+	}
+
+	return devs, warnings, nil
+}
+
+// inventoryDev builds the Device for one block device, ok is false when
+// it should be left out of the inventory
+func (sys Sysfs) inventoryDev(kname, link string) (d Device, ok bool, warnings []error) {
+	warn := func(err error) {
+		warnings = append(warnings, fmt.Errorf("%s: %s", kname, err))
+	}
+
+	holders, err := sys.Holders(kname)
+	if err != nil {
+		warn(err)
+	} else if len(holders) > 0 {
+		return d, false, warnings
+	}
+
+	kind := sys.Kind(kname)
+	if kind == KindLoop {
+		return d, false, warnings
+	}
 
-		device := path.Base(dpath)
-		reldev, err := os.Readlink(dpath)
+	if kind == KindDisk {
+		parts, err := sys.Partitions(kname)
 		if err != nil {
-			log.Fatal(err)
+			warn(err)
+		} else if len(parts) > 0 {
+			return d, false, warnings
 		}
-		letter := path.Base(reldev)
+	}
+
+	parent, err := sys.Parent(kname)
+	if err != nil {
+		warn(err)
+		parent = kname
+	}
 
-		// only consider devices with a partition table and only
-		// consider partition 1
-		if !strings.HasSuffix(device, "-part1") {
-			return nil
+	// partitions don't have a queue/ or device/ of their own
+	str := func(kname, fpath string) string {
+		val, err := sys.BlockString(kname, fpath)
+		if err != nil {
+			warn(err)
+		}
+		return val
+	}
+	num := func(kname, fpath string) int64 {
+		val, err := sys.BlockInt(kname, fpath)
+		if err != nil {
+			warn(err)
 		}
+		return val
+	}
 
-		bdev := strings.TrimRight(letter, "1234567890")
-		model := GetSysBlockString(bdev, "device/model")
-		bsize := GetSysBlockInt(bdev, "queue/hw_sector_size")
-		size := GetSysBlockInt(bdev, "size") * bsize
-		rotational := GetSysBlockInt(bdev, "queue/rotational")
-		brand := GuessBrand(model)
-		// lower case, replace spaces and dashes with underscore
-		name := strings.Replace(strings.Replace(strings.ToLower(model), " ", "_", -1), "-", "_", -1)
-
-		d := Device{
-			Name:       name,
-			Device:     dpath,
-			Mountpoint: path.Join("/mnt/effio", name),
-			Filesystem: "ext4",
-			Brand:      brand,
-			Series:     model,
-			Capacity:   size,
-			Rotational: (rotational == 1),
-			Transport:  "", // can be detected but it's a lot of work
-			HBA:        "", // ditto
-			Media:      "", // no way to detect
-			Blocksize:  int(bsize),
-			RPM:        0, // no way to detect?
+	var model, name string
+	switch kind {
+	case KindDM:
+		name = str(kname, "dm/name")
+		if uuid, _ := sys.BlockString(kname, "dm/uuid"); strings.HasPrefix(uuid, "LVM-") {
+			model = "LVM logical volume"
+		} else {
+			model = "device-mapper"
+		}
+	case KindMD:
+		model = "md " + str(kname, "md/level")
+		name = kname
+	default:
+		model = str(parent, "device/model")
+		name = model
+		if name == "" {
+			name = kname
 		}
+	}
 
-		devs = append(devs, d)
+	// lower case, replace spaces and dashes with underscore
+	name = strings.Replace(strings.Replace(strings.ToLower(name), " ", "_", -1), "-", "_", -1)
 
-		return nil
+	// partition 1 keeps the plain name, it's the usual setup for testing
+	if kind == KindPartition {
+		if n := num(kname, "partition"); n > 1 {
+			name = fmt.Sprintf("%s_part%d", name, n)
+		}
 	}
 
-	err := filepath.Walk(dpath, visitor)
+	// physical is what blockdev --getpbsz reports, older kernels and
+	// md/dm don't always have it
+	lbsize := num(parent, "queue/logical_block_size")
+	pbsize, err := sys.BlockInt(parent, "queue/physical_block_size")
 	if err != nil {
-		log.Fatalf("Could not inventory devices in '%s': %s", dpath, err)
+		pbsize = lbsize
 	}
+	rotational := num(parent, "queue/rotational")
 
-	return devs
+	scheduler, err := sys.Scheduler(parent)
+	if err != nil {
+		warn(err)
+	}
+	depth, err := sys.QueueDepth(parent)
+	if err != nil {
+		warn(err)
+	}
+	discard, err := sys.Discard(parent)
+	if err != nil {
+		warn(err)
+	}
+
+	vendor := sys.Vendor(parent)
+	known := LookupDeviceModel(vendor, model)
+	media := known.Media
+	if media == "" && rotational == 1 {
+		media = "Iron"
+	}
+
+	d = Device{
+		Name:       name,
+		Device:     link,
+		Mountpoint: path.Join("/mnt/effio", name),
+		Filesystem: "ext4",
+		Brand:      known.Brand,
+		Series:     model,
+		Capacity:   num(kname, "size") * 512, // always 512 byte sectors
+		Rotational: (rotational == 1),
+		Transport:  sys.Transport(parent),
+		HBA:        sys.HBADriver(parent),
+		Media:      media,
+		Blocksize:  int(pbsize),
+		RPM:        known.RPM,
+		Kind:       kind,
+		Parent:     parent,
+		Vendor:     vendor,
+		Firmware:   sys.Firmware(parent),
+		Serial:     sys.Serial(parent),
+		LogicalBS:  int(lbsize),
+		Discard:    discard,
+		QueueDepth: int(depth),
+		Scheduler:  scheduler,
+	}
+
+	return d, true, warnings
+}
+
+// lower is better, the ids meant for machines come last
+func linkRank(name string) int {
+	for _, prefix := range []string{"wwn-", "nvme-eui.", "nvme-nvme.", "dm-uuid-", "md-uuid-", "lvm-pv-uuid-"} {
+		if strings.HasPrefix(name, prefix) {
+			return 1
+		}
+	}
+	return 0
 }
 
 // filter devices by device name string
@@ -135,19 +294,3 @@ func (cmd *Cmd) FilterDevices(devs Devices) Devices {
 
 	return out
 }
-
-func GuessBrand(model string) string {
-	if strings.HasPrefix(model, "Samsung") {
-		return "Samsung"
-	} else if strings.HasPrefix(model, "ST") {
-		return "Seagate"
-	} else if strings.HasPrefix(model, "WD") {
-		return "Western Digital"
-	} else if strings.HasPrefix(model, "MRD") {
-		return "I/O Switch"
-	} else if strings.HasPrefix(model, "SSD") {
-		return "PNY"
-	} else {
-		return "Generic"
-	}
-}
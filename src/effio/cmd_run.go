@@ -2,28 +2,39 @@ package effio
 
 import (
 	"fmt"
-	"log"
 	"os"
-	"path/filepath"
+	"time"
 )
 
 // effio run -dev <file.json> -fio <dir> -path <dir>
-func (cmd *Cmd) RunSuite() {
-	// the default device filename is <hostname>.json
-	devfile, err := os.Hostname()
-	if err != nil {
-		devfile = "devices"
-	}
-	devfile = fmt.Sprintf("conf/machines/%s.json", devfile)
-
-	var devFlag, fioFlag string
-	var dryrunFlag, rerunFlag bool
+func (cmd *Cmd) RunSuite() error {
+	var devFlag, fioFlag, scratchFlag, runnerFlag string
+	var dryrunFlag, rerunFlag, resumeFlag, novalidateFlag, noprepareFlag, forceFlag bool
+	var retriesFlag, parallelFlag int
+	var intervalFlag time.Duration
+	var sim SimRunner
 	cmd.DefaultFlags()
-	cmd.FlagSet.StringVar(&devFlag, "dev", devfile, "JSON file containing device metadata")
+	cmd.FlagSet.StringVar(&devFlag, "dev", defaultDevFile(), "JSON file containing device metadata")
 	cmd.FlagSet.StringVar(&fioFlag, "fio", "conf/fio/default", "directory containing fio config templates")
-	cmd.FlagSet.BoolVar(&dryrunFlag, "dryrun", false, "only generate metadata, without running fio")
-	cmd.FlagSet.BoolVar(&rerunFlag, "rerun", false, "only rerun fio benchmarks with missing or empty output.json")
-	cmd.ParseArgs()
+	cmd.FlagSet.BoolVar(&dryrunFlag, "dryrun", false, "render all configs and print them without running fio")
+	cmd.FlagSet.StringVar(&scratchFlag, "scratch", "", "with -dryrun, write the rendered suite under this directory instead of printing configs")
+	cmd.FlagSet.BoolVar(&rerunFlag, "rerun", false, "rerun every fio benchmark, otherwise only ones with a missing or empty output.json run")
+	cmd.FlagSet.BoolVar(&resumeFlag, "resume", false, "resume a suite using its journal, skipping tests that already succeeded and running failed ones again")
+	cmd.FlagSet.IntVar(&retriesFlag, "retries", 0, "number of times to retry a failed test in this run, earlier runs' attempts don't count")
+	cmd.FlagSet.IntVar(&parallelFlag, "parallel", 1, "max number of tests to run at once, tests never share a device or mountpoint")
+	cmd.FlagSet.BoolVar(&novalidateFlag, "novalidate", false, "skip checking the rendered fio configs before running")
+	cmd.FlagSet.BoolVar(&noprepareFlag, "noprepare", false, "skip the prepare steps in the device JSON (mkfs, discard, precondition)")
+	cmd.FlagSet.BoolVar(&forceFlag, "force", false, "run destructive tests on devices that are mounted, swap or part of md/dm")
+	cmd.FlagSet.DurationVar(&intervalFlag, "interval", time.Second, "how often to sample diskstats and system metrics (CPU, memory, interrupts, etc.) while fio runs")
+	cmd.FlagSet.StringVar(&runnerFlag, "runner", "fio", "fio runs the benchmarks, sim writes synthetic results without touching any disks")
+	cmd.FlagSet.StringVar(&sim.Dist, "sim-dist", "lognormal", "with -runner sim, latency distribution: lognormal, normal, exponential or uniform")
+	cmd.FlagSet.Float64Var(&sim.Mean, "sim-mean", 500, "with -runner sim, mean latency in usec")
+	cmd.FlagSet.Float64Var(&sim.Stddev, "sim-stddev", 0, "with -runner sim, latency standard deviation in usec, default mean/4")
+	cmd.FlagSet.IntVar(&sim.Samples, "sim-samples", 2000, "with -runner sim, number of log records per fio job")
+	cmd.FlagSet.Int64Var(&sim.Seed, "sim-seed", 0, "with -runner sim, random seed")
+	if err := cmd.ParseArgs(); err != nil {
+		return err
+	}
 
 	if cmd.PathFlag == "" {
 		cmd.PathFlag = "./suites/"
@@ -33,17 +44,45 @@ func (cmd *Cmd) RunSuite() {
 		cmd.FlagSet.Usage()
 	}
 
+	runner, err := NewRunner(runnerFlag)
+	if err != nil {
+		return err
+	}
+	if _, ok := runner.(*SimRunner); ok {
+		if err := sim.Validate(); err != nil {
+			return err
+		}
+		runner = &sim
+	} else {
+		if intervalFlag <= 0 {
+			return fmt.Errorf("-interval must be more than 0, got %s", intervalFlag)
+		}
+		runner = FioRunner{SampleInterval: intervalFlag}
+	}
+
+	// a dry run with -scratch writes everything somewhere harmless instead
+	outPath := cmd.PathFlag
+	if dryrunFlag && scratchFlag != "" {
+		outPath = scratchFlag
+	}
+
 	// load device data from json
-	devs := LoadDevicesFile(mustAbs(devFlag))
+	devs, err := LoadDevicesFile(devFlag)
+	if err != nil {
+		return err
+	}
 
 	// load the fio config templates into memory
-	templates := LoadFioConfDir(mustAbs(fioFlag))
-
-	// use absolute paths for output
-	outPath := mustAbs(cmd.PathFlag)
+	templates, err := LoadFioConfDir(fioFlag)
+	if err != nil {
+		return err
+	}
 
 	// build up a test suite of devs x templates
-	suite := NewSuite(cmd.NameFlag, outPath)
+	suite, err := NewSuite(cmd.NameFlag, outPath)
+	if err != nil {
+		return err
+	}
 
 	// generate all the benchmark permutations
 	suite.Populate(devs, templates)
@@ -54,14 +93,104 @@ func (cmd *Cmd) RunSuite() {
 	}
 
 	if dryrunFlag {
-		fmt.Printf("TODO: print benchmark configs instead of running/writing them.\n")
-	} else {
-		// write benchmark metadata out under PathFlag
-		suite.WriteAll()
+		// render everything in memory, only print the configs when they
+		// aren't going to be written to the scratch directory
+		errs := suite.DryRun(os.Stdout, scratchFlag == "")
+		if len(errs) > 0 {
+			for _, err := range errs {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+			}
+			return fmt.Errorf("%d of %d tests failed to render", len(errs), len(suite.FioCommands))
+		}
+
+		if scratchFlag != "" {
+			if err := suite.WriteAll(); err != nil {
+				return err
+			}
+			fmt.Printf("Wrote rendered suite to %q.\n", suite.Path)
+		}
 
-		// execute fio commands
-		suite.Run(rerunFlag)
+		return nil
 	}
+
+	// the simulator never touches devices, so it never prepares them either
+	_, useFio := runner.(FioRunner)
+
+	// catch config mistakes before spending hours running the suite
+	if !novalidateFlag {
+		errs := suite.Validate(useFio)
+		if nerr := printValidation(errs); nerr > 0 {
+			return fmt.Errorf("%d problems found in the rendered fio configs, see 'effio validate' or use -novalidate", nerr)
+		}
+	}
+
+	// raw writes to a device that's in use would wreck the system,
+	// this is checked even with -novalidate
+	if useFio {
+		unsafe := suite.CheckSafety(DefaultProcfs, DefaultSysfs)
+		for _, err := range unsafe {
+			if forceFlag {
+				fmt.Fprintf(os.Stderr, "warning: %s\n", err)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+			}
+		}
+		if len(unsafe) > 0 && !forceFlag {
+			return fmt.Errorf("%d devices are in use, use -force to run destructive tests on them anyway", len(unsafe))
+		}
+	}
+
+	if resumeFlag {
+		// keep the original start time of the suite
+		if _, err := os.Stat(suite.SuiteJson); err == nil {
+			prev, err := LoadSuiteJson(suite.SuiteJson)
+			if err != nil {
+				return err
+			}
+			suite.MinTs = prev.MinTs
+		}
+
+		// WriteAll skips tests the journal says are done
+		suite.Journal, err = LoadJournal(suite.JournalJson)
+		if err != nil {
+			return err
+		}
+	}
+
+	// write benchmark metadata out under PathFlag
+	if err := suite.WriteAll(); err != nil {
+		return err
+	}
+
+	// execute fio commands
+	opts := RunOpts{
+		Rerun:    rerunFlag,
+		Resume:   resumeFlag,
+		Retries:  retriesFlag,
+		Parallel: parallelFlag,
+		Runner:   runner,
+		Prepare:  useFio && !noprepareFlag,
+	}
+	failed, err := suite.Run(opts)
+	if err == ErrInterrupted {
+		fmt.Fprintf(os.Stderr, "Suite interrupted, run again with -resume to continue.\n")
+		return err
+	} else if err != nil {
+		return err
+	} else if failed > 0 {
+		return &FailedTestsError{failed, len(suite.FioCommands), suite.JournalJson}
+	}
+
+	return nil
+}
+
+// the default device filename is conf/machines/<hostname>.json
+func defaultDevFile() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "devices"
+	}
+	return fmt.Sprintf("conf/machines/%s.json", host)
 }
 
 // FilterFioCommands() filters an FioCommands list by matching fcmd.name
@@ -93,14 +222,3 @@ func (cmd *Cmd) FilterFioCommands(in FioCommands) (out FioCommands) {
 
 	return out
 }
-
-// mustAbs change any relative path to an absolute path
-// any error from filepath.Abs is considered fatal
-func mustAbs(p string) string {
-	out, err := filepath.Abs(p)
-	if err != nil {
-		log.Fatalf("BUG: Required operation failed with error: %s\n", err)
-	}
-
-	return out
-}
@@ -26,12 +26,14 @@ import (
 	"strings"
 )
 
-func (cmd *Cmd) ServeHTTP() {
+func (cmd *Cmd) ServeHTTP() error {
 	var addrFlag string
 
 	cmd.DefaultFlags()
 	cmd.FlagSet.StringVar(&addrFlag, "addr", ":9000", "IP:PORT or :PORT address to listen on")
-	cmd.ParseArgs()
+	if err := cmd.ParseArgs(); err != nil {
+		return err
+	}
 
 	if cmd.PathFlag == "" {
 		cmd.PathFlag = "public/data"
@@ -42,18 +44,29 @@ func (cmd *Cmd) ServeHTTP() {
 
 	err := http.ListenAndServe(addrFlag, nil)
 	if err != nil {
-		log.Fatalf("net.http could not listen on address '%s': %s\n", addrFlag, err)
+		return fmt.Errorf("net.http could not listen on address '%s': %w", addrFlag, err)
 	}
+
+	return nil
 }
 
 func (cmd *Cmd) InventoryDataHandler(w http.ResponseWriter, r *http.Request) {
-	files := InventoryData(cmd.PathFlag)
+	files, err := InventoryData(cmd.PathFlag)
+	if err != nil {
+		log.Printf("Data inventory failed: %s\n", err)
+		http.Error(w, fmt.Sprintf("Data inventory failed: %s", err), 500)
+		return
+	}
 
 	// separate logfiles by log type
 	out := make(map[string][]string)
 	for _, file := range files {
 		base := strings.TrimSuffix(file, ".json")
-		logtype := strings.Split(base, "-")[1]
+		parts := strings.Split(base, "-")
+		if len(parts) < 2 {
+			continue // not a summary file
+		}
+		logtype := parts[1]
 
 		if _, ok := out[logtype]; !ok {
 			out[logtype] = make([]string, 0)
@@ -65,17 +78,18 @@ func (cmd *Cmd) InventoryDataHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("JSON marshal failed: %s\n", err)
 		http.Error(w, fmt.Sprintf("Marshaling JSON failed: %s", err), 500)
+		return
 	}
 
 	w.Write(json)
 }
 
-func InventoryData(dpath string) []string {
+func InventoryData(dpath string) ([]string, error) {
 	out := make([]string, 0)
 
 	visitor := func(dpath string, f os.FileInfo, err error) error {
 		if err != nil {
-			log.Fatalf("Encountered an error while inventorying data in '%s': %s", dpath, err)
+			return fmt.Errorf("could not inventory data: %w", err)
 		}
 
 		if strings.HasSuffix(dpath, ".json") {
@@ -87,8 +101,8 @@ func InventoryData(dpath string) []string {
 
 	err := filepath.Walk(dpath, visitor)
 	if err != nil {
-		log.Fatalf("Could not inventory suites in '%s': %s", dpath, err)
+		return nil, err
 	}
 
-	return out
+	return out, nil
 }
@@ -3,136 +3,288 @@ package effio
 import (
 	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
-	"strings"
+	"strconv"
 	"time"
 )
 
-func (cmd *Cmd) SummarizeCSV() {
-	var hbktFlag int
+// SummarizeOpts are the options shared by summarize and summarize-all
+type SummarizeOpts struct {
+	Bins        int           // number of bins when BinWidth is 0
+	BinWidth    time.Duration // length of fio time in each bin, msec resolution
+	Jobs        bool          // include a summary for each fio job
+	Stream      bool          // two passes over the logs instead of loading them, see summarize_stream.go
+	PcntlMethod string        // how percentiles between two records are picked, see summarize_pcntl.go
+	// steady state detection, see summarize_steady.go
+	Steady       bool          // detect steady state and report the warm-up and steady figures
+	SteadyRound  time.Duration // round length, 0 is DefaultSteadyRound
+	SteadyWindow int           // rounds in the measurement window, 0 is DefaultSteadyWindow
+	TrimWarmup   bool          // implies Steady, leave the warm-up out of the summary
+	skipBefore   uint32        // fio time (msec) of the first record to summarize when trimming
+}
+
+func (opts SummarizeOpts) check() error {
+	if opts.BinWidth < 0 {
+		return fmt.Errorf("bin width must be positive, got %s", opts.BinWidth)
+	}
+	if opts.BinWidth == 0 && opts.Bins < 1 {
+		return fmt.Errorf("need at least 1 bin, got %d", opts.Bins)
+	}
+	if opts.SteadyRound < 0 || (opts.SteadyRound > 0 && opts.SteadyRound < time.Millisecond) {
+		return fmt.Errorf("steady state rounds must be at least 1ms, got %s", opts.SteadyRound)
+	}
+	if opts.SteadyWindow < 0 || opts.SteadyWindow == 1 {
+		return fmt.Errorf("steady state window must be at least 2 rounds, got %d", opts.SteadyWindow)
+	}
+	return checkPcntlMethod(opts.PcntlMethod)
+}
+
+func (cmd *Cmd) summarizeFlags(opts *SummarizeOpts) {
+	cmd.FlagSet.IntVar(&opts.Bins, "hbkt", 10, "number of bins when -bin-width isn't set")
+	cmd.FlagSet.DurationVar(&opts.BinWidth, "bin-width", 0, "bin the logs by this much fio time, e.g. 1s or 100ms")
+	cmd.FlagSet.BoolVar(&opts.Jobs, "jobs", false, "include a summary for each fio job")
+	cmd.FlagSet.BoolVar(&opts.Stream, "stream", false, "summarize without loading the logs into memory, percentiles are within 0.4%")
+	cmd.FlagSet.StringVar(&opts.PcntlMethod, "pcntl-method", PcntlLinear, "percentile method: linear, nearest or lower (effio's old behavior)")
+	cmd.FlagSet.BoolVar(&opts.Steady, "steady", false, "detect steady state on the bw/iops logs")
+	cmd.FlagSet.DurationVar(&opts.SteadyRound, "steady-round", DefaultSteadyRound, "length of each steady state round")
+	cmd.FlagSet.IntVar(&opts.SteadyWindow, "steady-window", DefaultSteadyWindow, "rounds in the steady state measurement window")
+	cmd.FlagSet.BoolVar(&opts.TrimWarmup, "trim-warmup", false, "leave the records before steady state out of the summary, implies -steady")
+}
+
+func (cmd *Cmd) SummarizeCSV() error {
+	var opts SummarizeOpts
 	var inFlag, outFlag string
 	var jsonFlag bool
 
 	cmd.DefaultFlags()
-	cmd.FlagSet.StringVar(&inFlag, "in", "", "CSV file to load")
-	cmd.FlagSet.IntVar(&hbktFlag, "hbkt", 10, "data bin width")
+	cmd.FlagSet.StringVar(&inFlag, "in", "", "CSV file to load, per-job siblings are merged in")
 	cmd.FlagSet.StringVar(&outFlag, "out", "", "CSV file to write")
 	cmd.FlagSet.BoolVar(&jsonFlag, "json", false, "Print JSON instead of human-readable text.")
-	cmd.ParseArgs()
+	cmd.summarizeFlags(&opts)
+	if err := cmd.ParseArgs(); err != nil {
+		return err
+	}
+
+	// fio >= 2.1.10 writes one log per job, so -in lat_lat.1.log or
+	// -in lat_lat.log will load all of lat_lat.*.log
+	set, err := FindFioLogSet(inFlag)
+	if err != nil {
+		return err
+	}
+	if len(set.Files) == 0 {
+		return fmt.Errorf("no fio log files found matching '%s': %w", inFlag, os.ErrNotExist)
+	}
 
-	recs := LoadFioLog(inFlag)
-	smry := recs.Summarize(hbktFlag)
-	AppendMetadata(inFlag, &smry)
+	smry, err := set.Summarize(opts)
+	if err != nil {
+		return err
+	}
+
+	if err := AppendMetadata(set.Files[0], &smry); err != nil {
+		return err
+	}
 
 	if jsonFlag {
-		os.Stdout.Write(toJson(smry))
+		js, err := toJson(smry)
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(js)
 	} else {
 		printSummary(smry)
 	}
+
+	return nil
 }
 
 // effio summarize-all -path suites -out public/data
-func (cmd *Cmd) SummarizeAll() {
-	var hbktFlag int
+func (cmd *Cmd) SummarizeAll() error {
+	var opts SummarizeOpts
 	var outFlag string
 
 	cmd.DefaultFlags()
-	cmd.FlagSet.IntVar(&hbktFlag, "hbkt", 10, "data bin width")
 	cmd.FlagSet.StringVar(&outFlag, "out", "public/data", "directory to write summaries to")
-	cmd.ParseArgs()
+	cmd.summarizeFlags(&opts)
+	if err := cmd.ParseArgs(); err != nil {
+		return err
+	}
 
 	fi, err := os.Stat(outFlag)
 	if err != nil {
-		log.Fatalf("Could not stat '%s': %s\n", outFlag, err)
+		return err
 	}
 	if !fi.IsDir() {
-		log.Fatalf("'%s' must be a directory!\n", outFlag)
+		return fmt.Errorf("'%s' must be a directory", outFlag)
 	}
 
-	files := InventoryCSVFiles(cmd.PathFlag)
+	sets, err := InventoryCSVFiles(cmd.PathFlag)
+	if err != nil {
+		return err
+	}
 
-	for _, file := range files {
-		fi, err := os.Stat(file)
-		if err != nil {
-			log.Fatalf("Could not stat CSV file '%s': %s\n", file, err)
-		}
+	for _, set := range sets {
 		// avoid tiny files, not enough data for summarize to work
-		if fi.Size() < 5000 {
-			log.Printf("Skipping file %q because it is only %d bytes.\n", file, fi.Size())
+		if size := set.Size(); size < 5000 {
+			fmt.Printf("Skipping %q because it is only %d bytes.\n", set.Path(), size)
 			continue
 		}
 
 		started := time.Now()
 
-		recs := LoadFioLog(file)
-		smry := recs.Summarize(hbktFlag)
-		smry.Name = path.Base(file)
-		smry.Path = file
-
-		parts := strings.Split(smry.Name, ".")
-		switch parts[0] {
-		case "bw_bw":
-			smry.LogType = "bw"
-		case "lat_lat":
-			smry.LogType = "lat"
-		case "lat_slat":
-			smry.LogType = "slat"
-		case "lat_clat":
-			smry.LogType = "clat"
-		case "iops_iops":
-			smry.LogType = "iops"
+		outpath, err := set.WriteSummary(outFlag, opts)
+		if err != nil {
+			return err
 		}
 
-		AppendMetadata(file, &smry)
+		elapsed := time.Now().Sub(started)
+		fmt.Printf("Generated %q from %q in %s\n", outpath, set.Path(), elapsed)
+	}
 
-		// output filename is SHA1 of the source file
-		sha1sum := sha1file(file)
-		outpath := path.Join(outFlag, fmt.Sprintf("%s-%s.json", sha1sum, smry.LogType))
+	return nil
+}
 
-		out, err := os.OpenFile(outpath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-		if err != nil {
-			log.Fatalf("Could not open file '%s' for write: %s\n", outpath, err)
-		}
-		out.Write(toJson(smry))
+// WriteSummary summarizes the set along with the metadata from the test
+// directory and writes it as JSON into outDir. The file name is the SHA1
+// of the source file(s) and the log type, e.g. <sha1>-lat.json.
+func (set *FioLogSet) WriteSummary(outDir string, opts SummarizeOpts) (string, error) {
+	smry, err := set.Summarize(opts)
+	if err != nil {
+		return "", err
+	}
 
-		elapsed := time.Now().Sub(started)
-		fmt.Printf("Generated %q from %q in %s\n", outpath, file, elapsed)
+	if err := AppendMetadata(set.Files[0], &smry); err != nil {
+		return "", err
+	}
+
+	// output filename is SHA1 of the source file(s)
+	sha1sum, err := sha1file(set.Files...)
+	if err != nil {
+		return "", err
+	}
+	outpath := path.Join(outDir, fmt.Sprintf("%s-%s.json", sha1sum, smry.LogType))
+
+	js, err := toJson(smry)
+	if err != nil {
+		return "", err
 	}
+
+	err = ioutil.WriteFile(outpath, js, 0644)
+	if err != nil {
+		return "", fmt.Errorf("could not write summary: %w", err)
+	}
+
+	return outpath, nil
 }
 
-func InventoryCSVFiles(dpath string) []string {
-	out := make([]string, 0)
-	re := "(bw_bw|lat_lat|iops_iops)\\.?\\d*\\.log$"
-	//re := "(bw_bw|lat_lat|lat_slat|lat_clat|iops_iops)\\.?\\d*\\.log$"
+// Summarize loads and merges all the logs in the set then summarizes them.
+// With opts.Jobs, each fio job is also summarized on its own. With
+// opts.Stream the logs are read twice instead of being loaded. With
+// opts.Steady or opts.TrimWarmup steady state is detected first, a set
+// without any bw or iops logs to detect it with only gets a warning.
+func (set *FioLogSet) Summarize(opts SummarizeOpts) (ld LogSummaries, err error) {
+	if err := opts.check(); err != nil {
+		return ld, err
+	}
+
+	var ss *SteadyState
+	if opts.Steady || opts.TrimWarmup {
+		detected, err := set.DetectSteadyState(opts.SteadyRound, opts.SteadyWindow)
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", err)
+		} else if err != nil {
+			return ld, err
+		} else {
+			ss = &detected
+			ss.Trimmed = opts.TrimWarmup && ss.Detected
+			if ss.Trimmed {
+				opts.skipBefore = ss.Start
+			}
+		}
+	}
 
-	visitor := func(dpath string, f os.FileInfo, err error) error {
-		if err != nil {
-			log.Fatalf("Encountered an error while inventorying files in '%s': %s", dpath, err)
+	if opts.Stream {
+		ld, err = set.SummarizeStream(opts)
+		if err == nil && ss != nil {
+			err = ss.streamFigures(set, opts.PcntlMethod)
+		}
+		ld.SteadyState = ss
+		return ld, err
+	}
+
+	recs, err := set.Load()
+	if err != nil {
+		return ld, err
+	}
+	if len(recs) == 0 {
+		return ld, &ParseError{File: set.Path(), Err: fmt.Errorf("no records found")}
+	}
+	if ss != nil {
+		ss.setFigures(recs, opts.PcntlMethod)
+		recs = recs.from(opts.skipBefore)
+		if len(recs) == 0 {
+			return ld, &ParseError{File: set.Path(), Err: fmt.Errorf("no records after the warm-up")}
 		}
+	}
+
+	var jsmry []LogJobSummary
+	if opts.Jobs {
+		jsmry = recs.SummarizeJobs(opts)
+	}
 
-		fi, err := os.Stat(dpath)
+	smry := recs.Summarize(opts)
+	smry.Name = set.Name()
+	smry.Path = set.Path()
+	smry.Files = set.Files
+	smry.LogType = set.LogType
+	smry.Jobs = jsmry
+	if ss != nil && ss.Trimmed {
+		ss.steadyFrom(smry)
+	}
+	smry.SteadyState = ss
+
+	return smry, nil
+}
+
+// InventoryCSVFiles finds all of the fio logs under dpath and groups the
+// per-job files fio >= 2.1.10 writes by directory and log type so each
+// group can be merged into a single summary.
+func InventoryCSVFiles(dpath string) (FioLogSets, error) {
+	out := make(FioLogSets, 0)
+	found := make(map[string]int) // dir/base -> index in out
+	logtypes := map[string]bool{"bw_bw": true, "lat_lat": true, "iops_iops": true}
+
+	visitor := func(dpath string, fi os.FileInfo, err error) error {
 		if err != nil {
-			log.Fatalf("Could not stat '%s': %s\n", dpath, err)
+			return fmt.Errorf("could not inventory log files: %w", err)
 		}
 
-		// skip empty and tiny files
-		if fi.Size() < 100 {
+		if fi.IsDir() {
 			return nil
 		}
 
 		// WARNING: using assumptions based on effio conventions
-		matched, err := regexp.MatchString(re, dpath)
-		if err != nil {
-			panic(err)
+		base, _, ok := parseFioLogName(dpath)
+		if !ok || !logtypes[base] {
+			return nil
 		}
-		if matched {
-			out = append(out, dpath)
+
+		key := path.Join(path.Dir(dpath), base)
+		if idx, ok := found[key]; ok {
+			out[idx].Files = append(out[idx].Files, dpath)
+		} else {
+			found[key] = len(out)
+			out = append(out, FioLogSet{
+				Dir:     path.Dir(dpath),
+				Base:    base,
+				LogType: fioLogType(base),
+				Files:   []string{dpath},
+			})
 		}
 
 		return nil
@@ -140,19 +292,29 @@ func InventoryCSVFiles(dpath string) []string {
 
 	err := filepath.Walk(dpath, visitor)
 	if err != nil {
-		log.Fatalf("Could not inventory files in '%s': %s", dpath, err)
+		return nil, err
 	}
 
-	return out
+	// skip empty and tiny sets, but not tiny files in a set: a job that
+	// stopped early still has IOs in the merged summary
+	sets := out[:0]
+	for _, set := range out {
+		if set.Size() < 100 {
+			continue
+		}
+		set.sortFiles()
+		sets = append(sets, set)
+	}
+
+	return sets, nil
 }
 
-func toJson(smry LogSummaries) []byte {
+func toJson(smry LogSummaries) ([]byte, error) {
 	js, err := json.Marshal(smry)
 	if err != nil {
-		fmt.Printf("Failed to encode summary data as JSON: %s\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to encode summary data as JSON: %s", err)
 	}
-	return append(js, byte('\n'))
+	return append(js, byte('\n')), nil
 }
 
 func printSummary(smry LogSummaries) {
@@ -166,12 +328,13 @@ func printSummary(smry LogSummaries) {
 	fmt.Printf("End Timestamp:      %d\n", smry.Summary.MaxTs)
 	fmt.Printf("Elapsed Time:       %d\n", smry.Summary.Elapsed)
 	fmt.Printf("\n")
-	fmt.Printf("P1:    % 8d P5:     % 8d P10:     % 8d\n", smry.Pcntl[1].Val, smry.Pcntl[5].Val, smry.Pcntl[10].Val)
-	fmt.Printf("P25:   % 8d P50:    % 8d P75:     % 8d\n", smry.Pcntl[25].Val, smry.Pcntl[50].Val, smry.Pcntl[75].Val)
-	fmt.Printf("P90:   % 8d P95:    % 8d P99:     % 8d\n", smry.Pcntl[90].Val, smry.Pcntl[95].Val, smry.Pcntl[99].Val)
-	fmt.Printf("P99.9: % 8d P99.99: % 8d P99.999: % 8d\n", smry.Pcntl[99.9].Val, smry.Pcntl[99.99].Val, smry.Pcntl[99.999].Val)
+	fmt.Printf("P1:    % 10.1f P5:     % 10.1f P10:     % 10.1f\n", smry.Pcntl[1].Val, smry.Pcntl[5].Val, smry.Pcntl[10].Val)
+	fmt.Printf("P25:   % 10.1f P50:    % 10.1f P75:     % 10.1f\n", smry.Pcntl[25].Val, smry.Pcntl[50].Val, smry.Pcntl[75].Val)
+	fmt.Printf("P90:   % 10.1f P95:    % 10.1f P99:     % 10.1f\n", smry.Pcntl[90].Val, smry.Pcntl[95].Val, smry.Pcntl[99].Val)
+	fmt.Printf("P99.9: % 10.1f P99.99: % 10.1f P99.999: % 10.1f\n", smry.Pcntl[99.9].Val, smry.Pcntl[99.99].Val, smry.Pcntl[99.999].Val)
 
-	fmt.Printf("\nAll Binned Data[% 4d]:   ", len(smry.Bin))
+	fmt.Printf("\nBin Width: %gs\n", smry.BinWidth)
+	fmt.Printf("All Binned Data[% 4d]:   ", len(smry.Bin))
 	for _, bkt := range smry.Bin {
 		fmt.Printf("% 7.3f ", bkt.Average)
 	}
@@ -188,9 +351,59 @@ func printSummary(smry LogSummaries) {
 		fmt.Printf("% 7.3f ", bkt.Average)
 	}
 	fmt.Printf("\n")
+
+	if ss := smry.SteadyState; ss != nil {
+		if ss.Detected {
+			fmt.Printf("\nSteady state from %gs to %gs in %s", float64(ss.Start)/1000, float64(ss.End)/1000, ss.Source)
+		} else {
+			fmt.Printf("\nSteady state not reached in %s, last window", ss.Source)
+		}
+		fmt.Printf(": range %.1f%% excursion %.1f%%\n", ss.RangePct, ss.ExcursionPct)
+		fmt.Printf("All:    Count: % 10d Average: % 10.3f P50: % 10.1f P99: % 10.1f\n",
+			ss.All.Count, ss.All.Average, ss.AllPcntl[50].Val, ss.AllPcntl[99].Val)
+		if ss.Detected {
+			fmt.Printf("Steady: Count: % 10d Average: % 10.3f P50: % 10.1f P99: % 10.1f\n",
+				ss.Steady.Count, ss.Steady.Average, ss.SteadyPcntl[50].Val, ss.SteadyPcntl[99].Val)
+		}
+	}
+
+	if len(smry.Breakdown) > 0 {
+		fmt.Printf("\nDirection    Block Size      Count    Average      Stdev        P50        P99\n")
+	}
+	for _, bd := range smry.Breakdown {
+		ddir, bsz := bd.Ddir, "any"
+		if ddir == "" {
+			ddir = "any"
+		}
+		if bd.Bsz > 0 {
+			bsz = strconv.FormatUint(uint64(bd.Bsz), 10)
+		}
+		fmt.Printf("%-9s % 13s % 10d % 10.1f % 10.1f % 10.1f % 10.1f\n", ddir, bsz,
+			bd.Summary.Count, bd.Summary.Average, bd.Summary.Stdev, bd.Pcntl[50].Val, bd.Pcntl[99].Val)
+	}
+
+	if len(smry.Diskstats) > 0 {
+		fmt.Printf("\nDevice       r/s      w/s    rMB/s    wMB/s  rrqm/s  wrqm/s r_await w_await avgqu-sz  %%util\n")
+	}
+	for _, ds := range smry.Diskstats {
+		m := ds.Total
+		fmt.Printf("%-9s % 8.1f % 8.1f % 8.2f % 8.2f % 7.1f % 7.1f % 7.2f % 7.2f % 8.2f % 6.1f\n", ds.Name,
+			m.ReadsPerSec, m.WritesPerSec, m.ReadMBPerSec, m.WriteMBPerSec, m.ReadMerges, m.WriteMerges,
+			m.ReadAwait, m.WriteAwait, m.AvgQuSize, m.Util)
+	}
+
+	if len(smry.Jobs) > 0 {
+		fmt.Printf("\n")
+	}
+	for _, job := range smry.Jobs {
+		fmt.Printf("Job % 3d: Count: % 10d Average: % 10.3f Stdev: % 10.3f P50: % 10.1f P99: % 10.1f\n",
+			job.Job, job.Summary.Count, job.Summary.Average, job.Summary.Stdev, job.Pcntl[50].Val, job.Pcntl[99].Val)
+	}
 }
 
-func AppendMetadata(dpath string, smry *LogSummaries) {
+// AppendMetadata loads command.json and fio's output.json from the same
+// directory as dpath into the summary. Missing files are not an error.
+func AppendMetadata(dpath string, smry *LogSummaries) (err error) {
 	fcmd_filenames := []string{"command.json", "test.json"}
 	dir := path.Dir(dpath)
 
@@ -198,7 +411,10 @@ func AppendMetadata(dpath string, smry *LogSummaries) {
 		fpath := path.Join(dir, name)
 		if fi, err := os.Stat(fpath); err == nil {
 			if fi.Size() > 0 {
-				smry.FioCommand = LoadFioCommandJson(fpath)
+				smry.FioCommand, err = LoadFioCommandJson(fpath)
+				if err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -206,23 +422,65 @@ func AppendMetadata(dpath string, smry *LogSummaries) {
 	fpath := path.Join(dir, "output.json")
 	if fi, err := os.Stat(fpath); err == nil {
 		if fi.Size() > 0 {
-			smry.FioJsonData = LoadFioJsonData(fpath)
+			smry.FioJsonData, err = LoadFioJsonData(fpath)
+			if err != nil {
+				return err
+			}
 		}
 	}
-}
 
-func sha1file(file string) string {
-	hasher := sha1.New()
+	fpath = path.Join(dir, "diskstats.csv")
+	if fi, err := os.Stat(fpath); err == nil && fi.Size() > 0 {
+		ds, err := LoadDiskstatsCSV(fpath)
+		if err != nil {
+			return err
+		}
+		smry.Diskstats, err = SummarizeDiskstats(ds)
+		if err != nil {
+			return err
+		}
+	}
 
-	f, err := os.Open(file)
+	smry.System, err = SummarizeSystem(dir)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer f.Close()
 
-	if _, err := io.Copy(hasher, f); err != nil {
-		log.Fatal(err)
+	// tests run before snapshots were added to command.json can still
+	// use the suite's host.json if there is one
+	smry.Host = smry.FioCommand.Host
+	smry.DeviceSnapshot = smry.FioCommand.DeviceSnapshot
+	if smry.Host == nil {
+		fpath := path.Join(path.Dir(dir), "host.json")
+		if data, err := ioutil.ReadFile(fpath); err == nil {
+			var hs HostSnapshot
+			if err := json.Unmarshal(data, &hs); err != nil {
+				return &ParseError{File: fpath, Err: err}
+			}
+			smry.Host = &hs
+		}
+	}
+
+	return nil
+}
+
+// sha1file returns the SHA1 of the concatenation of the files, which
+// for a single file is the same as sha1sum(1)
+func sha1file(files ...string) (string, error) {
+	hasher := sha1.New()
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = io.Copy(hasher, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
 	}
 
-	return fmt.Sprintf("%x", hasher.Sum(nil))
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
 }
@@ -0,0 +1,75 @@
+package effio
+
+import (
+	"fmt"
+	"os"
+)
+
+// effio validate -dev <file.json> -fio <dir>
+// renders every test the same way run would and checks the fio configs
+// without writing anything or touching any disks
+func (cmd *Cmd) ValidateSuite() error {
+	var devFlag, fioFlag string
+	var fioParseFlag bool
+	cmd.DefaultFlags()
+	cmd.FlagSet.StringVar(&devFlag, "dev", defaultDevFile(), "JSON file containing device metadata")
+	cmd.FlagSet.StringVar(&fioFlag, "fio", "conf/fio/default", "directory containing fio config templates")
+	cmd.FlagSet.BoolVar(&fioParseFlag, "fio-parse", true, "also check configs with fio --parse-only when fio is in PATH")
+	if err := cmd.ParseArgs(); err != nil {
+		return err
+	}
+
+	if cmd.PathFlag == "" {
+		cmd.PathFlag = "./suites/"
+	}
+
+	// the name only shows up in paths, which aren't written
+	if cmd.NameFlag == "" {
+		cmd.NameFlag = "validate"
+	}
+
+	devs, err := LoadDevicesFile(devFlag)
+	if err != nil {
+		return err
+	}
+
+	templates, err := LoadFioConfDir(fioFlag)
+	if err != nil {
+		return err
+	}
+
+	suite, err := NewSuite(cmd.NameFlag, cmd.PathFlag)
+	if err != nil {
+		return err
+	}
+
+	suite.Populate(devs, templates)
+
+	if cmd.InclFlag != "" || cmd.ExclFlag != "" {
+		suite.FioCommands = cmd.FilterFioCommands(suite.FioCommands)
+	}
+
+	errs := suite.Validate(fioParseFlag)
+	errs = append(errs, suite.CheckSafety(DefaultProcfs, DefaultSysfs)...)
+	nerr := printValidation(errs)
+
+	fmt.Printf("%d tests, %d errors, %d warnings\n", len(suite.FioCommands), nerr, len(errs)-nerr)
+
+	if nerr > 0 {
+		return fmt.Errorf("%d problems found in the rendered fio configs and devices", nerr)
+	}
+
+	return nil
+}
+
+// printValidation prints errors from Suite.Validate() to stderr and
+// returns the number that aren't warnings
+func printValidation(errs []error) (nerr int) {
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		if !IsWarning(err) {
+			nerr++
+		}
+	}
+	return nerr
+}
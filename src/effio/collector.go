@@ -0,0 +1,297 @@
+package effio
+
+// Sampling system-wide metrics while fio runs so latency spikes can be
+// lined up with CPU, memory pressure, interrupts and so on. Each Sampler
+// reads one thing, usually a file in /proc, and SystemCollector calls all
+// of them on a timer, writing <name>.csv in the test directory.
+// The CSV files are one metric per row so samplers can return whatever
+// keys they find, e.g. every line of /proc/vmstat:
+// <unix ns>,<key>,<value>
+// SummarizeSystem() folds them back into the test's summary.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Sampler reads one set of metrics. Sample is only ever called from
+// one goroutine at a time so samplers can keep state between calls.
+type Sampler interface {
+	Name() string // used for the file name, e.g. stat -> stat.csv
+	Sample(proc Procfs) ([]SampleValue, error)
+	Counter(key string) bool // true for counters that only go up, summarized as rates
+}
+
+// SampleValue is one metric from a Sampler
+type SampleValue struct {
+	Key   string
+	Value float64
+}
+
+// DefaultSamplers returns a fresh set of the samplers for /proc/stat,
+// meminfo, vmstat, interrupts and pressure/io
+func DefaultSamplers() []Sampler {
+	return []Sampler{&StatSampler{}, MeminfoSampler{}, VmstatSampler{}, InterruptsSampler{}, PressureSampler{"io"}}
+}
+
+// SystemCollector is returned by CollectSystem so the caller can stop
+// collection and wait for the CSV files to be closed.
+type SystemCollector struct {
+	finish  chan struct{}
+	done    chan struct{}
+	Skipped []SkippedSampler // samplers that aren't available, e.g. pressure_io on kernels without PSI
+	errs    []error
+}
+
+// SkippedSampler is a sampler CollectSystem didn't use and why
+type SkippedSampler struct {
+	Name string
+	Err  error
+}
+
+type samplerFile struct {
+	sampler Sampler
+	fd      *os.File
+}
+
+// CollectSystem starts a goroutine that calls every sampler at the
+// interval and writes their values to <dir>/<name>.csv until Stop() is
+// called. Samplers that fail on the first try are skipped: the file may not
+// exist or, like /proc/pressure/io with psi=0, may fail with EOPNOTSUPP.
+// Anything failing later only stops that sampler.
+func CollectSystem(dir string, proc Procfs, samplers []Sampler, interval time.Duration) (*SystemCollector, error) {
+	sc := SystemCollector{
+		finish: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	var files []*samplerFile
+	closeAll := func() {
+		for _, sf := range files {
+			if sf.fd != nil {
+				sf.fd.Close()
+			}
+		}
+	}
+
+	for _, s := range samplers {
+		if _, err := s.Sample(proc); err != nil {
+			sc.Skipped = append(sc.Skipped, SkippedSampler{s.Name(), err})
+			continue
+		}
+
+		fname := path.Join(dir, s.Name()+".csv")
+		fd, err := os.OpenFile(fname, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("could not open file for writing %s: %w", s.Name(), err)
+		}
+		files = append(files, &samplerFile{s, fd})
+	}
+
+	sample := func() {
+		now := time.Now().UnixNano()
+		for _, sf := range files {
+			if sf.fd == nil {
+				continue // failed earlier
+			}
+
+			vals, err := sf.sampler.Sample(proc)
+			if err == nil {
+				var buf bytes.Buffer
+				for _, v := range vals {
+					fmt.Fprintf(&buf, "%d,%s,%s\n", now, v.Key, strconv.FormatFloat(v.Value, 'f', -1, 64))
+				}
+				_, err = sf.fd.Write(buf.Bytes())
+			}
+
+			if err != nil {
+				sc.errs = append(sc.errs, fmt.Errorf("%s: %w", sf.sampler.Name(), err))
+				sf.fd.Close()
+				sf.fd = nil
+			}
+		}
+	}
+
+	go func() {
+		defer close(sc.done)
+		defer closeAll()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		sample()
+		for {
+			select {
+			case <-ticker.C:
+				sample()
+			case <-sc.finish:
+				sample()
+				return
+			}
+		}
+	}()
+
+	return &sc, nil
+}
+
+// Stop collection and wait for the CSV files to be closed. Returns the
+// errors that stopped samplers early, if any. A nil collector is a no-op.
+func (sc *SystemCollector) Stop() []error {
+	if sc == nil {
+		return nil
+	}
+
+	close(sc.finish)
+	<-sc.done
+
+	return sc.errs
+}
+
+// SystemSummary is one sampler's CSV summarized
+type SystemSummary struct {
+	Name    string          `json:"name"` // sampler name, e.g. vmstat
+	Samples int             `json:"samples"`
+	Seconds float64         `json:"seconds"` // first sample to last
+	Metrics []MetricSummary `json:"metrics"` // sorted by key
+}
+
+// MetricSummary is one key from a sampler. For counters min, max and
+// average are of the per-second rate between samples, for everything else
+// they're of the values.
+type MetricSummary struct {
+	Key     string  `json:"key"`
+	Counter bool    `json:"counter"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	Average float64 `json:"average"`
+	Total   float64 `json:"total,omitempty"` // counters only, last sample - first
+}
+
+type systemPoint struct {
+	ts  int64
+	val float64
+}
+
+// SummarizeSystem summarizes every sampler CSV in the test directory.
+// Counters that never moved are left out, /proc/interrupts and vmstat have
+// lots of those.
+func SummarizeSystem(dir string) (out []SystemSummary, err error) {
+	for _, s := range DefaultSamplers() {
+		fname := path.Join(dir, s.Name()+".csv")
+		if fi, err := os.Stat(fname); err != nil || fi.Size() == 0 {
+			continue
+		}
+
+		smry, err := summarizeSamplerCSV(fname, s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, smry)
+	}
+
+	return out, nil
+}
+
+func summarizeSamplerCSV(fname string, s Sampler) (smry SystemSummary, err error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return smry, err
+	}
+
+	series := make(map[string][]systemPoint)
+	times := make(map[int64]bool)
+	var minTs, maxTs int64 = math.MaxInt64, math.MinInt64
+
+	for lno, row := range bytes.Split(bytes.TrimRight(data, "\n"), []byte{'\n'}) {
+		// keys can't have commas in them so split from both ends
+		line := string(row)
+		first, last := strings.Index(line, ","), strings.LastIndex(line, ",")
+		if first < 0 || first == last {
+			return smry, &ParseError{fname, lno + 1, fmt.Errorf("expected 3 fields")}
+		}
+
+		ts, err := strconv.ParseInt(line[:first], 10, 64)
+		if err != nil {
+			return smry, &ParseError{fname, lno + 1, err}
+		}
+		val, err := strconv.ParseFloat(line[last+1:], 64)
+		if err != nil {
+			return smry, &ParseError{fname, lno + 1, err}
+		}
+
+		key := line[first+1 : last]
+		series[key] = append(series[key], systemPoint{ts, val})
+		times[ts] = true
+		if ts < minTs {
+			minTs = ts
+		}
+		if ts > maxTs {
+			maxTs = ts
+		}
+	}
+
+	smry.Name = s.Name()
+	smry.Samples = len(times)
+	smry.Seconds = float64(maxTs-minTs) / 1e9
+	smry.Metrics = []MetricSummary{}
+
+	for key, pts := range series {
+		ms := MetricSummary{Key: key, Counter: s.Counter(key)}
+
+		if ms.Counter {
+			if len(pts) < 2 {
+				continue
+			}
+			ms.Total = pts[len(pts)-1].val - pts[0].val
+			if ms.Total == 0 {
+				continue
+			}
+
+			var rates []float64
+			for i := 1; i < len(pts); i++ {
+				secs := float64(pts[i].ts-pts[i-1].ts) / 1e9
+				if secs > 0 && pts[i].val >= pts[i-1].val {
+					rates = append(rates, (pts[i].val-pts[i-1].val)/secs)
+				}
+			}
+			ms.Min, ms.Max, ms.Average = minMaxAvg(rates)
+		} else {
+			vals := make([]float64, len(pts))
+			for i, pt := range pts {
+				vals[i] = pt.val
+			}
+			ms.Min, ms.Max, ms.Average = minMaxAvg(vals)
+		}
+
+		smry.Metrics = append(smry.Metrics, ms)
+	}
+
+	sort.Slice(smry.Metrics, func(i, j int) bool { return smry.Metrics[i].Key < smry.Metrics[j].Key })
+
+	return smry, nil
+}
+
+func minMaxAvg(vals []float64) (min, max, avg float64) {
+	if len(vals) == 0 {
+		return 0, 0, 0
+	}
+
+	min, max = vals[0], vals[0]
+	sum := 0.0
+	for _, v := range vals {
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+		sum += v
+	}
+
+	return min, max, sum / float64(len(vals))
+}
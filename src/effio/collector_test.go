@@ -0,0 +1,215 @@
+package effio
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func writeProcFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		fname := path.Join(root, name)
+		if err := os.MkdirAll(path.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func sampleMap(t *testing.T, s Sampler, proc Procfs) map[string]float64 {
+	vals, err := s.Sample(proc)
+	if err != nil {
+		t.Fatalf("%s: %s", s.Name(), err)
+	}
+	out := make(map[string]float64)
+	for _, v := range vals {
+		out[v.Key] = v.Value
+	}
+	return out
+}
+
+func TestSamplers(t *testing.T) {
+	proc := Procfs{Root: t.TempDir()}
+	writeProcFiles(t, proc.Root, map[string]string{
+		"stat": "cpu  100 0 50 800 50 0 0 0 0 0\ncpu0 100 0 50 800 50 0 0 0 0 0\n" +
+			"intr 5000 10 20 0\nctxt 9000\nbtime 1600000000\nprocesses 300\nprocs_running 2\nprocs_blocked 1\n",
+		"vmstat":      "nr_free_pages 1000\nnr_dirtied 50\npgpgin 10\npgpgout 20\n",
+		"meminfo":     "MemTotal:       1024 kB\nDirty:            8 kB\nHugePages_Total:   0\n",
+		"interrupts":  "           CPU0       CPU1\n  0:         44          1   IO-APIC   2-edge      timer\n130:   100   200   PCI-MSI 1048576-edge      nvme0q1\nLOC:    10    20   Local timer interrupts\nERR:          0\n",
+		"pressure/io": "some avg10=1.50 avg60=0.20 avg300=0.00 total=12345\nfull avg10=0.50 avg60=0.10 avg300=0.00 total=2345\n",
+	})
+
+	stat := &StatSampler{}
+	vals := sampleMap(t, stat, proc)
+	if vals["cpu_user"] != 100 || vals["ctxt"] != 9000 || vals["intr"] != 5000 || vals["procs_blocked"] != 1 {
+		t.Errorf("bad /proc/stat values %v", vals)
+	}
+	if _, ok := vals["cpu_busy_pct"]; ok {
+		t.Errorf("cpu_busy_pct needs a previous sample")
+	}
+
+	// 100 jiffies later: 30 user, 10 system, 40 idle, 20 iowait
+	writeProcFiles(t, proc.Root, map[string]string{"stat": "cpu  130 0 60 840 70 0 0 0 0 0\n"})
+	vals = sampleMap(t, stat, proc)
+	if vals["cpu_busy_pct"] != 40 || vals["cpu_iowait_pct"] != 20 {
+		t.Errorf("expected 40%% busy and 20%% iowait, got %v", vals)
+	}
+	if !stat.Counter("cpu_user") || stat.Counter("cpu_busy_pct") || stat.Counter("procs_running") {
+		t.Errorf("wrong counters for stat")
+	}
+
+	vals = sampleMap(t, MeminfoSampler{}, proc)
+	if vals["MemTotal"] != 1048576 || vals["HugePages_Total"] != 0 {
+		t.Errorf("bad meminfo values %v", vals)
+	}
+
+	vals = sampleMap(t, VmstatSampler{}, proc)
+	if len(vals) != 4 || vals["pgpgout"] != 20 {
+		t.Errorf("bad vmstat values %v", vals)
+	}
+	if (VmstatSampler{}).Counter("nr_free_pages") || !(VmstatSampler{}).Counter("nr_dirtied") || !(VmstatSampler{}).Counter("pgpgin") {
+		t.Errorf("wrong counters for vmstat")
+	}
+
+	vals = sampleMap(t, InterruptsSampler{}, proc)
+	expect := map[string]float64{"0:timer": 45, "130:nvme0q1": 300, "LOC": 30, "ERR": 0}
+	if len(vals) != len(expect) {
+		t.Errorf("expected %v, got %v", expect, vals)
+	}
+	for k, v := range expect {
+		if got, ok := vals[k]; !ok || got != v {
+			t.Errorf("interrupt %s: expected %g, got %g", k, v, got)
+		}
+	}
+
+	writeProcFiles(t, proc.Root, map[string]string{"interrupts": ""})
+	if _, err := (InterruptsSampler{}).Sample(proc); err == nil {
+		t.Error("an empty /proc/interrupts should be an error")
+	}
+
+	vals = sampleMap(t, PressureSampler{"io"}, proc)
+	if vals["some_avg10"] != 1.5 || vals["full_total"] != 2345 || len(vals) != 8 {
+		t.Errorf("bad pressure values %v", vals)
+	}
+}
+
+func TestCollectSystem(t *testing.T) {
+	proc := Procfs{Root: t.TempDir()}
+	writeProcFiles(t, proc.Root, map[string]string{
+		"stat":    "cpu  100 0 50 800 50 0 0 0 0 0\nctxt 9000\nprocs_running 2\n",
+		"meminfo": "MemTotal:       1024 kB\nDirty:            8 kB\n",
+	})
+
+	dir := t.TempDir()
+	samplers := []Sampler{&StatSampler{}, MeminfoSampler{}, PressureSampler{"io"}}
+	sc, err := CollectSystem(dir, proc, samplers, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if errs := sc.Stop(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	if len(sc.Skipped) != 1 || sc.Skipped[0].Name != "pressure_io" {
+		t.Errorf("pressure_io should be skipped, got %v", sc.Skipped)
+	}
+	if _, err := os.Stat(path.Join(dir, "pressure_io.csv")); !os.IsNotExist(err) {
+		t.Errorf("there should be no pressure_io.csv")
+	}
+
+	smrys, err := SummarizeSystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(smrys) != 2 || smrys[0].Name != "stat" || smrys[1].Name != "meminfo" {
+		t.Fatalf("expected stat and meminfo summaries, got %+v", smrys)
+	}
+	if smrys[0].Samples < 2 || smrys[0].Seconds <= 0 {
+		t.Errorf("expected at least 2 samples, got %+v", smrys[0])
+	}
+
+	// counters that didn't move are dropped
+	if len(smrys[0].Metrics) != 1 || smrys[0].Metrics[0].Key != "procs_running" || smrys[0].Metrics[0].Average != 2 {
+		t.Errorf("only procs_running should be left in stat, got %+v", smrys[0].Metrics)
+	}
+	if len(smrys[1].Metrics) != 2 || smrys[1].Metrics[0].Key != "Dirty" || smrys[1].Metrics[0].Max != 8192 {
+		t.Errorf("bad meminfo summary %+v", smrys[1].Metrics)
+	}
+}
+
+// failSampler fails like /proc/pressure/io does on a kernel booted with psi=0
+type failSampler struct{}
+
+func (failSampler) Name() string            { return "fail" }
+func (failSampler) Counter(key string) bool { return false }
+func (failSampler) Sample(proc Procfs) ([]SampleValue, error) {
+	return nil, &os.PathError{Op: "read", Path: "/proc/pressure/io", Err: syscall.EOPNOTSUPP}
+}
+
+// any error on the first try skips the sampler, not only a missing file
+func TestCollectSystemSkipsFailing(t *testing.T) {
+	proc := Procfs{Root: t.TempDir()}
+	writeProcFiles(t, proc.Root, map[string]string{"meminfo": "MemTotal:       1024 kB\n"})
+
+	dir := t.TempDir()
+	sc, err := CollectSystem(dir, proc, []Sampler{MeminfoSampler{}, failSampler{}}, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if errs := sc.Stop(); len(errs) != 0 {
+		t.Errorf("a skipped sampler shouldn't fail the collector: %v", errs)
+	}
+
+	if len(sc.Skipped) != 1 || sc.Skipped[0].Name != "fail" || !errors.Is(sc.Skipped[0].Err, syscall.EOPNOTSUPP) {
+		t.Errorf("fail should be skipped with EOPNOTSUPP, got %v", sc.Skipped)
+	}
+	if _, err := os.Stat(path.Join(dir, "fail.csv")); !os.IsNotExist(err) {
+		t.Errorf("there should be no fail.csv")
+	}
+}
+
+func TestSummarizeSystemRates(t *testing.T) {
+	dir := t.TempDir()
+	csv := "" +
+		"1000000000,pgpgin,100\n1000000000,nr_dirty,10\n" +
+		"2000000000,pgpgin,300\n2000000000,nr_dirty,30\n" +
+		"4000000000,pgpgin,1100\n4000000000,nr_dirty,20\n"
+	if err := ioutil.WriteFile(path.Join(dir, "vmstat.csv"), []byte(csv), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	smrys, err := SummarizeSystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(smrys) != 1 || smrys[0].Samples != 3 || smrys[0].Seconds != 3 {
+		t.Fatalf("expected one vmstat summary over 3 seconds, got %+v", smrys)
+	}
+
+	near := func(what string, got, expect float64) {
+		if math.Abs(got-expect) > 0.001 {
+			t.Errorf("%s: expected %g, got %g", what, expect, got)
+		}
+	}
+
+	dirty, pgpgin := smrys[0].Metrics[0], smrys[0].Metrics[1]
+	if dirty.Counter || !pgpgin.Counter {
+		t.Fatalf("nr_dirty is a gauge and pgpgin a counter, got %+v", smrys[0].Metrics)
+	}
+	near("nr_dirty min", dirty.Min, 10)
+	near("nr_dirty max", dirty.Max, 30)
+	near("nr_dirty avg", dirty.Average, 20)
+	near("pgpgin total", pgpgin.Total, 1000)
+	near("pgpgin min rate", pgpgin.Min, 200)
+	near("pgpgin max rate", pgpgin.Max, 400)
+	near("pgpgin avg rate", pgpgin.Average, 300)
+}
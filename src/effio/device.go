@@ -5,10 +5,11 @@ package effio
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
+	"path/filepath"
 	"syscall"
 )
 
@@ -30,6 +31,22 @@ type Device struct {
 	Blocksize  int    `json:"blocksize"`
 	RPM        int    `json:"rpm"`
 	DoMount    bool   `json:"mount"`
+	Kind       string `json:"kind"`   // disk, partition, md, dm, see sysfs.go
+	Parent     string `json:"parent"` // kernel name of the whole disk, e.g. nvme0n1 for nvme0n1p1
+	Vendor     string `json:"vendor"` // SCSI vendor, empty for SATA and NVMe
+	Firmware   string `json:"firmware"`
+	Serial     string `json:"serial"`
+	LogicalBS  int    `json:"logical_blocksize"`
+	Discard    bool   `json:"discard"`
+	QueueDepth int    `json:"queue_depth"`
+	Scheduler  string `json:"scheduler"`
+	// mount options, e.g. "noatime,discard", defaults to noatime,nodiratime
+	MountOptions string `json:"mount_options"`
+	// also collect diskstats for the parent disk and md/dm slaves
+	DiskstatsRelated bool `json:"diskstats_related"`
+	// prepare can only erase devices that say it's ok, see prepare.go
+	Destroyable bool           `json:"destroyable"`
+	Prepare     *PreparePolicy `json:"prepare"`
 }
 
 type Devices []Device
@@ -56,9 +73,10 @@ func (d *Device) IsMounted() (bool, error) {
 	}
 }
 
+// Mount the device if the device json asks for it. Errors are a *MountError.
 func (d *Device) Mount() error {
 	if d.Mountpoint == "" {
-		return errors.New("'mountpoint' must be defined in device json for mounting support")
+		return d.mountError("mount", errors.New("'mountpoint' must be defined in device json for mounting support"))
 	}
 
 	// device is expected to be mounted, nothing to do
@@ -67,36 +85,72 @@ func (d *Device) Mount() error {
 	}
 
 	if d.Device == "" {
-		return errors.New("'device' must be defined in device json for mounting support")
+		return d.mountError("mount", errors.New("'device' must be defined in device json for mounting support"))
 	}
 	if d.Filesystem == "" {
-		return errors.New("'filesystem' must be defined in device json for mounting support")
+		return d.mountError("mount", errors.New("'filesystem' must be defined in device json for mounting support"))
 	}
 
 	if err := os.MkdirAll(d.Mountpoint, 0755); err != nil {
-		return err
+		return d.mountError("mount", err)
 	}
 
-	var flags uintptr
-	flags = syscall.MS_NOATIME | syscall.MS_NODIRATIME
-	data := ""
+	opts, err := ParseMountOptions(d.MountOptions)
+	if err != nil {
+		return d.mountError("mount", err)
+	}
+
+	err = syscall.Mount(d.Device, d.Mountpoint, d.Filesystem, opts.flags, opts.Data)
+	if err != nil {
+		return d.mountError("mount", err)
+	}
 
-	return syscall.Mount(d.Device, d.Mountpoint, d.Filesystem, uintptr(flags), data)
+	return nil
 }
 
+// Umount the device if effio mounted it. Errors are a *MountError.
 func (d *Device) Umount() error {
 	if !d.DoMount {
 		return nil
 	}
-	return syscall.Unmount(d.Mountpoint, 0)
+
+	err := syscall.Unmount(d.Mountpoint, 0)
+	if err != nil {
+		return d.mountError("umount", err)
+	}
+
+	return nil
 }
 
-func (d *Device) ToJson() string {
+func (d *Device) mountError(op string, err error) error {
+	return &MountError{Op: op, Device: d.Device, Mountpoint: d.Mountpoint, Err: err}
+}
+
+func (d *Device) ToJson() (string, error) {
 	js, err := json.MarshalIndent(d, "  ", "  ")
 	if err != nil {
-		log.Fatalf("Failed to encode device as JSON: %s\n", err)
+		return "", fmt.Errorf("failed to encode device as JSON: %s", err)
+	}
+	return string(js), nil
+}
+
+// busyKeys returns the resources a test on this device ties up: the
+// device, with symlinks like /dev/disk/by-id resolved, and the mountpoint.
+// Tests with a key in common can't run in parallel.
+func (d *Device) busyKeys() (keys []string) {
+	if d.Device != "" {
+		dev, err := filepath.EvalSymlinks(d.Device)
+		if err != nil {
+			dev = d.Device
+		}
+		keys = append(keys, "dev:"+dev)
+	}
+
+	if d.Mountpoint != "" {
+		keys = append(keys, "mnt:"+path.Clean(d.Mountpoint))
 	}
-	return string(js)
+
+	return keys
 }
 
 // implement the sort interface
@@ -114,15 +168,15 @@ func (devs Devices) Less(i, j int) bool {
 	return devs[i].Mountpoint < devs[j].Mountpoint
 }
 
-func LoadDevicesFile(fname string) (devs Devices) {
+func LoadDevicesFile(fname string) (devs Devices, err error) {
 	mdbuf, err := ioutil.ReadFile(fname)
 	if err != nil {
-		log.Fatalf("Could not read '%s': %s\n", fname, err)
+		return nil, fmt.Errorf("could not read device JSON: %w", err)
 	}
 	err = json.Unmarshal(mdbuf, &devs)
 	if err != nil {
-		log.Fatalf("Could not parse JSON: %s\n", err)
+		return nil, jsonParseError(fname, mdbuf, err)
 	}
 
-	return devs
+	return devs, nil
 }
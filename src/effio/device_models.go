@@ -0,0 +1,68 @@
+package effio
+
+// Known drive models, for filling in the things sysfs can't tell us like
+// the brand, media and spindle speed. Add to the table as new drives show
+// up in the lab. More specific patterns go before general ones since the
+// first match wins.
+
+import (
+	"regexp"
+	"strings"
+)
+
+type DeviceModel struct {
+	Pattern *regexp.Regexp // matched against the model from sysfs
+	Brand   string
+	Media   string // MLC, TLC, Iron, hybrid, etc.
+	RPM     int
+}
+
+var DeviceModels = []DeviceModel{
+	{regexp.MustCompile(`^Samsung SSD 8[45]0 PRO`), "Samsung", "MLC", 0},
+	{regexp.MustCompile(`^Samsung SSD 8[45]0 EVO`), "Samsung", "TLC", 0},
+	{regexp.MustCompile(`^Samsung SSD 9[5-8]0 PRO`), "Samsung", "MLC", 0},
+	{regexp.MustCompile(`^Samsung SSD 9[67]0 EVO`), "Samsung", "TLC", 0},
+	{regexp.MustCompile(`^(Samsung|SAMSUNG)`), "Samsung", "", 0},
+	{regexp.MustCompile(`^INTEL SSD`), "Intel", "", 0},
+	{regexp.MustCompile(`^(Crucial_)?CT\d`), "Crucial", "", 0},
+	{regexp.MustCompile(`^Micron`), "Micron", "", 0},
+	{regexp.MustCompile(`^KINGSTON`), "Kingston", "", 0},
+	{regexp.MustCompile(`^APPLE SSD`), "Apple", "", 0},
+	{regexp.MustCompile(`^MRD`), "I/O Switch", "MLC", 0},
+	{regexp.MustCompile(`^SSD\d`), "PNY", "MLC", 0},
+	{regexp.MustCompile(`^ST3300657SS`), "Seagate", "Iron", 15000},
+	{regexp.MustCompile(`^ST9500430SS`), "Seagate", "Iron", 7200},
+	{regexp.MustCompile(`^ST31000340NS`), "Seagate", "Iron", 7200},
+	{regexp.MustCompile(`^ST\d+DM`), "Seagate", "Iron", 0}, // desktop drives vary, 5900 or 7200
+	{regexp.MustCompile(`^ST\d+DX`), "Seagate", "hybrid", 7200},
+	{regexp.MustCompile(`^ST\d`), "Seagate", "Iron", 0},
+	{regexp.MustCompile(`^WDC WD\d+BLFS`), "Western Digital", "Iron", 10000},
+	{regexp.MustCompile(`^WDC WD\d+(EZRX|EFRX)`), "Western Digital", "Iron", 5400},
+	{regexp.MustCompile(`^WDC WD\d+(FYYZ|FZEX|FZRX)`), "Western Digital", "Iron", 7200},
+	{regexp.MustCompile(`^WDC `), "Western Digital", "", 0},
+	{regexp.MustCompile(`^WD`), "Western Digital", "", 0}, // e.g. NVMe and USB drives without the WDC prefix
+	{regexp.MustCompile(`^(HGST|HUS|HUH)`), "HGST", "Iron", 0},
+	{regexp.MustCompile(`^TOSHIBA`), "Toshiba", "", 0},
+	{regexp.MustCompile(`^Amazon Elastic Block Store`), "Amazon", "unknown", 0},
+	{regexp.MustCompile(`^PersistentDisk`), "Google", "unknown", 0},
+	{regexp.MustCompile(`^(VMware|Virtual disk)`), "VMware", "unknown", 0},
+	{regexp.MustCompile(`^QEMU`), "QEMU", "unknown", 0},
+}
+
+// LookupDeviceModel finds the first entry in DeviceModels matching the
+// model. When nothing matches, the SCSI vendor is used as the brand if
+// there is one, otherwise it's Generic.
+func LookupDeviceModel(vendor, model string) DeviceModel {
+	for _, dm := range DeviceModels {
+		if dm.Pattern.MatchString(model) {
+			return dm
+		}
+	}
+
+	vendor = strings.TrimSpace(vendor)
+	if vendor != "" && vendor != "ATA" {
+		return DeviceModel{Brand: vendor}
+	}
+
+	return DeviceModel{Brand: "Generic"}
+}
@@ -0,0 +1,178 @@
+package effio
+
+// Errors returned by package effio. Everything in the package returns errors
+// rather than exiting so it can be used as a library; cmd.go is the only
+// place they get turned into messages and exit codes.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ErrFioNotFound is returned when there is no fio command in PATH.
+var ErrFioNotFound = errors.New("could not locate an fio command in PATH")
+
+// ErrInterrupted is returned by FioCommand.Run and Suite.Run when fio was
+// stopped by a signal.
+var ErrInterrupted = errors.New("interrupted by signal")
+
+// MountError is returned when mounting or unmounting a device fails.
+type MountError struct {
+	Op         string // mount or umount
+	Device     string
+	Mountpoint string
+	Err        error
+}
+
+func (e *MountError) Error() string {
+	return fmt.Sprintf("%s '%s' on '%s' failed: %s", e.Op, e.Device, e.Mountpoint, e.Err)
+}
+
+func (e *MountError) Unwrap() error { return e.Err }
+
+// TemplateError is returned when an fio config template fails to parse
+// or execute.
+type TemplateError struct {
+	Template string // path to the template file
+	Test     string // name of the FioCommand being rendered, empty for parse errors
+	Err      error
+}
+
+func (e *TemplateError) Error() string {
+	if e.Test == "" {
+		return fmt.Sprintf("template '%s' failed to parse: %s", e.Template, e.Err)
+	}
+	return fmt.Sprintf("template '%s' failed for %s: %s", e.Template, e.Test, e.Err)
+}
+
+func (e *TemplateError) Unwrap() error { return e.Err }
+
+// PrepareError is returned when a step of a device's prepare policy fails
+// or the device isn't safe to erase, see prepare.go.
+type PrepareError struct {
+	Device string
+	Step   string // check, discard, precondition or mkfs
+	Err    error
+}
+
+func (e *PrepareError) Error() string {
+	return fmt.Sprintf("prepare %s of '%s' failed: %s", e.Step, e.Device, e.Err)
+}
+
+func (e *PrepareError) Unwrap() error { return e.Err }
+
+// UnsafeDeviceError is returned by Suite.CheckSafety() for a device that
+// would be written over while it's in use, see safety.go.
+type UnsafeDeviceError struct {
+	Device string
+	Why    string   // what would destroy data, e.g. a test writing to the raw device
+	Uses   []string // everything using the device, e.g. "sdb1 is mounted on /home"
+}
+
+func (e *UnsafeDeviceError) Error() string {
+	return fmt.Sprintf("refusing to use '%s', %s but %s", e.Device, e.Why, strings.Join(e.Uses, ", "))
+}
+
+// ParseError is returned when a file effio reads can't be parsed.
+// Line is 0 when the line number isn't known.
+type ParseError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("parse failed in '%s' at line %d: %s", e.File, e.Line, e.Err)
+	}
+	return fmt.Sprintf("parse failed in '%s': %s", e.File, e.Err)
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// ConfigError is a problem FioCommand.Validate() found in a rendered fio
+// config. Warnings are reported but don't stop a suite from running.
+type ConfigError struct {
+	Test    string
+	Line    int // line in the rendered config, 0 when it's about the whole file
+	Warning bool
+	Err     error
+}
+
+func (e *ConfigError) Error() string {
+	level := "error"
+	if e.Warning {
+		level = "warning"
+	}
+	if e.Line > 0 {
+		return fmt.Sprintf("%s: %s at config.fio line %d: %s", level, e.Test, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %s", level, e.Test, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+// IsWarning is true for a *ConfigError that is only a warning
+func IsWarning(err error) bool {
+	var cerr *ConfigError
+	return errors.As(err, &cerr) && cerr.Warning
+}
+
+// FailedTestsError is returned by the run command when some of the tests
+// in a suite failed.
+type FailedTestsError struct {
+	Failed  int
+	Total   int
+	Journal string
+}
+
+func (e *FailedTestsError) Error() string {
+	return fmt.Sprintf("%d of %d benchmarks failed, see %s for details", e.Failed, e.Total, e.Journal)
+}
+
+// jsonParseError converts errors from encoding/json into a ParseError with
+// the line number filled in when json can tell where it went wrong.
+func jsonParseError(fname string, data []byte, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	if errors.As(err, &syntaxErr) {
+		offset = syntaxErr.Offset
+	} else if errors.As(err, &typeErr) {
+		offset = typeErr.Offset
+	} else {
+		return &ParseError{File: fname, Err: err}
+	}
+
+	line := 1
+	for i := int64(0); i < offset && i < int64(len(data)); i++ {
+		if data[i] == '\n' {
+			line++
+		}
+	}
+
+	return &ParseError{File: fname, Line: line, Err: err}
+}
+
+// ExitCode maps an error from package effio to a process exit status.
+func ExitCode(err error) int {
+	var exitErr *exec.ExitError
+
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, ErrInterrupted):
+		return 130 // same as a shell killed by SIGINT
+	case errors.Is(err, ErrFioNotFound), errors.Is(err, os.ErrNotExist):
+		return 3
+	case errors.As(err, &exitErr):
+		return exitErr.ExitCode()
+	default:
+		return 1
+	}
+}
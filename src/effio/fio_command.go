@@ -1,14 +1,15 @@
 package effio
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -16,23 +17,36 @@ import (
 // The goal is to capture every detail of how the benchmark was generated
 // and eventually run so it can be exported with all results.
 type FioCommand struct {
-	Name        string      `json:"name"`          // name to be used in commands, files, etc.
-	FioName     string      `json:"fio_name"`      // name of the fio template
-	SuiteName   string      `json:"suite_name"`    // name of the run suite
-	Path        string      `json:"path"`          // directory for writing configs, logs, etc.
-	MinTs       time.Time   `json:"min_ts"`        // timestamp right before starting fio
-	MaxTs       time.Time   `json:"max_ts"`        // timestamp right after the process exits
-	FioArgs     []string    `json:"fio_args"`      // the arguments to the executed fio command
-	FioFile     string      `json:"fio_file"`      // generated fio config file name
-	FioJson     string      `json:"fio_json"`      // generated fio json output file name
-	FioBWLog    string      `json:"fio_bw_log"`    // filename for the bandwidth log
-	FioLatLog   string      `json:"fio_lat_log"`   // filename for the latency log
-	FioIopsLog  string      `json:"fio_iops_log"`  // filename for the iops log
-	CmdJson     string      `json:"command_json"`  // dump of the fio command data (this struct)
-	CmdScript   string      `json:"command_sh"`    // a shell script with the fio command in it
-	FioConfTmpl FioConfTmpl `json:"fio_conf_tmpl"` // template info struct
-	Device      Device      `json:"device"`        // device info struct
-	Suite       *Suite      `json:"-"`             // don't serialize to JSON
+	Name           string          `json:"name"`            // name to be used in commands, files, etc.
+	FioName        string          `json:"fio_name"`        // name of the fio template
+	SuiteName      string          `json:"suite_name"`      // name of the run suite
+	Path           string          `json:"path"`            // directory for writing configs, logs, etc.
+	MinTs          time.Time       `json:"min_ts"`          // timestamp right before starting fio
+	MaxTs          time.Time       `json:"max_ts"`          // timestamp right after the process exits
+	ExitStatus     int             `json:"exit_status"`     // exit status of fio, -1 if it did not run
+	State          string          `json:"state"`           // pending, succeeded, failed, interrupted, see journal.go
+	FioArgs        []string        `json:"fio_args"`        // the arguments to the executed fio command
+	FioFile        string          `json:"fio_file"`        // generated fio config file name
+	FioJson        string          `json:"fio_json"`        // generated fio json output file name
+	FioBWLog       string          `json:"fio_bw_log"`      // filename for the bandwidth log
+	FioLatLog      string          `json:"fio_lat_log"`     // filename for the latency log
+	FioIopsLog     string          `json:"fio_iops_log"`    // filename for the iops log
+	CmdJson        string          `json:"command_json"`    // dump of the fio command data (this struct)
+	CmdScript      string          `json:"command_sh"`      // a shell script with the fio command in it
+	FioConfTmpl    FioConfTmpl     `json:"fio_conf_tmpl"`   // template info struct
+	Params         Params          `json:"params"`          // sweep parameters for this test, available to templates
+	FioConfig      *FioConfig      `json:"fio_config"`      // the rendered config.fio, parsed
+	FioJobs        []FioJobOptions `json:"fio_jobs"`        // effective options of each job in config.fio
+	Device         Device          `json:"device"`          // device info struct
+	MountOptions   MountOptions    `json:"mount_options"`   // Device.MountOptions parsed, see mount_options.go
+	Host           *HostSnapshot   `json:"host"`            // host snapshot taken right before running
+	DeviceSnapshot *DeviceSnapshot `json:"device_snapshot"` // queue settings and mount options at run time
+	PrepareSteps   []PrepareStep   `json:"prepare_steps"`   // device preparation done right before this test
+	PrepareTs      time.Time       `json:"prepare_ts"`      // timestamp right before preparing the device, zero if it wasn't
+	PrepareElapsed float64         `json:"prepare_elapsed"` // seconds spent preparing the device, not part of MinTs/MaxTs
+	SampleInterval time.Duration   `json:"sample_interval"` // how often diskstats and system metrics are sampled, in ns
+	prepared       bool            // PrepareDevice() succeeded
+	Suite          *Suite          `json:"-"` // don't serialize to JSON
 }
 
 // FioCommands: A sortable list of FioCommand
@@ -43,94 +57,201 @@ func (fcs FioCommands) Swap(i, j int)      { fcs[i], fcs[j] = fcs[j], fcs[i] }
 func (fcs FioCommands) Less(i, j int) bool { return fcs[i].Name < fcs[j].Name }
 
 // Run() an fio benchmark
-func (fcmd *FioCommand) Run() {
-	err := os.Chdir(fcmd.Path)
-	if err != nil {
-		log.Fatalf("Could not chdir to output path '%s': %s\n", fcmd.Path, err)
-	}
+// Failures are returned rather than being fatal so a suite can carry on
+// with the rest of its tests. fio's exit status is saved in ExitStatus.
+// When intr fires, the signal is forwarded to fio and Run waits for it to
+// exit, stops diskstats collection and unmounts before returning ErrInterrupted.
+// Returns ErrFioNotFound, a *MountError, or the error from running fio, which
+// is an *exec.ExitError when fio exits non-zero.
+func (fcmd *FioCommand) Run(intr *Interrupt) error {
+	fcmd.ExitStatus = -1
 
 	fioPath, err := exec.LookPath("fio")
 	if err != nil {
-		log.Fatalf("Could not locate an fio command in PATH: %s\n", err)
+		return ErrFioNotFound
 	}
 
 	unmount := false
 	if fcmd.Device.Device != "" && fcmd.Device.Mountpoint != "" {
 		err := fcmd.Device.Mount()
 		if err != nil {
-			log.Printf(fcmd.Device.ToJson())
-			log.Fatalf("Could not mount device '%s': %s\n", fcmd.Device.Name, err)
+			return err
 		}
 		unmount = true
 	}
 
+	// after mounting so the mount options are in there
+	fcmd.TakeSnapshots(fioPath)
+
+	if fcmd.SampleInterval <= 0 {
+		fcmd.SampleInterval = time.Second
+	}
+
 	// start collecting data from /proc/diskstats in a goroutine
-	stopstats := CollectDiskstats(path.Join(fcmd.Path, "diskstats.csv"), fcmd.Device)
+	// devices like docker volumes don't have a device file to watch
+	var stats *DiskstatsCollector
+	if fcmd.Device.Device != "" {
+		stats, err = CollectDiskstats(path.Join(fcmd.Path, "diskstats.csv"), fcmd.Device, fcmd.SampleInterval)
+		if err != nil {
+			if unmount {
+				fcmd.Device.Umount()
+			}
+			return err
+		}
+	}
 
-	// set up the process
-	cmd := exec.Command(fioPath, fcmd.FioArgs...)
-	stderr, err := cmd.StderrPipe()
+	// and CPU, memory, interrupts etc. for the whole system
+	system, err := CollectSystem(fcmd.Path, DefaultProcfs, DefaultSamplers(), fcmd.SampleInterval)
 	if err != nil {
-		log.Fatal(err)
+		stats.Stop()
+		if unmount {
+			fcmd.Device.Umount()
+		}
+		return err
+	}
+	for _, skip := range system.Skipped {
+		fcmd.Printf("Not collecting %s, it isn't available on this system: %s\n", skip.Name, skip.Err)
 	}
 
+	// stop collecting and unmount no matter how fio exits
+	cleanup := func() error {
+		statsErr := stats.Stop()
+		if statsErr != nil {
+			fcmd.Printf("Diskstats collection failed: %s\n", statsErr)
+		}
+		for _, serr := range system.Stop() {
+			fcmd.Printf("System metrics collection failed: %s\n", serr)
+		}
+		for _, dn := range stats.Unseen() {
+			fcmd.Printf("Warning: %s never showed up in /proc/diskstats, diskstats.csv has no rows for it\n", dn)
+		}
+
+		if unmount {
+			if err := fcmd.Device.Umount(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// set up the process
+	// fio runs in the test directory so its logs land there; this used to
+	// chdir but that's process-wide and doesn't work with parallel tests
+	// fio gets its own process group so a ^C on the terminal only goes to
+	// effio, which then decides when to pass it along
+	var stderr bytes.Buffer
+	cmd := exec.Command(fioPath, fcmd.FioArgs...)
+	cmd.Dir = fcmd.Path
+	cmd.Stderr = &stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
 	// start running the process
 	if err := cmd.Start(); err != nil {
-		log.Fatalf("Could not run '%s %s': %s\n", fioPath, strings.Join(fcmd.FioArgs, " "))
+		cleanup()
+		return fmt.Errorf("could not run '%s %s': %s", fioPath, strings.Join(fcmd.FioArgs, " "), err)
 	}
 
-	// grab stderr in case something goes wrong
-	errors, err := ioutil.ReadAll(stderr)
-	if err != nil {
-		log.Fatal(err)
+	// wait for the process to exit in the background so signals can be handled
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	interrupted := false
+	select {
+	case err = <-exited:
+	case <-intr.Done():
+		interrupted = true
+		fcmd.Printf("Sending %s to fio (pid %d).\n", intr.Signal(), cmd.Process.Pid)
+		signalGroup(cmd.Process, intr.Signal())
+
+		select {
+		case err = <-exited:
+		case <-intr.Hard():
+			signalGroup(cmd.Process, syscall.SIGKILL)
+			err = <-exited
+		}
 	}
 
-	// blocking wait for the process to exit
-	err = cmd.Wait()
+	fcmd.ExitStatus = cmd.ProcessState.ExitCode()
 
-	// stop the diskstats collection goroutine
-	close(stopstats)
+	cleanupErr := cleanup()
 
-	if unmount {
-		err = fcmd.Device.Umount()
-		if err != nil {
-			log.Printf(fcmd.Device.ToJson())
-			log.Fatalf("Could not unmount device '%s': %s\n", fcmd.Device.Name)
+	if interrupted {
+		if cleanupErr != nil {
+			fcmd.Printf("Cleanup after interrupt failed: %s\n", cleanupErr)
 		}
+		return ErrInterrupted
 	}
 
-	// it might be OK to let 1 fio command out of a suite fail?
 	if err != nil {
-		log.Printf(string(errors))
-		log.Fatalf("Command '%s %s' failed: %s\n", fioPath, strings.Join(fcmd.FioArgs, " "), err)
+		fcmd.Printf("%s", stderr.String())
+		return fmt.Errorf("command '%s %s' failed: %w", fioPath, strings.Join(fcmd.FioArgs, " "), err)
 	}
+
+	return cleanupErr
 }
 
-// WriteFioConf() writes the fio configuration file.
+// Printf prints a message to stdout with every line prefixed by the test
+// name so output from tests running in parallel can be told apart.
+func (fcmd *FioCommand) Printf(format string, args ...interface{}) {
+	msg := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+	prefix := fmt.Sprintf("[%s] ", fcmd.Name)
+	lines := strings.Split(msg, "\n")
+	fmt.Print(prefix + strings.Join(lines, "\n"+prefix) + "\n")
+}
+
+// WriteFioConf() writes the fio configuration file as rendered and fills
+// in FioConfig and FioJobs when it parses.
 // <-path path>/<suite.Name>/<generated command name>/config.fio
-func (fcmd *FioCommand) WriteFioConf() {
+func (fcmd *FioCommand) WriteFioConf() error {
 	outfile := path.Join(fcmd.Path, fcmd.FioFile)
 
-	fd, err := os.OpenFile(outfile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	conf, err := fcmd.RenderFioConf()
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(outfile, conf, 0644)
 	if err != nil {
-		log.Fatalf("Failed to create fio config file '%s': %s\n", outfile, err)
+		return fmt.Errorf("failed to write fio config file: %w", err)
 	}
-	defer fd.Close()
 
-	err = fcmd.FioConfTmpl.tmpl.Execute(fd, fcmd)
+	// keep the parsed config for command.json so reports can group
+	// tests by the options fio actually ran with. fio may well understand
+	// things the model doesn't, so that's only worth a warning.
+	fcmd.FioConfig, fcmd.FioJobs = nil, nil
+	parsed, err := ParseFioConfig(outfile, conf)
 	if err != nil {
-		log.Fatalf("Template execution failed for '%s': %s\n", outfile, err)
+		fcmd.Printf("Warning: fio_config and fio_jobs won't be in command.json: %s\n", err)
+		return nil
 	}
+	fcmd.FioConfig = parsed
+	fcmd.FioJobs = parsed.AllJobOptions()
+
+	return nil
+}
+
+// RenderFioConf() executes the fio config template in memory and returns
+// the resulting config file. Errors are a *TemplateError.
+func (fcmd *FioCommand) RenderFioConf() ([]byte, error) {
+	var buf bytes.Buffer
+	err := fcmd.FioConfTmpl.tmpl.Execute(&buf, fcmd)
+	if err != nil {
+		return nil, &TemplateError{fcmd.FioConfTmpl.Filename, fcmd.Name, err}
+	}
+	return buf.Bytes(), nil
 }
 
 // WriteFcmdJson() dumps the fio command data to a JSON file
 // <-path path>/<suite.Name>/<fcmd.Name>/command.json
-func (fcmd *FioCommand) WriteFcmdJson() {
+func (fcmd *FioCommand) WriteFcmdJson() error {
 	outfile := path.Join(fcmd.Path, fcmd.CmdJson)
 
 	js, err := json.MarshalIndent(fcmd, "", "  ")
 	if err != nil {
-		log.Fatalf("Failed to encode command data as JSON: %s\n", err)
+		return fmt.Errorf("failed to encode command data as JSON: %s", err)
 	}
 
 	// MarshalIndent does not follow the final brace with a newline
@@ -138,56 +259,68 @@ func (fcmd *FioCommand) WriteFcmdJson() {
 
 	err = ioutil.WriteFile(outfile, js, 0644)
 	if err != nil {
-		log.Fatalf("Failed to write command JSON data file '%s': %s\n", outfile, err)
+		return fmt.Errorf("failed to write command JSON data file: %w", err)
 	}
+
+	return nil
 }
 
-func LoadFioCommandJson(filename string) (out FioCommand) {
+func LoadFioCommandJson(filename string) (out FioCommand, err error) {
 	dataBytes, err := ioutil.ReadFile(filename)
-	if os.IsNotExist(err) {
-		log.Fatalf("Could not read file %s: %s", filename, err)
+	if err != nil {
+		return out, fmt.Errorf("could not read command JSON: %w", err)
 	}
 
 	err = json.Unmarshal(dataBytes, &out)
 	if err != nil {
-		log.Fatalf("Could not parse FioCommand JSON: %s", err)
+		return out, jsonParseError(filename, dataBytes, err)
 	}
 
-	return out
+	return out, nil
 }
 
 // WriteCmdScript() writes the command to a file as a mini shell script.
 // <-path path>/<suite.Name>/<fcmd.Name>/run.sh
-func (fcmd *FioCommand) WriteCmdScript() {
+func (fcmd *FioCommand) WriteCmdScript() error {
 	outfile := path.Join(fcmd.Path, fcmd.CmdScript)
 
-	fd, err := os.OpenFile(outfile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	err := ioutil.WriteFile(outfile, fcmd.RenderCmdScript(), 0755)
 	if err != nil {
-		log.Fatalf("Failed to create command file '%s': %s\n", outfile, err)
+		return fmt.Errorf("failed to write command file: %w", err)
 	}
-	defer fd.Close()
 
+	return nil
+}
+
+// RenderCmdScript() returns the contents of run.sh.
+func (fcmd *FioCommand) RenderCmdScript() []byte {
 	// just use 'fio' if it isn't found on the path
 	fioPath, err := exec.LookPath("fio")
 	if err != nil {
 		fioPath = "fio"
 	}
-	fmt.Fprintf(fd, "#!/bin/bash -x\n%s %s\n", fioPath, strings.Join(fcmd.FioArgs, " "))
+	return []byte(fmt.Sprintf("#!/bin/bash -x\n%s %s\n", fioPath, strings.Join(fcmd.FioArgs, " ")))
 }
 
 // Returns a fully-qualified path to the lat_lat.log CSV file
+// fio >= 2.1.10 writes lat_lat.1.log, lat_lat.2.log, etc. instead, see LatLogs()
 func (fcmd *FioCommand) LatLogPath() string {
 	// fio insists on adding the _lat.log and I can't find an option to disable it
 	return path.Join(fcmd.Path, fmt.Sprintf("%s_lat.log", fcmd.FioLatLog))
 }
 
-// get the size of the latency log, return 0 on errors (e.g. missing)
+// LatLogs finds the latency log(s) written by fio for this command
+func (fcmd *FioCommand) LatLogs() (FioLogSet, error) {
+	return FindFioLogSet(fcmd.LatLogPath())
+}
+
+// get the size of the latency log(s), return 0 on errors (e.g. missing)
 func (fcmd *FioCommand) LatLogSize() int64 {
-	fi, err := os.Stat(fcmd.LatLogPath())
+	set, err := fcmd.LatLogs()
 	if err != nil {
 		return 0
 	}
-	return fi.Size()
+	return set.Size()
 }
 
 // FioJsonSize() gets the size of output.json, returns 0 on errors
@@ -0,0 +1,500 @@
+package effio
+
+// A model of fio's INI-style job files: parse, look up options the way fio
+// does, convert them to typed values, write them back out and diff them.
+// Sections are [global] or a job name, options are key=value or a bare key
+// for flags like thread, lines starting with ; or # are comments.
+// Comments and blank lines are kept with the section or option that follows
+// them so a config can be modified and written back out in the same order.
+// Lines are written back exactly as they were read unless the option was
+// changed or added with Set(), those are written as key=value.
+//
+// This is part of package effio rather than a package of its own because
+// effio is built as a single package (main.go imports ./src/effio).
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type FioConfig struct {
+	Filename string        `json:"filename"`
+	Sections []*FioSection `json:"sections"`
+	Trailer  []string      `json:"trailer,omitempty"` // comments after the last option
+}
+
+type FioSection struct {
+	Name     string      `json:"name"`
+	Line     int         `json:"line"`
+	Comments []string    `json:"comments,omitempty"` // comment and blank lines before the [name]
+	Options  []FioOption `json:"options"`
+	raw      string      // the [name] line as read
+}
+
+type FioOption struct {
+	Name     string   `json:"name"`
+	Value    string   `json:"value"`
+	HasValue bool     `json:"has_value"` // false for flags like thread
+	Line     int      `json:"line"`
+	Comments []string `json:"comments,omitempty"` // comment and blank lines before the option
+	raw      string   // the line as read, until Set() changes it
+}
+
+// The effective options of a job with [global] applied and values
+// converted, recorded in command.json for grouping tests in reports.
+// Unset options have fio's defaults except ioengine, which is left empty
+// since the default has changed between fio versions.
+type FioJobOptions struct {
+	Name      string  `json:"name"`
+	Rw        string  `json:"rw"`
+	Bs        int64   `json:"bs"` // the first size when bs has separate read,write sizes
+	Iodepth   int64   `json:"iodepth"`
+	Ioengine  string  `json:"ioengine"`
+	Numjobs   int64   `json:"numjobs"`
+	RwMixRead int64   `json:"rwmixread"`
+	Direct    bool    `json:"direct"`
+	Size      int64   `json:"size"`
+	Runtime   float64 `json:"runtime"` // seconds
+	TimeBased bool    `json:"time_based"`
+	// raw values of options that didn't convert, e.g. iodepth=${IODEPTH},
+	// their typed field above is 0
+	Unparsed map[string]string `json:"unparsed,omitempty"`
+}
+
+// kinds of fio option values, see FioOptionType()
+const (
+	FioString = "string"
+	FioInt    = "int"
+	FioSize   = "size"
+	FioBool   = "bool"
+	FioTime   = "time"
+)
+
+// types of the options effio cares about, anything else is a FioString
+var fioOptionTypes = map[string]string{
+	"bs":                     FioSize,
+	"size":                   FioSize,
+	"filesize":               FioSize,
+	"io_size":                FioSize,
+	"offset":                 FioSize,
+	"iodepth":                FioInt,
+	"iodepth_batch":          FioInt,
+	"iodepth_batch_complete": FioInt,
+	"numjobs":                FioInt,
+	"nrfiles":                FioInt,
+	"rwmixread":              FioInt,
+	"rwmixwrite":             FioInt,
+	"direct":                 FioBool,
+	"buffered":               FioBool,
+	"thread":                 FioBool,
+	"time_based":             FioBool,
+	"group_reporting":        FioBool,
+	"norandommap":            FioBool,
+	"randrepeat":             FioBool,
+	"unlink":                 FioBool,
+	"disable_lat":            FioBool,
+	"disable_clat":           FioBool,
+	"disable_slat":           FioBool,
+	"runtime":                FioTime,
+	"ramp_time":              FioTime,
+	"startdelay":             FioTime,
+}
+
+// fio accepts more than one name for some options, look them up
+// by the short name
+var fioOptionAliases = map[string]string{
+	"readwrite":  "rw",
+	"blocksize":  "bs",
+	"blockalign": "ba",
+}
+
+func canonicalFioOption(name string) string {
+	if alias, ok := fioOptionAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+// FioOptionType returns one of the Fio* type constants for an option name
+func FioOptionType(name string) string {
+	if t, ok := fioOptionTypes[canonicalFioOption(name)]; ok {
+		return t
+	}
+	return FioString
+}
+
+// ParseFioConfig parses an fio job file. fname is only used in errors.
+func ParseFioConfig(fname string, data []byte) (*FioConfig, error) {
+	conf := FioConfig{Filename: fname}
+	var cur *FioSection
+	var comments []string // waiting for the next section or option
+
+	// don't turn the final newline into a blank line
+	data = bytes.TrimSuffix(data, []byte("\n"))
+
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		raw := string(line)
+		l := strings.TrimSpace(raw)
+		if l == "" || strings.HasPrefix(l, ";") || strings.HasPrefix(l, "#") {
+			comments = append(comments, raw)
+			continue
+		}
+
+		if strings.HasPrefix(l, "[") {
+			if !strings.HasSuffix(l, "]") {
+				return nil, &ParseError{File: fname, Line: i + 1, Err: fmt.Errorf("unterminated section name")}
+			}
+
+			name := strings.TrimSpace(l[1 : len(l)-1])
+			if name == "" {
+				return nil, &ParseError{File: fname, Line: i + 1, Err: fmt.Errorf("empty section name")}
+			}
+
+			cur = &FioSection{Name: name, Line: i + 1, Comments: comments, raw: raw}
+			comments = nil
+			conf.Sections = append(conf.Sections, cur)
+			continue
+		}
+
+		if cur == nil {
+			return nil, &ParseError{File: fname, Line: i + 1, Err: fmt.Errorf("option outside of a section")}
+		}
+
+		opt := FioOption{Line: i + 1, Comments: comments, raw: raw}
+		comments = nil
+		if kv := strings.SplitN(l, "=", 2); len(kv) == 2 {
+			opt.Name = strings.TrimSpace(kv[0])
+			opt.Value = strings.TrimSpace(kv[1])
+			opt.HasValue = true
+		} else {
+			opt.Name = l
+		}
+
+		if opt.Name == "" {
+			return nil, &ParseError{File: fname, Line: i + 1, Err: fmt.Errorf("option with no name")}
+		}
+
+		cur.Options = append(cur.Options, opt)
+	}
+
+	conf.Trailer = comments
+
+	return &conf, nil
+}
+
+// Bytes writes the config back out in fio's format. A config that was only
+// parsed comes out the same as it went in, plus a final newline if it was
+// missing one.
+func (c *FioConfig) Bytes() []byte {
+	var buf bytes.Buffer
+
+	writeLines := func(lines []string) {
+		for _, line := range lines {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+	}
+
+	for _, sec := range c.Sections {
+		writeLines(sec.Comments)
+		if sec.raw != "" {
+			writeLines([]string{sec.raw})
+		} else {
+			fmt.Fprintf(&buf, "[%s]\n", sec.Name)
+		}
+		for _, opt := range sec.Options {
+			writeLines(opt.Comments)
+			if opt.raw != "" {
+				writeLines([]string{opt.raw})
+			} else {
+				buf.WriteString(opt.String())
+				buf.WriteByte('\n')
+			}
+		}
+	}
+	writeLines(c.Trailer)
+
+	return buf.Bytes()
+}
+
+// IsGlobal is true for [global] sections
+func (s *FioSection) IsGlobal() bool {
+	return s.Name == "global"
+}
+
+// Get returns the value of the last occurrence of an option in the
+// section. Aliases like readwrite/rw are treated as the same option.
+func (s *FioSection) Get(name string) (opt FioOption, ok bool) {
+	name = canonicalFioOption(name)
+	for _, o := range s.Options {
+		if canonicalFioOption(o.Name) == name {
+			opt = o
+			ok = true
+		}
+	}
+	return
+}
+
+// Set changes the last occurrence of an option, or adds it to the end
+// of the section. An empty value sets a flag like thread.
+func (s *FioSection) Set(name, value string) {
+	cname := canonicalFioOption(name)
+	for i := len(s.Options) - 1; i >= 0; i-- {
+		if canonicalFioOption(s.Options[i].Name) == cname {
+			s.Options[i].Value = value
+			s.Options[i].HasValue = value != ""
+			s.Options[i].raw = ""
+			return
+		}
+	}
+
+	s.Options = append(s.Options, FioOption{Name: name, Value: value, HasValue: value != ""})
+}
+
+// Jobs returns all the sections that aren't [global]
+func (c *FioConfig) Jobs() (jobs []*FioSection) {
+	for _, s := range c.Sections {
+		if !s.IsGlobal() {
+			jobs = append(jobs, s)
+		}
+	}
+	return jobs
+}
+
+// Lookup finds the value of an option for a job the way fio does: the job's
+// own options win, then the [global] sections above it, nearest first.
+func (c *FioConfig) Lookup(job *FioSection, name string) (FioOption, bool) {
+	if opt, ok := job.Get(name); ok {
+		return opt, true
+	}
+
+	idx := len(c.Sections)
+	for i, s := range c.Sections {
+		if s == job {
+			idx = i
+			break
+		}
+	}
+
+	for i := idx - 1; i >= 0; i-- {
+		if c.Sections[i].IsGlobal() {
+			if opt, ok := c.Sections[i].Get(name); ok {
+				return opt, true
+			}
+		}
+	}
+
+	return FioOption{}, false
+}
+
+// LookupValue is Lookup for callers that only want the value
+func (c *FioConfig) LookupValue(job *FioSection, name, def string) string {
+	if opt, ok := c.Lookup(job, name); ok {
+		return opt.Value
+	}
+	return def
+}
+
+// JobOptions returns the effective, typed options for a job. Options that
+// don't convert, e.g. iodepth=${IODEPTH} or size=80% which only fio can
+// work out, are left as 0 in jo with the raw value in jo.Unparsed, and err
+// is the first of them.
+func (c *FioConfig) JobOptions(job *FioSection) (jo FioJobOptions, err error) {
+	jo, _, errs := c.jobOptions(job)
+	if len(errs) > 0 {
+		err = errs[0]
+	}
+	return jo, err
+}
+
+// jobOptions is JobOptions() with every option that didn't convert in bad
+// and a *ParseError for each in errs
+func (c *FioConfig) jobOptions(job *FioSection) (jo FioJobOptions, bad []FioOption, errs []error) {
+	jo = FioJobOptions{
+		Name:      job.Name,
+		Rw:        "read",
+		Bs:        4096,
+		Iodepth:   1,
+		Numjobs:   1,
+		RwMixRead: 50,
+	}
+
+	unparsed := func(opt FioOption, err error) {
+		if jo.Unparsed == nil {
+			jo.Unparsed = make(map[string]string)
+		}
+		jo.Unparsed[opt.Name] = opt.Value
+		bad = append(bad, opt)
+		errs = append(errs, &ParseError{File: c.Filename, Line: opt.Line, Err: fmt.Errorf("%s: %s", opt.Name, err)})
+	}
+
+	if opt, ok := c.Lookup(job, "rw"); ok {
+		// rw=randread:8 sets an offset modifier, drop it
+		jo.Rw = strings.SplitN(opt.Value, ":", 2)[0]
+	}
+
+	if opt, ok := c.Lookup(job, "bs"); ok {
+		// bs=4k,64k sets read,write sizes and bs=4k-16k is a range, take the first
+		sizes := strings.FieldsFunc(opt.Value, func(r rune) bool { return r == ',' || r == '-' })
+		var err error
+		if len(sizes) == 0 {
+			err = fmt.Errorf("no size")
+		} else {
+			jo.Bs, err = parseBytes(sizes[0])
+		}
+		if err != nil {
+			jo.Bs = 0
+			unparsed(opt, err)
+		}
+	}
+
+	ints := []struct {
+		name string
+		dst  *int64
+	}{{"iodepth", &jo.Iodepth}, {"numjobs", &jo.Numjobs}, {"rwmixread", &jo.RwMixRead}}
+	for _, i := range ints {
+		if opt, ok := c.Lookup(job, i.name); ok {
+			var err error
+			if *i.dst, err = opt.Int(); err != nil {
+				*i.dst = 0
+				unparsed(opt, err)
+			}
+		}
+	}
+
+	// fio uses rwmixwrite when only it is set
+	if opt, ok := c.Lookup(job, "rwmixwrite"); ok {
+		if _, set := c.Lookup(job, "rwmixread"); !set {
+			if w, err := opt.Int(); err != nil {
+				jo.RwMixRead = 0
+				unparsed(opt, err)
+			} else {
+				jo.RwMixRead = 100 - w
+			}
+		}
+	}
+
+	jo.Ioengine = c.LookupValue(job, "ioengine", "")
+
+	if opt, ok := c.Lookup(job, "size"); ok {
+		var err error
+		if jo.Size, err = opt.Size(); err != nil {
+			jo.Size = 0
+			unparsed(opt, err)
+		}
+	}
+
+	bools := []struct {
+		name string
+		dst  *bool
+	}{{"direct", &jo.Direct}, {"time_based", &jo.TimeBased}}
+	for _, b := range bools {
+		if opt, ok := c.Lookup(job, b.name); ok {
+			var err error
+			if *b.dst, err = opt.Bool(); err != nil {
+				*b.dst = false
+				unparsed(opt, err)
+			}
+		}
+	}
+
+	if opt, ok := c.Lookup(job, "runtime"); ok {
+		if d, err := opt.Duration(); err != nil {
+			unparsed(opt, err)
+		} else {
+			jo.Runtime = d.Seconds()
+		}
+	}
+
+	return jo, bad, errs
+}
+
+// fioDeferred is true for values only fio can work out, e.g.
+// iodepth=${IODEPTH} or size=80%
+func fioDeferred(value string) bool {
+	return strings.Contains(value, "$") || strings.HasSuffix(value, "%")
+}
+
+// AllJobOptions returns JobOptions() for every job in order, ignoring the
+// options that didn't convert. Those are in each job's Unparsed.
+func (c *FioConfig) AllJobOptions() []FioJobOptions {
+	var out []FioJobOptions
+	for _, job := range c.Jobs() {
+		jo, _ := c.JobOptions(job)
+		out = append(out, jo)
+	}
+	return out
+}
+
+func (o FioOption) String() string {
+	if o.HasValue {
+		return o.Name + "=" + o.Value
+	}
+	return o.Name
+}
+
+// Type returns the kind of value the option takes, see FioOptionType()
+func (o FioOption) Type() string {
+	return FioOptionType(o.Name)
+}
+
+func (o FioOption) Int() (int64, error) {
+	return strconv.ParseInt(o.Value, 10, 64)
+}
+
+// Size parses sizes like 4k or 1g, see parseBytes()
+func (o FioOption) Size() (int64, error) {
+	return parseBytes(o.Value)
+}
+
+// Bool is true for flags without a value and for 1/true/yes/on
+func (o FioOption) Bool() (bool, error) {
+	if !o.HasValue {
+		return true, nil
+	}
+
+	switch strings.ToLower(o.Value) {
+	case "1", "true", "yes", "on":
+		return true, nil
+	case "0", "false", "no", "off":
+		return false, nil
+	}
+
+	return false, fmt.Errorf("'%s' is not a boolean", o.Value)
+}
+
+// Duration parses fio times, which are in seconds unless they have
+// a us, ms, s, m, h or d suffix
+func (o FioOption) Duration() (time.Duration, error) {
+	v := strings.ToLower(o.Value)
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{
+		{"us", time.Microsecond},
+		{"ms", time.Millisecond},
+		{"s", time.Second},
+		{"m", time.Minute},
+		{"h", time.Hour},
+		{"d", 24 * time.Hour},
+	}
+
+	unit := time.Second
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			v = strings.TrimSuffix(v, u.suffix)
+			unit = u.unit
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a time", o.Value)
+	}
+
+	return time.Duration(n) * unit, nil
+}
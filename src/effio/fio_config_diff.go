@@ -0,0 +1,125 @@
+package effio
+
+// Diffing fio configs, e.g. to see what actually differs between two tests
+// in a suite or between a template and last year's copy of it.
+
+import (
+	"fmt"
+)
+
+const (
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+	DiffChanged = "changed"
+)
+
+// FioConfigDiff is one difference between two configs. Option is empty when
+// a whole section was added, removed or renamed, in which case Old and New
+// are the section names.
+type FioConfigDiff struct {
+	Kind    string `json:"kind"` // one of the Diff* constants
+	Section string `json:"section"`
+	Option  string `json:"option"`
+	Old     string `json:"old"`
+	New     string `json:"new"`
+}
+
+func (d FioConfigDiff) String() string {
+	if d.Option == "" {
+		switch d.Kind {
+		case DiffAdded:
+			return fmt.Sprintf("+[%s]", d.New)
+		case DiffRemoved:
+			return fmt.Sprintf("-[%s]", d.Old)
+		default:
+			return fmt.Sprintf("[%s] -> [%s]", d.Old, d.New)
+		}
+	}
+
+	switch d.Kind {
+	case DiffAdded:
+		return fmt.Sprintf("[%s] +%s", d.Section, d.New)
+	case DiffRemoved:
+		return fmt.Sprintf("[%s] -%s", d.Section, d.Old)
+	default:
+		return fmt.Sprintf("[%s] %s -> %s", d.Section, d.Old, d.New)
+	}
+}
+
+// DiffFioConfigs compares the options declared in each section of two
+// configs. Comments and option order are ignored. [global] sections are
+// matched in order, as are jobs, since effio's job names include the test
+// name and would never match between two tests.
+func DiffFioConfigs(a, b *FioConfig) (diffs []FioConfigDiff) {
+	split := func(c *FioConfig) (globals, jobs []*FioSection) {
+		for _, s := range c.Sections {
+			if s.IsGlobal() {
+				globals = append(globals, s)
+			} else {
+				jobs = append(jobs, s)
+			}
+		}
+		return
+	}
+
+	aGlobals, aJobs := split(a)
+	bGlobals, bJobs := split(b)
+
+	diffs = append(diffs, diffSectionLists(aGlobals, bGlobals)...)
+	diffs = append(diffs, diffSectionLists(aJobs, bJobs)...)
+
+	return diffs
+}
+
+func diffSectionLists(a, b []*FioSection) (diffs []FioConfigDiff) {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		switch {
+		case i >= len(b):
+			diffs = append(diffs, FioConfigDiff{Kind: DiffRemoved, Section: a[i].Name, Old: a[i].Name})
+		case i >= len(a):
+			diffs = append(diffs, FioConfigDiff{Kind: DiffAdded, Section: b[i].Name, New: b[i].Name})
+		default:
+			if a[i].Name != b[i].Name {
+				diffs = append(diffs, FioConfigDiff{Kind: DiffChanged, Section: b[i].Name, Old: a[i].Name, New: b[i].Name})
+			}
+			diffs = append(diffs, diffSections(a[i], b[i])...)
+		}
+	}
+
+	return diffs
+}
+
+// diffSections compares the last value of each option, in the order they
+// appear in a then b
+func diffSections(a, b *FioSection) (diffs []FioConfigDiff) {
+	seen := make(map[string]bool)
+
+	for _, opt := range a.Options {
+		name := canonicalFioOption(opt.Name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		aOpt, _ := a.Get(name)
+		bOpt, ok := b.Get(name)
+		if !ok {
+			diffs = append(diffs, FioConfigDiff{Kind: DiffRemoved, Section: b.Name, Option: name, Old: aOpt.String()})
+		} else if aOpt.Value != bOpt.Value || aOpt.HasValue != bOpt.HasValue {
+			diffs = append(diffs, FioConfigDiff{Kind: DiffChanged, Section: b.Name, Option: name, Old: aOpt.String(), New: bOpt.String()})
+		}
+	}
+
+	for _, opt := range b.Options {
+		name := canonicalFioOption(opt.Name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		bOpt, _ := b.Get(name)
+		diffs = append(diffs, FioConfigDiff{Kind: DiffAdded, Section: b.Name, Option: name, New: bOpt.String()})
+	}
+
+	return diffs
+}
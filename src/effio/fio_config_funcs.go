@@ -0,0 +1,242 @@
+package effio
+
+// Functions available in fio config templates so one template can adapt
+// to the device and host, e.g.
+//   size={{ humanBytes (percentOf .Device.Capacity 80) }}
+//   blocksize={{ roundUp 4000 .Device.Blocksize }}
+//   numjobs={{ ncpu }}
+//   iodepth={{ ternary .Device.Rotational 4 32 }}
+// Numeric arguments can be any Go integer or float, or a string like "4k"
+// so sweep parameters (always strings) work in arithmetic too.
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var fioConfFuncs = template.FuncMap{
+	"add": func(a, b interface{}) (int64, error) {
+		return intOp(a, b, func(x, y int64) int64 { return x + y })
+	},
+	"sub": func(a, b interface{}) (int64, error) {
+		return intOp(a, b, func(x, y int64) int64 { return x - y })
+	},
+	"mul": func(a, b interface{}) (int64, error) {
+		return intOp(a, b, func(x, y int64) int64 { return x * y })
+	},
+	"div": func(a, b interface{}) (int64, error) {
+		if y, err := toInt64(b); err == nil && y == 0 {
+			return 0, fmt.Errorf("div: division by zero")
+		}
+		return intOp(a, b, func(x, y int64) int64 { return x / y })
+	},
+	"mod": func(a, b interface{}) (int64, error) {
+		if y, err := toInt64(b); err == nil && y == 0 {
+			return 0, fmt.Errorf("mod: division by zero")
+		}
+		return intOp(a, b, func(x, y int64) int64 { return x % y })
+	},
+	"min": func(a, b interface{}) (int64, error) {
+		return intOp(a, b, func(x, y int64) int64 {
+			if x < y {
+				return x
+			}
+			return y
+		})
+	},
+	"max": func(a, b interface{}) (int64, error) {
+		return intOp(a, b, func(x, y int64) int64 {
+			if x > y {
+				return x
+			}
+			return y
+		})
+	},
+	"roundUp":    roundUp,
+	"roundDown":  roundDown,
+	"percentOf":  percentOf,
+	"humanBytes": humanBytes,
+	"parseBytes": parseBytes,
+	"ncpu":       runtime.NumCPU,
+	"memTotal":   memTotal,
+	"ternary":    ternary,
+}
+
+// fio's size suffixes, all powers of 1024 by default
+var byteUnits = []string{"", "k", "m", "g", "t", "p"}
+
+func intOp(a, b interface{}, op func(x, y int64) int64) (int64, error) {
+	x, err := toInt64(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := toInt64(b)
+	if err != nil {
+		return 0, err
+	}
+	return op(x, y), nil
+}
+
+// toInt64 converts template values to an int64. Floats are truncated.
+func toInt64(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), nil
+	case int8:
+		return int64(n), nil
+	case int16:
+		return int64(n), nil
+	case int32:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case uint:
+		return int64(n), nil
+	case uint8:
+		return int64(n), nil
+	case uint16:
+		return int64(n), nil
+	case uint32:
+		return int64(n), nil
+	case uint64:
+		return int64(n), nil
+	case float32:
+		return int64(n), nil
+	case float64:
+		return int64(n), nil
+	case string:
+		return parseBytes(n)
+	default:
+		return 0, fmt.Errorf("%v (%T) is not a number", v, v)
+	}
+}
+
+func toFloat64(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float32:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	case string:
+		if f, err := strconv.ParseFloat(n, 64); err == nil {
+			return f, nil
+		}
+	}
+
+	i, err := toInt64(v)
+	return float64(i), err
+}
+
+// roundUp rounds n up to the next multiple of m, e.g. a blocksize to
+// the device's physical block size
+func roundUp(n, m interface{}) (int64, error) {
+	x, y, err := roundArgs(n, m)
+	if err != nil {
+		return 0, err
+	}
+	return (x + y - 1) / y * y, nil
+}
+
+// roundDown rounds n down to a multiple of m
+func roundDown(n, m interface{}) (int64, error) {
+	x, y, err := roundArgs(n, m)
+	if err != nil {
+		return 0, err
+	}
+	return x / y * y, nil
+}
+
+func roundArgs(n, m interface{}) (x, y int64, err error) {
+	if x, err = toInt64(n); err != nil {
+		return
+	}
+	if y, err = toInt64(m); err != nil {
+		return
+	}
+	if y <= 0 {
+		err = fmt.Errorf("cannot round to a multiple of %d", y)
+	}
+	return
+}
+
+// percentOf returns pct percent of total, e.g. percentOf .Device.Capacity 80
+func percentOf(total, pct interface{}) (int64, error) {
+	t, err := toInt64(total)
+	if err != nil {
+		return 0, err
+	}
+	p, err := toFloat64(pct)
+	if err != nil {
+		return 0, err
+	}
+	return int64(float64(t) * p / 100), nil
+}
+
+// humanBytes formats a size the way fio reads it using the largest
+// unit that divides it evenly, e.g. 4096 -> 4k, 1536 -> 1536.
+func humanBytes(v interface{}) (string, error) {
+	n, err := toInt64(v)
+	if err != nil {
+		return "", err
+	}
+
+	unit := 0
+	for n != 0 && n%1024 == 0 && unit < len(byteUnits)-1 {
+		n /= 1024
+		unit++
+	}
+
+	return fmt.Sprintf("%d%s", n, byteUnits[unit]), nil
+}
+
+// parseBytes parses fio-style sizes: 512, 4k, 4K, 4kb, 4KiB, 1m, 2g, 1t.
+// Like fio, the suffixes are powers of 1024.
+func parseBytes(val string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(val))
+	s = strings.TrimSuffix(s, "b")
+	s = strings.TrimSuffix(s, "i")
+
+	mult := int64(1)
+	for i := len(byteUnits) - 1; i > 0; i-- {
+		if strings.HasSuffix(s, byteUnits[i]) {
+			s = strings.TrimSuffix(s, byteUnits[i])
+			mult = int64(math.Pow(1024, float64(i)))
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%s'", val)
+	}
+
+	return n * mult, nil
+}
+
+// memTotal returns the host's memory in bytes from DefaultProcfs
+func memTotal() (int64, error) {
+	mi, err := DefaultProcfs.Meminfo()
+	if err != nil {
+		return 0, err
+	}
+
+	total, ok := mi["MemTotal"]
+	if !ok {
+		return 0, &ParseError{File: DefaultProcfs.Path("meminfo"), Err: fmt.Errorf("MemTotal not found")}
+	}
+
+	return total, nil
+}
+
+// ternary returns a when cond is true and b otherwise,
+// e.g. ternary .Device.Rotational 4 32
+func ternary(cond bool, a, b interface{}) interface{} {
+	if cond {
+		return a
+	}
+	return b
+}
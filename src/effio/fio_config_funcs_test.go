@@ -0,0 +1,130 @@
+package effio
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"testing"
+	"text/template"
+)
+
+var parseBytesTestData = []struct {
+	in     string
+	expect int64
+	ok     bool
+}{
+	{"512", 512, true},
+	{"4k", 4096, true},
+	{"4K", 4096, true},
+	{"4kb", 4096, true},
+	{"4KiB", 4096, true},
+	{"1m", 1048576, true},
+	{"2g", 2147483648, true},
+	{"1t", 1099511627776, true},
+	{"", 0, false},
+	{"k", 0, false},
+	{"4x", 0, false},
+}
+
+func TestParseBytes(t *testing.T) {
+	for _, tpb := range parseBytesTestData {
+		n, err := parseBytes(tpb.in)
+		if (err == nil) != tpb.ok || n != tpb.expect {
+			t.Errorf("parseBytes(%q) = (%d, %v), expected %d", tpb.in, n, err, tpb.expect)
+		}
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:             "0",
+		512:           "512",
+		1536:          "1536",
+		4096:          "4k",
+		1048576:       "1m",
+		3221225472:    "3g",
+		1099511627776: "1t",
+	}
+
+	for in, expect := range tests {
+		out, err := humanBytes(in)
+		if err != nil || out != expect {
+			t.Errorf("humanBytes(%d) = (%q, %v), expected %q", in, out, err, expect)
+		}
+
+		// must round trip through parseBytes
+		if n, _ := parseBytes(out); n != in {
+			t.Errorf("parseBytes(humanBytes(%d)) = %d", in, n)
+		}
+	}
+}
+
+func TestFioConfFuncs(t *testing.T) {
+	fcmd := FioCommand{
+		Name:   "t",
+		Params: Params{"bs": "64k", "iodepth": "16"},
+		Device: Device{Capacity: 256060514304, Blocksize: 4096, Rotational: true},
+	}
+
+	tests := []struct {
+		tmpl   string
+		expect string
+	}{
+		{`{{ add 1 2 }}`, "3"},
+		{`{{ sub 10 4 }}`, "6"},
+		{`{{ mul .Params.iodepth 2 }}`, "32"},
+		{`{{ div .Params.bs 2 }}`, "32768"},
+		{`{{ mod 10 4 }}`, "2"},
+		{`{{ min .Params.iodepth 8 }} {{ max .Params.iodepth 8 }}`, "8 16"},
+		{`{{ roundUp 4000 .Device.Blocksize }}`, "4096"},
+		{`{{ roundDown 5000 .Device.Blocksize }}`, "4096"},
+		{`{{ percentOf .Device.Capacity 80 }}`, "204848411443"},
+		{`{{ percentOf 1000 12.5 }}`, "125"},
+		{`{{ humanBytes (roundDown (percentOf .Device.Capacity 50) 1073741824) }}`, "119g"},
+		{`{{ parseBytes .Params.bs }}`, "65536"},
+		{`{{ ternary .Device.Rotational 4 32 }}`, "4"},
+		{`{{ ncpu }}`, strconv.Itoa(runtime.NumCPU())},
+	}
+
+	for _, tt := range tests {
+		tmpl, err := template.New("t").Funcs(fioConfFuncs).Parse(tt.tmpl)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.tmpl, err)
+		}
+
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, &fcmd); err != nil {
+			t.Errorf("%s: %s", tt.tmpl, err)
+			continue
+		}
+
+		if buf.String() != tt.expect {
+			t.Errorf("%s = %q, expected %q", tt.tmpl, buf.String(), tt.expect)
+		}
+	}
+
+	for _, bad := range []string{`{{ div 1 0 }}`, `{{ roundUp 1 0 }}`, `{{ add "x" 1 }}`, `{{ mul .Device.Rotational 2 }}`} {
+		tmpl := template.Must(template.New("t").Funcs(fioConfFuncs).Parse(bad))
+		if err := tmpl.Execute(&bytes.Buffer{}, &fcmd); err == nil {
+			t.Errorf("%s should fail", bad)
+		}
+	}
+}
+
+func TestMemTotal(t *testing.T) {
+	root := t.TempDir()
+	writeProcFiles(t, root, map[string]string{"meminfo": "MemTotal:       16318452 kB\nMemFree:         1024 kB\n"})
+
+	saved := DefaultProcfs
+	DefaultProcfs = Procfs{Root: root}
+	defer func() { DefaultProcfs = saved }()
+
+	tmpl := template.Must(template.New("t").Funcs(fioConfFuncs).Parse(`{{ memTotal }}`))
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &FioCommand{}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "16710094848" {
+		t.Errorf("memTotal = %s, expected 16710094848", buf.String())
+	}
+}
@@ -0,0 +1,137 @@
+package effio
+
+// Parameter sweeps: a template random_read.fio can have a sidecar file
+// random_read.sweep.json next to it that lists values for any number of
+// parameters, e.g.
+//   {"iodepth": [1, 4, 16, 64], "bs": ["4k", "64k", "1m"]}
+// Suite.Populate() expands every combination into its own FioCommand
+// (12 tests per device in this example) and the values are available in
+// the template as {{ .Params.iodepth }}. Params are saved in command.json
+// so reports can group by them.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Sweep maps a parameter name to the list of values to test
+type Sweep map[string][]string
+
+// one combination of sweep values, the empty Params is a test without a sweep
+type Params map[string]string
+
+// anything that won't play nice in a file name
+var unsafeNameRE = regexp.MustCompile(`[^A-Za-z0-9.]+`)
+
+// sweepFilename returns the sidecar file name for a template
+func sweepFilename(tmplFile string) string {
+	return strings.TrimSuffix(tmplFile, ".fio") + ".sweep.json"
+}
+
+// LoadSweepFile loads a sweep sidecar. Values can be strings, numbers or
+// booleans and are kept exactly as written so 1e6 doesn't become 1000000.
+// A template with no sidecar has a nil Sweep and no error.
+func LoadSweepFile(fname string) (Sweep, error) {
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read sweep file: %w", err)
+	}
+
+	raw := make(map[string][]interface{})
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, jsonParseError(fname, data, err)
+	}
+
+	sweep := make(Sweep)
+	for key, vals := range raw {
+		if len(vals) == 0 {
+			return nil, &ParseError{File: fname, Err: fmt.Errorf("parameter '%s' has no values", key)}
+		}
+
+		for _, val := range vals {
+			switch v := val.(type) {
+			case string:
+				sweep[key] = append(sweep[key], v)
+			case json.Number:
+				sweep[key] = append(sweep[key], v.String())
+			case bool:
+				sweep[key] = append(sweep[key], fmt.Sprintf("%t", v))
+			default:
+				return nil, &ParseError{File: fname, Err: fmt.Errorf("parameter '%s' has a value that is not a string, number or boolean", key)}
+			}
+		}
+
+		// values have to stay distinct after cleaning them up for test names
+		seen := make(map[string]string)
+		for _, val := range sweep[key] {
+			clean := unsafeNameRE.ReplaceAllString(val, "_")
+			if prev, ok := seen[clean]; ok {
+				return nil, &ParseError{File: fname, Err: fmt.Errorf("parameter '%s' values '%s' and '%s' would generate the same test name", key, prev, val)}
+			}
+			seen[clean] = val
+		}
+	}
+
+	return sweep, nil
+}
+
+// Keys returns the parameter names in sorted order
+func (s Sweep) Keys() []string {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Expand returns every combination of the parameter values. The order is
+// stable: keys are sorted and the last key changes fastest. An empty Sweep
+// expands to one empty Params so templates without a sweep still get a test.
+func (s Sweep) Expand() []Params {
+	out := []Params{Params{}}
+
+	for _, key := range s.Keys() {
+		next := make([]Params, 0, len(out)*len(s[key]))
+		for _, prev := range out {
+			for _, val := range s[key] {
+				p := make(Params, len(prev)+1)
+				for k, v := range prev {
+					p[k] = v
+				}
+				p[key] = val
+				next = append(next, p)
+			}
+		}
+		out = next
+	}
+
+	return out
+}
+
+// Suffix returns a stable string to add to test names, e.g.
+// "bs_4k-iodepth_16", or "" for no parameters
+func (p Params) Suffix() string {
+	keys := make([]string, 0, len(p))
+	for key := range p {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = unsafeNameRE.ReplaceAllString(key, "_") + "_" + unsafeNameRE.ReplaceAllString(p[key], "_")
+	}
+
+	return strings.Join(parts, "-")
+}
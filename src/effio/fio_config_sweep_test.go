@@ -0,0 +1,115 @@
+package effio
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestSweepExpand(t *testing.T) {
+	sweep := Sweep{
+		"iodepth": {"1", "4", "16", "64"},
+		"bs":      {"4k", "64k", "1m"},
+	}
+
+	combos := sweep.Expand()
+	if len(combos) != 12 {
+		t.Fatalf("expected 12 combinations, got %d", len(combos))
+	}
+
+	// keys sorted, last key changes fastest
+	expect := []string{"bs_4k-iodepth_1", "bs_4k-iodepth_4", "bs_4k-iodepth_16", "bs_4k-iodepth_64", "bs_64k-iodepth_1"}
+	for i, suffix := range expect {
+		if combos[i].Suffix() != suffix {
+			t.Errorf("combination %d: expected %q, got %q", i, suffix, combos[i].Suffix())
+		}
+	}
+
+	empty := Sweep(nil).Expand()
+	if len(empty) != 1 || empty[0].Suffix() != "" {
+		t.Errorf("a nil sweep should expand to one empty Params, got %v", empty)
+	}
+
+	if s := (Params{"rw mix": "75/25"}).Suffix(); s != "rw_mix_75_25" {
+		t.Errorf("unsafe characters should be replaced in %q", s)
+	}
+}
+
+func TestSweepPopulate(t *testing.T) {
+	dir := t.TempDir()
+	tmpl := "[{{ .Name }}]\niodepth={{ .Params.iodepth }}\nbs={{ .Params.bs }}\n"
+	sweep := `{"iodepth": [1, 32], "bs": ["4k", "1m"]}`
+
+	if err := ioutil.WriteFile(path.Join(dir, "rr.fio"), []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "rr.sweep.json"), []byte(sweep), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpls, err := LoadFioConfDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	suite, err := NewSuite("sweep", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite.Populate(Devices{{Name: "d1"}}, tmpls)
+
+	if len(suite.FioCommands) != 4 {
+		t.Fatalf("expected 4 tests, got %d", len(suite.FioCommands))
+	}
+
+	fcmd := suite.FioCommands[3]
+	if fcmd.Name != "d1-rr-bs_1m-iodepth_32" || fcmd.FioName != "rr" {
+		t.Errorf("unexpected name %q from template %q", fcmd.Name, fcmd.FioName)
+	}
+
+	conf, err := fcmd.RenderFioConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(conf) != "[d1-rr-bs_1m-iodepth_32]\niodepth=32\nbs=1m\n" {
+		t.Errorf("unexpected config:\n%s", conf)
+	}
+}
+
+func TestSweepErrors(t *testing.T) {
+	dir := t.TempDir()
+	bad := map[string]string{
+		"empty.sweep.json":  `{"iodepth": []}`,
+		"object.sweep.json": `{"iodepth": [{"a": 1}]}`,
+		"dup.sweep.json":    `{"rw": ["75/25", "75_25"]}`,
+		"syntax.sweep.json": "{\n\"iodepth\": [1,\n}",
+	}
+
+	for fname, data := range bad {
+		fpath := path.Join(dir, fname)
+		if err := ioutil.WriteFile(fpath, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadSweepFile(fpath); err == nil {
+			t.Errorf("%s should fail to load", fname)
+		}
+	}
+
+	if s, err := LoadSweepFile(path.Join(dir, "missing.sweep.json")); s != nil || err != nil {
+		t.Errorf("a missing sweep file should be (nil, nil), got (%v, %v)", s, err)
+	}
+
+	// a typo in a parameter name is an error, not "<no value>"
+	fcmd := FioCommand{Name: "t", Params: Params{"iodepth": "1"}}
+	if err := ioutil.WriteFile(path.Join(dir, "typo.fio"), []byte("iodepth={{ .Params.iodpeth }}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmpls, err := LoadFioConfDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fcmd.FioConfTmpl = tmpls[0]
+	if _, err := fcmd.RenderFioConf(); err == nil {
+		t.Error("rendering a missing parameter should fail")
+	}
+}
@@ -1,8 +1,8 @@
 package effio
 
 import (
+	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
@@ -16,8 +16,9 @@ import (
 // reason base fio configs can't use envvars, but it does make reproducing
 // results less accurate
 type FioConfTmpl struct {
-	Filename string             `json:"filename"` // full path to the source file
-	Name     string             `json:"name"`     // used to generate output filenames
+	Filename string             `json:"filename"`        // full path to the source file
+	Name     string             `json:"name"`            // used to generate output filenames
+	Sweep    Sweep              `json:"sweep,omitempty"` // from <name>.sweep.json, see fio_config_sweep.go
 	tmpl     *template.Template `json:"-"`
 }
 
@@ -27,10 +28,17 @@ type FioConfTmpls []FioConfTmpl
 // Template directives are optional. A plain fio config will pass through
 // unharmed.
 // Templates are parsed but not executed. effio.Suite calls Execute() directly.
-func LoadFioConfDir(dir string) (fts FioConfTmpls) {
+// Templates that fail to parse are returned as a *TemplateError.
+func LoadFioConfDir(dir string) (fts FioConfTmpls, err error) {
+	// Filename is recorded in command.json so make it absolute
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
 	visitor := func(fpath string, f os.FileInfo, err error) error {
 		if err != nil {
-			log.Fatalf("Encountered an error while loading fio config '%s': %s", fpath, err)
+			return fmt.Errorf("could not load fio configs: %w", err)
 		}
 
 		fname := path.Base(fpath)
@@ -38,23 +46,34 @@ func LoadFioConfDir(dir string) (fts FioConfTmpls) {
 		if ext == ".fio" {
 			data, err := ioutil.ReadFile(fpath)
 			if err != nil {
-				log.Fatalf("Could not read fio config '%s': %s", fpath, err)
+				return fmt.Errorf("could not read fio config: %w", err)
 			}
 
 			// remove the .fio to get the base filename to use as a generic name string
 			name := strings.TrimSuffix(fname, ext)
-			tmpl := template.Must(template.New(name).Parse(string(data)))
+			// missingkey=error turns a typo in a .Params name into an error
+			// instead of "<no value>" in the config, use index for optional params
+			// see fio_config_funcs.go for the functions available to templates
+			tmpl, err := template.New(name).Funcs(fioConfFuncs).Option("missingkey=error").Parse(string(data))
+			if err != nil {
+				return &TemplateError{Template: fpath, Err: err}
+			}
+
+			sweep, err := LoadSweepFile(sweepFilename(fpath))
+			if err != nil {
+				return err
+			}
 
-			fts = append(fts, FioConfTmpl{fpath, name, tmpl})
+			fts = append(fts, FioConfTmpl{fpath, name, sweep, tmpl})
 		}
 
 		return nil
 	}
 
-	err := filepath.Walk(dir, visitor)
+	err = filepath.Walk(dir, visitor)
 	if err != nil {
-		log.Fatalf("Could not load configs in '%s': %s", dir, err)
+		return nil, err
 	}
 
-	return fts
+	return fts, nil
 }
@@ -0,0 +1,325 @@
+package effio
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+const testFioConf = `; a comment
+[global]
+rw=randread
+blocksize=4k
+thread
+
+[job1]
+rw=randwrite
+# another comment
+write_lat_log=lat
+
+[global]
+iodepth=32
+
+[job2]
+readwrite=read
+`
+
+func TestParseFioConfig(t *testing.T) {
+	conf, err := ParseFioConfig("test.fio", []byte(testFioConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conf.Sections) != 4 {
+		t.Fatalf("expected 4 sections, got %d", len(conf.Sections))
+	}
+
+	jobs := conf.Jobs()
+	if len(jobs) != 2 || jobs[0].Name != "job1" || jobs[1].Name != "job2" {
+		t.Fatalf("unexpected jobs %v", jobs)
+	}
+
+	thread, ok := conf.Sections[0].Get("thread")
+	if !ok || thread.HasValue || thread.Line != 5 {
+		t.Errorf("thread should be a flag on line 5, got %+v", thread)
+	}
+
+	tests := []struct {
+		job    *FioSection
+		option string
+		expect string
+	}{
+		{jobs[0], "rw", "randwrite"}, // job overrides global
+		{jobs[0], "bs", "4k"},        // alias from global
+		{jobs[0], "iodepth", "-"},    // the second global comes after job1
+		{jobs[1], "rw", "read"},      // alias in the job
+		{jobs[1], "iodepth", "32"},
+		{jobs[1], "blocksize", "4k"},
+	}
+
+	for _, tt := range tests {
+		if val := conf.LookupValue(tt.job, tt.option, "-"); val != tt.expect {
+			t.Errorf("[%s] %s = %q, expected %q", tt.job.Name, tt.option, val, tt.expect)
+		}
+	}
+
+	for _, bad := range []string{"rw=read\n[job]\n", "[job\nrw=read\n", "[]\n", "[job]\n=read\n"} {
+		_, err := ParseFioConfig("bad.fio", []byte(bad))
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Line == 0 {
+			t.Errorf("%q should fail with a line number, got %v", bad, err)
+		}
+	}
+}
+
+func TestValidateFioCommand(t *testing.T) {
+	logs := "write_lat_log={{ .FioLatLog }}\nwrite_bw_log={{ .FioBWLog }}\nwrite_iops_log={{ .FioIopsLog }}\n"
+	mounted := Device{Name: "m", Device: "/dev/sdz", Mountpoint: "/mnt/m"}
+	raw := Device{Name: "r", Device: "/dev/sdz"}
+
+	tests := []struct {
+		name     string
+		tmpl     string
+		dev      Device
+		errors   int
+		warnings int
+		contains string
+	}{
+		{"ok", "[global]\ndirectory={{ .Device.Mountpoint }}\n[j]\n" + logs, mounted, 0, 0, ""},
+		{"ok raw read", "[j]\nrw=randread\nfilename={{ .Device.Device }}\n" + logs, raw, 0, 0, ""},
+		{"no lat log", "[j]\ndirectory=/mnt/m\nwrite_bw_log=bw\nwrite_iops_log=iops\n", mounted, 1, 0, "write_lat_log"},
+		{"wrong lat log", "[j]\ndirectory=/mnt/m\nwrite_lat_log=foo\nwrite_bw_log=bw\nwrite_iops_log=iops\n", mounted, 1, 0, "write_lat_log=foo"},
+		{"no bw log", "[j]\ndirectory=/mnt/m\nwrite_lat_log=lat\n", mounted, 0, 2, ""},
+		{"no target", "[j]\n" + logs, mounted, 1, 0, "neither directory nor filename"},
+		{"wrong dir", "[j]\ndirectory=/mnt/other\n" + logs, mounted, 1, 0, "not under the device mountpoint"},
+		{"file in dir", "[j]\ndirectory=/mnt/m\nfilename=a:b\n" + logs, mounted, 0, 0, ""},
+		{"raw write", "[j]\nrw=randwrite\nfilename={{ .Device.Device }}\n" + logs, mounted, 1, 0, "destroy the filesystem"},
+		{"wrong raw", "[j]\nfilename=/dev/sdy\n" + logs, raw, 1, 0, "is not the device"},
+		{"empty value", "[global]\ndirectory={{ .Device.Mountpoint }}\n[j]\nfilename=/dev/sdz\n" + logs, raw, 0, 1, "directory is empty"},
+		{"global only", "[global]\nrw=read\n", raw, 1, 0, "no jobs"},
+		{"bad int", "[j]\niodepth=lots\nfilename=/dev/sdz\n" + logs, raw, 1, 0, "iodepth"},
+		{"envvar", "[j]\niodepth=${IODEPTH}\nsize=80%\nbs=lots\nfilename=/dev/sdz\n" + logs, raw, 1, 2, "size=80%"},
+	}
+
+	for _, tt := range tests {
+		fcmd := FioCommand{Name: tt.name, FioBWLog: "bw", FioLatLog: "lat", FioIopsLog: "iops", FioFile: "config.fio", Device: tt.dev}
+		fcmd.FioConfTmpl.tmpl = template.Must(template.New(tt.name).Funcs(fioConfFuncs).Parse(tt.tmpl))
+
+		var nerr, nwarn int
+		var all []string
+		for _, err := range fcmd.Validate(false) {
+			if IsWarning(err) {
+				nwarn++
+			} else {
+				nerr++
+			}
+			all = append(all, err.Error())
+		}
+
+		if nerr != tt.errors || nwarn != tt.warnings {
+			t.Errorf("%s: expected %d errors and %d warnings, got %v", tt.name, tt.errors, tt.warnings, all)
+		}
+		if tt.contains != "" && !strings.Contains(strings.Join(all, "\n"), tt.contains) {
+			t.Errorf("%s: expected a problem mentioning %q, got %v", tt.name, tt.contains, all)
+		}
+	}
+}
+
+// warnings don't stop fio --parse-only from running, errors do
+func TestValidateFioParse(t *testing.T) {
+	bin := path.Join(t.TempDir(), "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\necho 'bad option'\nexit 1\n"
+	if err := ioutil.WriteFile(path.Join(bin, "fio"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	dev := Device{Name: "m", Device: "/dev/sdz", Mountpoint: "/mnt/m"}
+	tests := []struct {
+		name  string
+		tmpl  string
+		parse bool
+	}{
+		{"warnings", "[j]\ndirectory=/mnt/m\nwrite_lat_log=lat\n", true},
+		{"errors", "[j]\ndirectory=/mnt/other\nwrite_lat_log=lat\n", false},
+	}
+
+	for _, tt := range tests {
+		fcmd := FioCommand{Name: tt.name, FioBWLog: "bw", FioLatLog: "lat", FioIopsLog: "iops", FioFile: "config.fio", Device: dev}
+		fcmd.FioConfTmpl.tmpl = template.Must(template.New(tt.name).Funcs(fioConfFuncs).Parse(tt.tmpl))
+
+		var parsed bool
+		for _, err := range fcmd.Validate(true) {
+			if strings.Contains(err.Error(), "fio --parse-only failed") {
+				parsed = true
+			}
+		}
+		if parsed != tt.parse {
+			t.Errorf("%s: expected fio --parse-only to run: %t, got %t", tt.name, tt.parse, parsed)
+		}
+	}
+}
+
+func TestFioConfigRoundTrip(t *testing.T) {
+	conf, err := ParseFioConfig("test.fio", []byte(testFioConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out := string(conf.Bytes()); out != testFioConf {
+		t.Errorf("round trip changed the config:\n%s", out)
+	}
+
+	// changes keep everything else in place
+	conf.Sections[1].Set("rw", "randrw")
+	conf.Sections[1].Set("direct", "1")
+	expect := strings.Replace(testFioConf, "rw=randwrite\n# another comment\nwrite_lat_log=lat\n",
+		"rw=randrw\n# another comment\nwrite_lat_log=lat\ndirect=1\n", 1)
+	if out := string(conf.Bytes()); out != expect {
+		t.Errorf("unexpected config after Set():\n%s", out)
+	}
+
+	// lines are kept as is, only options that were changed are normalized
+	ws := "[ j ]\r\n  rw = read  \r\n\t; indented\n  bs = 4k\n"
+	conf, err = ParseFioConfig("ws.fio", []byte(ws))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := string(conf.Bytes()); out != ws {
+		t.Errorf("round trip changed whitespace: %q", out)
+	}
+	conf.Sections[0].Set("bs", "8k")
+	if out := string(conf.Bytes()); out != "[ j ]\r\n  rw = read  \r\n\t; indented\nbs=8k\n" {
+		t.Errorf("unexpected normalization: %q", out)
+	}
+}
+
+// fio understands more than the model does, e.g. include, config.fio is
+// written as rendered anyway
+func TestWriteFioConfUnparsed(t *testing.T) {
+	tmpl := "include common.fio\n[j]\nrw=read\n"
+	fcmd := FioCommand{Name: "t", Path: t.TempDir(), FioFile: "config.fio"}
+	fcmd.FioConfTmpl.tmpl = template.Must(template.New("t").Funcs(fioConfFuncs).Parse(tmpl))
+
+	if err := fcmd.WriteFioConf(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path.Join(fcmd.Path, fcmd.FioFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != tmpl || fcmd.FioConfig != nil || fcmd.FioJobs != nil {
+		t.Errorf("expected config.fio as rendered and no parsed config, got %q and %v", data, fcmd.FioConfig)
+	}
+}
+
+func TestFioJobOptions(t *testing.T) {
+	data := `[global]
+ioengine=libaio
+bs=4k,64k
+direct=1
+time_based
+runtime=10m
+size=25g
+rwmixwrite=75
+
+[j1]
+rw=randrw:8
+iodepth=32
+numjobs=4
+
+[j2]
+rw=write
+runtime=500
+`
+	conf, err := ParseFioConfig("test.fio", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := conf.AllJobOptions()
+
+	expect := []FioJobOptions{
+		{"j1", "randrw", 4096, 32, "libaio", 4, 25, true, 25 << 30, 600, true, nil},
+		{"j2", "write", 4096, 1, "libaio", 1, 25, true, 25 << 30, 500, true, nil},
+	}
+	for i := range expect {
+		if !reflect.DeepEqual(jobs[i], expect[i]) {
+			t.Errorf("job %d: expected %+v, got %+v", i, expect[i], jobs[i])
+		}
+	}
+
+	types := map[string]string{"bs": FioSize, "blocksize": FioSize, "iodepth": FioInt, "direct": FioBool, "ramp_time": FioTime, "ioengine": FioString}
+	for name, expect := range types {
+		if FioOptionType(name) != expect {
+			t.Errorf("%s should be a %s, not a %s", name, expect, FioOptionType(name))
+		}
+	}
+
+	durations := map[string]time.Duration{"30": 30 * time.Second, "500ms": 500 * time.Millisecond, "2h": 2 * time.Hour, "10us": 10 * time.Microsecond}
+	for val, expect := range durations {
+		if d, err := (FioOption{Value: val}).Duration(); err != nil || d != expect {
+			t.Errorf("Duration(%q) = (%s, %v), expected %s", val, d, err, expect)
+		}
+	}
+
+	// fio fills these in itself, keep the raw value
+	conf, err = ParseFioConfig("env.fio", []byte("[j]\niodepth=${IODEPTH}\nsize=80%\nbs=8k\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jo, err := conf.JobOptions(conf.Jobs()[0])
+	if err == nil {
+		t.Error("JobOptions should return an error for iodepth=${IODEPTH}")
+	}
+	if jo.Iodepth != 0 || jo.Size != 0 || jo.Bs != 8192 {
+		t.Errorf("expected iodepth 0, size 0 and bs 8192, got %+v", jo)
+	}
+	if jo.Unparsed["iodepth"] != "${IODEPTH}" || jo.Unparsed["size"] != "80%" {
+		t.Errorf("unexpected unparsed values: %v", jo.Unparsed)
+	}
+
+	if _, err := (FioOption{Value: "maybe", HasValue: true}).Bool(); err == nil {
+		t.Error("Bool() should fail on 'maybe'")
+	}
+}
+
+func TestDiffFioConfigs(t *testing.T) {
+	a, err := ParseFioConfig("a.fio", []byte("[global]\nrw=randread\nbs=4k\nthread\n[d1-test]\niodepth=1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ParseFioConfig("b.fio", []byte("; new\n[global]\nreadwrite=randread\nbs=64k\ndirect=1\n[d2-test]\niodepth=1\n[extra]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out []string
+	for _, d := range DiffFioConfigs(a, b) {
+		out = append(out, d.String())
+	}
+
+	expect := []string{
+		"[global] bs=4k -> bs=64k",
+		"[global] -thread",
+		"[global] +direct=1",
+		"[d1-test] -> [d2-test]",
+		"+[extra]",
+	}
+	if strings.Join(out, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("unexpected diff:\n%s", strings.Join(out, "\n"))
+	}
+
+	if diffs := DiffFioConfigs(a, a); len(diffs) != 0 {
+		t.Errorf("a config should not differ from itself: %v", diffs)
+	}
+}
@@ -0,0 +1,250 @@
+package effio
+
+// Pre-flight checks for rendered fio configs so mistakes show up before a
+// suite starts instead of when fio fails hours into it, or worse, when it
+// succeeds at scribbling over a mounted filesystem.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Validate renders and parses the fio config and checks it for problems.
+// Returned errors are a *TemplateError, *ParseError or *ConfigError, see
+// IsWarning() to tell the warnings apart. When fioParse is true and fio is
+// in PATH and there are no errors other than warnings, the config is also
+// checked with fio --parse-only.
+func (fcmd *FioCommand) Validate(fioParse bool) (errs []error) {
+	data, err := fcmd.RenderFioConf()
+	if err != nil {
+		return []error{err}
+	}
+
+	conf, err := ParseFioConfig(path.Join(fcmd.Path, fcmd.FioFile), data)
+	if err != nil {
+		return []error{err}
+	}
+
+	problem := func(line int, warning bool, format string, args ...interface{}) {
+		errs = append(errs, &ConfigError{fcmd.Name, line, warning, fmt.Errorf(format, args...)})
+	}
+
+	jobs := conf.Jobs()
+	if len(jobs) == 0 {
+		problem(0, false, "no jobs, only [global] sections")
+	}
+
+	// empty values are usually a template variable that isn't set,
+	// e.g. directory={{ .Device.Mountpoint }} on a device without one
+	for _, sec := range conf.Sections {
+		for _, opt := range sec.Options {
+			if opt.HasValue && opt.Value == "" && opt.Name != "description" {
+				problem(opt.Line, true, "%s is empty", opt.Name)
+			}
+		}
+	}
+
+	logs := []struct {
+		option, expect string
+		required       bool
+	}{
+		{"write_lat_log", fcmd.FioLatLog, true},
+		{"write_bw_log", fcmd.FioBWLog, false},
+		{"write_iops_log", fcmd.FioIopsLog, false},
+	}
+
+	for _, job := range jobs {
+		// catches things like iodepth=abc, envvars and percentages are
+		// left for fio
+		_, bad, perrs := conf.jobOptions(job)
+		for i, err := range perrs {
+			if fioDeferred(bad[i].Value) {
+				problem(bad[i].Line, true, "%s=%s can't be checked until fio runs", bad[i].Name, bad[i].Value)
+				continue
+			}
+			var perr *ParseError
+			if errors.As(err, &perr) {
+				problem(perr.Line, false, "%s", perr.Err)
+			} else {
+				problem(job.Line, false, "%s", err)
+			}
+		}
+
+		for _, log := range logs {
+			opt, ok := conf.Lookup(job, log.option)
+			if !ok {
+				problem(job.Line, !log.required, "[%s] does not set %s, effio summarize needs %s=%s", job.Name, log.option, log.option, log.expect)
+			} else if opt.Value != log.expect {
+				problem(opt.Line, !log.required, "%s=%s, effio summarize only finds %s=%s", log.option, opt.Value, log.option, log.expect)
+			}
+		}
+
+		fcmd.validateTargets(conf, job, problem)
+	}
+
+	for _, err := range fcmd.Device.Prepare.Validate(fcmd.Device) {
+		problem(0, false, "%s", err)
+	}
+
+	if fcmd.Device.DoMount {
+		fcmd.validateMountOptions(problem)
+	}
+
+	if fioParse && !hasErrors(errs) {
+		if err := fioParseOnly(data); err != nil {
+			problem(0, false, "%s", err)
+		}
+	}
+
+	return errs
+}
+
+// hasErrors is true if any of errs isn't just a warning
+func hasErrors(errs []error) bool {
+	for _, err := range errs {
+		if !IsWarning(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateMountOptions checks the options effio will mount the device with
+func (fcmd *FioCommand) validateMountOptions(problem func(int, bool, string, ...interface{})) {
+	opts, err := ParseMountOptions(fcmd.Device.MountOptions)
+	if err != nil {
+		problem(0, false, "%s", err)
+		return
+	}
+
+	errs, warnings := opts.Validate(fcmd.Device.Filesystem)
+	for _, err := range errs {
+		problem(0, false, "%s", err)
+	}
+	for _, err := range warnings {
+		problem(0, true, "%s", err)
+	}
+}
+
+// validateTargets makes sure the files fio will write to are on the device
+// under test and that raw writes don't go to a device effio mounts.
+func (fcmd *FioCommand) validateTargets(conf *FioConfig, job *FioSection, problem func(int, bool, string, ...interface{})) {
+	dev := fcmd.Device
+	if dev.Device == "" && dev.Mountpoint == "" {
+		return // nothing to check against, e.g. the simulator
+	}
+
+	targets, line := fioJobTargets(conf, job)
+	if len(targets) == 0 {
+		problem(job.Line, false, "[%s] sets neither directory nor filename, fio would write into the test directory", job.Name)
+		return
+	}
+
+	writes := fioRwWrites(conf.LookupValue(job, "rw", "read"))
+
+	for _, target := range targets {
+		raw := strings.HasPrefix(target, "/dev/") || (dev.Device != "" && sameFile(target, dev.Device))
+
+		if raw && writes && dev.Mountpoint != "" {
+			problem(line, false, "[%s] writes to raw device '%s' but %s is mounted on %s by effio, this would destroy the filesystem", job.Name, target, dev.Device, dev.Mountpoint)
+		} else if dev.Mountpoint != "" && !underDir(target, dev.Mountpoint) {
+			problem(line, false, "[%s] '%s' is not under the device mountpoint %s", job.Name, target, dev.Mountpoint)
+		} else if dev.Mountpoint == "" && !sameFile(target, dev.Device) {
+			problem(line, false, "[%s] '%s' is not the device %s", job.Name, target, dev.Device)
+		}
+	}
+}
+
+// fioJobTargets returns the files or directory a job does I/O on and the
+// line they were set on. Empty when the job sets neither directory nor
+// filename.
+func fioJobTargets(conf *FioConfig, job *FioSection) (targets []string, line int) {
+	dirOpt, hasDir := conf.Lookup(job, "directory")
+	fileOpt, hasFile := conf.Lookup(job, "filename")
+
+	if !hasFile {
+		if !hasDir {
+			return nil, 0
+		}
+		return []string{dirOpt.Value}, dirOpt.Line
+	}
+
+	// fio separates multiple files with :
+	for _, fname := range strings.Split(fileOpt.Value, ":") {
+		if hasDir && !path.IsAbs(fname) {
+			fname = path.Join(dirOpt.Value, fname)
+		}
+		targets = append(targets, fname)
+	}
+
+	return targets, fileOpt.Line
+}
+
+// fioRwWrites is true for rw= settings that write or trim
+func fioRwWrites(rw string) bool {
+	switch strings.SplitN(rw, ":", 2)[0] {
+	case "write", "randwrite", "rw", "readwrite", "randrw", "trim", "randtrim", "trimwrite":
+		return true
+	}
+	return false
+}
+
+// sameFile compares paths after resolving symlinks like /dev/disk/by-id
+func sameFile(a, b string) bool {
+	resolve := func(p string) string {
+		if r, err := filepath.EvalSymlinks(p); err == nil {
+			return r
+		}
+		return path.Clean(p)
+	}
+	return resolve(a) == resolve(b)
+}
+
+func underDir(fpath, dir string) bool {
+	fpath = path.Clean(fpath)
+	dir = path.Clean(dir)
+	return fpath == dir || strings.HasPrefix(fpath, dir+"/")
+}
+
+// fioParseOnly runs fio --parse-only on the config. It does nothing when
+// fio isn't in PATH.
+func fioParseOnly(data []byte) error {
+	fioPath, err := exec.LookPath("fio")
+	if err != nil {
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile("", "effio-validate-*.fio")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	out, err := exec.Command(fioPath, "--parse-only", tmp.Name()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("fio --parse-only failed: %s", bytes.TrimSpace(out))
+	}
+
+	return nil
+}
+
+// Validate every test in the suite, see FioCommand.Validate()
+func (suite *Suite) Validate(fioParse bool) (errs []error) {
+	for _, fcmd := range suite.FioCommands {
+		errs = append(errs, fcmd.Validate(fioParse)...)
+	}
+	return errs
+}
@@ -10,92 +10,375 @@ import (
 	"io"
 	"log"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// fio >= 2.1.10 writes one log file per job, e.g. lat_lat.1.log, lat_lat.2.log,
+// while 2.1.9 and earlier write a single lat_lat.log with every job in it.
+// submatch 1 is the base name, submatch 2 is the (optional) job index
+var fioLogRE = regexp.MustCompile("^(bw_bw|lat_lat|lat_slat|lat_clat|iops_iops)\\.?(\\d*)\\.log$")
+
+// FioLogSet is all of the log files fio wrote for one log type in one
+// test directory. Files are sorted by job index.
+type FioLogSet struct {
+	Dir     string   `json:"dir"`      // directory containing the logs
+	Base    string   `json:"base"`     // e.g. lat_lat
+	LogType string   `json:"log_type"` // e.g. bw, lat, slat, clat, iops
+	Files   []string `json:"files"`    // full paths to each log file
+}
+
+type FioLogSets []FioLogSet
+
+// parseFioLogName splits a fio log file name into its base name and job index.
+// Logs written by fio before 2.1.10 have no job index and get 0.
+func parseFioLogName(fname string) (base string, job int, ok bool) {
+	m := fioLogRE.FindStringSubmatch(path.Base(fname))
+	if m == nil {
+		return "", 0, false
+	}
+
+	if m[2] != "" {
+		job, _ = strconv.Atoi(m[2])
+	}
+
+	return m[1], job, true
+}
+
+// fioLogType maps the base name of a log file to the type of log
+func fioLogType(base string) string {
+	switch base {
+	case "bw_bw":
+		return "bw"
+	case "lat_lat":
+		return "lat"
+	case "lat_slat":
+		return "slat"
+	case "lat_clat":
+		return "clat"
+	case "iops_iops":
+		return "iops"
+	}
+
+	return ""
+}
+
+// FindFioLogSet finds all of the per-job siblings of the named log file.
+// The file itself does not need to exist, e.g. lat_lat.log will find
+// lat_lat.1.log, lat_lat.2.log, etc..
+func FindFioLogSet(fpath string) (set FioLogSet, err error) {
+	base, _, ok := parseFioLogName(fpath)
+	if !ok {
+		return set, fmt.Errorf("'%s' does not look like an fio log file name", fpath)
+	}
+
+	set.Dir = path.Dir(fpath)
+	set.Base = base
+	set.LogType = fioLogType(base)
+
+	matches, err := filepath.Glob(path.Join(set.Dir, base+"*.log"))
+	if err != nil {
+		return set, fmt.Errorf("could not search for log files in '%s': %s", set.Dir, err)
+	}
+
+	for _, m := range matches {
+		if mbase, _, ok := parseFioLogName(m); ok && mbase == base {
+			set.Files = append(set.Files, m)
+		}
+	}
+
+	set.sortFiles()
+
+	return set, nil
+}
+
+// Name returns a name for the set suitable for display, the file name for
+// single-file sets or a glob pattern for per-job sets, e.g. lat_lat.*.log
+func (set *FioLogSet) Name() string {
+	if len(set.Files) == 1 {
+		return path.Base(set.Files[0])
+	}
+	return fmt.Sprintf("%s.*.log", set.Base)
+}
+
+// Path returns the full path version of Name()
+func (set *FioLogSet) Path() string {
+	return path.Join(set.Dir, set.Name())
+}
+
+// Size returns the combined size of all the files in the set, missing files
+// are counted as 0 bytes
+func (set *FioLogSet) Size() (size int64) {
+	for _, file := range set.Files {
+		if fi, err := os.Stat(file); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// Load reads every file in the set and merges them into one LogRecs.
+func (set *FioLogSet) Load() (LogRecs, error) {
+	return LoadFioLogs(set.Files)
+}
+
+// sort by job index rather than by name so lat_lat.10.log comes after lat_lat.2.log
+func (set *FioLogSet) sortFiles() {
+	sort.Slice(set.Files, func(i, j int) bool {
+		_, ji, _ := parseFioLogName(set.Files[i])
+		_, jj, _ := parseFioLogName(set.Files[j])
+		return ji < jj
+	})
+}
+
+// LoadFioLogs loads the per-job log files fio writes for a single log type
+// and merges them into one LogRecs in time order, sorting any file that
+// isn't. The job index of each record
+// is preserved in LogRec.Job and LogRec.Idx is renumbered to the position in
+// the merged list, same as StreamFioLogs().
+func LoadFioLogs(filenames []string) (LogRecs, error) {
+	lists := make([]LogRecs, len(filenames))
+	for i, filename := range filenames {
+		lrs, err := LoadFioLog(filename)
+		if err != nil {
+			return nil, err
+		}
+		// fio < 2.1.10 writes every job to one file, not always in order
+		if !sort.IsSorted(lrs) {
+			sort.Stable(lrs)
+		}
+		lists[i] = lrs
+	}
+
+	if len(lists) == 1 {
+		// nothing to merge, Idx is the line number until renumbered
+		lrs := lists[0]
+		for i := range lrs {
+			lrs[i].Idx = uint32(i)
+		}
+		return lrs, nil
+	}
+
+	return mergeLogRecs(lists), nil
+}
+
+// mergeLogRecs does a k-way merge of lists that are each in time order, as
+// fio writes them. The number of jobs is small so a linear scan of the list
+// heads is plenty fast. Ties go to the lower job.
+func mergeLogRecs(lists []LogRecs) LogRecs {
+	total := 0
+	for _, lrs := range lists {
+		total += len(lrs)
+	}
+
+	out := make(LogRecs, 0, total)
+	heads := make([]int, len(lists))
+
+	for len(out) < total {
+		min := -1
+		for i, lrs := range lists {
+			if heads[i] >= len(lrs) {
+				continue
+			}
+			if min == -1 || lrs[heads[i]].Time < lists[min][heads[min]].Time {
+				min = i
+			}
+		}
+
+		lr := lists[min][heads[min]]
+		lr.Idx = uint32(len(out))
+		out = append(out, lr)
+		heads[min]++
+	}
+
+	return out
+}
+
 // Loads the CSV output by fio into an LogRecs array of LogRec structs.
-func LoadFioLog(filename string) LogRecs {
+// The job index is taken from the file name, e.g. 2 for lat_lat.2.log.
+// Malformed lines are skipped with a warning, read errors are returned as
+// a *ParseError.
+func LoadFioLog(filename string) (LogRecs, error) {
 	fmt.Printf("Parsing file: '%s' ... ", filename)
 
-	fd, err := os.Open(filename)
+	r, err := openFioLog(filename)
 	if err != nil {
-		fmt.Printf(" Failed.\nCould not open file '%s' for read: %s\n", filename, err)
-		return LogRecs{}
+		fmt.Printf(" Failed.\n")
+		return nil, err
 	}
-	defer fd.Close()
+	defer r.Close()
 
 	started := time.Now()
 	records := make(LogRecs, 0)
 
-	bfd := bufio.NewReader(fd)
-	lno := 0
 	for {
-		line, _, err := bfd.ReadLine()
-		if err == io.EOF {
-			break
-		}
+		lr, ok, err := r.Next()
 		if err != nil {
-			log.Fatalf("\nRead from file '%s' failed: %s", filename, err)
+			fmt.Printf(" Failed.\n")
+			return nil, err
+		} else if !ok {
+			break
 		}
-		lno++
 
-		if lno%10000 == 0 {
+		if r.lno%10000 == 0 {
 			fmt.Printf(".")
 		}
 
+		records = append(records, lr)
+	}
+
+	done := time.Now()
+	fmt.Printf(" Done.\nRows: %d Elapsed: %s\n", len(records), done.Sub(started).String())
+
+	return records, nil
+}
+
+// fioLogReader reads one fio log a record at a time
+type fioLogReader struct {
+	filename string
+	fd       *os.File
+	bfd      *bufio.Reader
+	job      uint16
+	lno      int
+	quiet    bool // don't warn about malformed lines, e.g. on a second pass
+}
+
+func openFioLog(filename string) (*fioLogReader, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open fio log: %w", err)
+	}
+
+	_, job, _ := parseFioLogName(filename)
+
+	return &fioLogReader{filename: filename, fd: fd, bfd: bufio.NewReader(fd), job: uint16(job)}, nil
+}
+
+func (r *fioLogReader) Close() error {
+	return r.fd.Close()
+}
+
+// Next returns the next record, ok is false at the end of the file.
+// Idx is the line number.
+func (r *fioLogReader) Next() (lr LogRec, ok bool, err error) {
+	warn := func(field int, err error) {
+		if !r.quiet {
+			log.Printf("\nParsing field %d failed in file '%s' at line %d: %s", field, r.filename, r.lno, err)
+		}
+	}
+
+	for {
+		line, _, err := r.bfd.ReadLine()
+		if err == io.EOF {
+			return lr, false, nil
+		}
+		if err != nil {
+			return lr, false, &ParseError{r.filename, r.lno + 1, err}
+		}
+		r.lno++
+
 		// fio always uses ", " instead of "," as far as I can tell
-		r := strings.SplitN(string(line), ", ", 4)
+		f := strings.SplitN(string(line), ", ", 4)
 		// probably an impartial record at the end of the file
-		if len(r) < 4 || r[0] == "" || r[1] == "" {
+		if len(f) < 4 || f[0] == "" || f[1] == "" {
 			continue
 		}
 
-		tm, err := strconv.Atoi(r[0])
+		tm, err := strconv.Atoi(f[0])
 		if err != nil {
-			log.Printf("\nParsing field 0 failed in file '%s' at line %d: %s", filename, lno, err)
+			warn(0, err)
 			continue
 		}
-		perf, err := strconv.Atoi(r[1])
+		perf, err := strconv.Atoi(f[1])
 		if err != nil {
-			log.Printf("\nParsing field 1 in file '%s' at line %d: %s", filename, lno, err)
+			warn(1, err)
 			continue
 		}
-		ddir, err := strconv.Atoi(r[2])
+		ddir, err := strconv.Atoi(f[2])
 		if err != nil {
-			log.Printf("\nParsing field 2 failed in file '%s' at line %d: %s", filename, lno, err)
+			warn(2, err)
 			continue
 		}
-		bsz, err := strconv.Atoi(r[3])
+		bsz, err := strconv.Atoi(f[3])
 		if err != nil {
-			log.Printf("\nParsing field 3 failed in file '%s' at line %d: %s", filename, lno, err)
+			warn(3, err)
 			continue
 		}
 
-		lr := LogRec{uint32(tm), uint32(perf), uint8(ddir), uint16(bsz), uint32(lno)}
-		records = append(records, &lr)
+		return LogRec{Time: uint32(tm), Val: uint32(perf), Bsz: uint32(bsz), Idx: uint32(r.lno), Job: r.job, Ddir: uint8(ddir)}, true, nil
 	}
+}
 
-	done := time.Now()
-	fmt.Printf(" Done.\nRows: %d Elapsed: %s\n", len(records), done.Sub(started).String())
+// StreamFioLogs reads the per-job log files of one log type and calls fn
+// with every record without holding more than one record per file in
+// memory. The files are merged by time but nothing is sorted, so records
+// only come in time order when every file is: fio before 2.1.10 writes all
+// the jobs to one file out of order. Use LoadFioLogs() when order matters.
+func StreamFioLogs(filenames []string, quiet bool, fn func(LogRec) error) error {
+	readers := make([]*fioLogReader, 0, len(filenames))
+	defer func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}()
+
+	heads := make([]LogRec, len(filenames))
+	live := make([]bool, len(filenames))
+	for i, filename := range filenames {
+		r, err := openFioLog(filename)
+		if err != nil {
+			return err
+		}
+		r.quiet = quiet
+		readers = append(readers, r)
 
-	return records
+		if heads[i], live[i], err = r.Next(); err != nil {
+			return err
+		}
+	}
+
+	// same k-way merge as mergeLogRecs(), ties go to the lower job
+	for idx := uint32(0); ; idx++ {
+		min := -1
+		for i := range heads {
+			if live[i] && (min == -1 || heads[i].Time < heads[min].Time) {
+				min = i
+			}
+		}
+		if min == -1 {
+			return nil
+		}
+
+		lr := heads[min]
+		lr.Idx = idx
+		if err := fn(lr); err != nil {
+			return err
+		}
+
+		var err error
+		if heads[min], live[min], err = readers[min].Next(); err != nil {
+			return err
+		}
+	}
 }
 
-func (lrs LogRecs) DumpCSV(fpath string) {
+func (lrs LogRecs) DumpCSV(fpath string) error {
 	fd, err := os.OpenFile(fpath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
-		log.Fatalf("Could not open '%s' for write: %s\n", fpath, err)
+		return err
 	}
 	defer fd.Close()
 
+	bfd := bufio.NewWriter(fd)
+
 	for _, lr := range lrs {
-		// TODO: Something isn't right with the sampling below
-		// all the samples should always be full
-		if lr == nil {
-			break
-		}
-		fmt.Fprintf(fd, "%f,%f,%d,%d\n", lr.Time, lr.Val, lr.Ddir, lr.Bsz)
+		fmt.Fprintf(bfd, "%d,%d,%d,%d\n", lr.Time, lr.Val, lr.Ddir, lr.Bsz)
 	}
+
+	return bfd.Flush()
 }
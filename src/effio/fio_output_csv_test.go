@@ -0,0 +1,114 @@
+package effio
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+type testLogName struct {
+	name string
+	base string
+	job  int
+	ok   bool
+}
+
+var logNameTestData = []testLogName{
+	{"lat_lat.log", "lat_lat", 0, true},
+	{"/tmp/suite/test/lat_lat.1.log", "lat_lat", 1, true},
+	{"bw_bw.12.log", "bw_bw", 12, true},
+	{"iops_iops.3.log", "iops_iops", 3, true},
+	{"lat_clat.2.log", "lat_clat", 2, true},
+	{"output.json", "", 0, false},
+	{"diskstats.csv", "", 0, false},
+}
+
+func TestParseFioLogName(t *testing.T) {
+	for _, tln := range logNameTestData {
+		base, job, ok := parseFioLogName(tln.name)
+		if base != tln.base || job != tln.job || ok != tln.ok {
+			t.Errorf("parseFioLogName(%q) = (%q, %d, %t), expected (%q, %d, %t)",
+				tln.name, base, job, ok, tln.base, tln.job, tln.ok)
+		}
+	}
+}
+
+func TestMergeLogRecs(t *testing.T) {
+	lists := []LogRecs{
+		LogRecs{{Time: 1, Job: 1}, {Time: 4, Job: 1}, {Time: 5, Job: 1}},
+		LogRecs{{Time: 1, Job: 2}, {Time: 2, Job: 2}, {Time: 6, Job: 2}},
+		LogRecs{{Time: 3, Job: 3}},
+	}
+
+	expect := []struct{ time, job uint32 }{{1, 1}, {1, 2}, {2, 2}, {3, 3}, {4, 1}, {5, 1}, {6, 2}}
+
+	merged := mergeLogRecs(lists)
+	if len(merged) != len(expect) {
+		t.Fatalf("mergeLogRecs returned %d records, expected %d", len(merged), len(expect))
+	}
+
+	for i, lr := range merged {
+		if lr.Time != expect[i].time || uint32(lr.Job) != expect[i].job || lr.Idx != uint32(i) {
+			t.Errorf("record %d: got time %d job %d idx %d, expected time %d job %d idx %d",
+				i, lr.Time, lr.Job, lr.Idx, expect[i].time, expect[i].job, i)
+		}
+	}
+}
+
+// one file or several, Idx is the position in the list
+func TestLoadFioLogsIdx(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"lat_lat.1.log": "1, 100, 0, 4096\nbogus\n3, 300, 0, 4096\n",
+		"lat_lat.2.log": "2, 200, 1, 4096\n",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, names := range [][]string{{"lat_lat.1.log"}, {"lat_lat.1.log", "lat_lat.2.log"}} {
+		var fnames []string
+		for _, name := range names {
+			fnames = append(fnames, path.Join(dir, name))
+		}
+
+		lrs, err := LoadFioLogs(fnames)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, lr := range lrs {
+			if lr.Idx != uint32(i) {
+				t.Errorf("%v: record %d has idx %d", names, i, lr.Idx)
+			}
+		}
+	}
+}
+
+// a short per-job log stays in its set, only tiny sets are skipped
+func TestInventoryCSVFiles(t *testing.T) {
+	dir := t.TempDir()
+	var long string
+	for i := 0; i < 20; i++ {
+		long += "1, 100, 0, 4096\n"
+	}
+	files := map[string]string{
+		"lat_lat.1.log": long,
+		"lat_lat.2.log": "1, 100, 0, 4096\n",
+		"bw_bw.1.log":   "1, 100, 0, 4096\n",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sets, err := InventoryCSVFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 1 || sets[0].Base != "lat_lat" || len(sets[0].Files) != 2 {
+		t.Errorf("expected one lat_lat set with both files, got %+v", sets)
+	}
+}
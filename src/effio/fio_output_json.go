@@ -8,8 +8,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
-	"os"
 	"strconv"
 	"strings"
 )
@@ -91,11 +89,10 @@ type FioJsonData struct {
 	DiskUtil      []FioJsonDiskUtil `json:"disk_util"`
 }
 
-func LoadFioJsonData(filename string) (fdata FioJsonData) {
+func LoadFioJsonData(filename string) (fdata FioJsonData, err error) {
 	dataBytes, err := ioutil.ReadFile(filename)
-
-	if os.IsNotExist(err) {
-		log.Fatalf("Could not read file %s: %s", filename, err)
+	if err != nil {
+		return fdata, fmt.Errorf("could not read fio JSON output: %w", err)
 	}
 
 	// data loaded OK
@@ -116,15 +113,27 @@ func LoadFioJsonData(filename string) (fdata FioJsonData) {
 		eof = len(dataBytes)
 	}
 
-	err = json.Unmarshal(dataBytes[offset:eof+2], &fdata)
+	end := eof + 2
+	if end > len(dataBytes) {
+		end = len(dataBytes)
+	}
+
+	err = json.Unmarshal(dataBytes[offset:end], &fdata)
 	if err != nil {
-		log.Fatalf("Could not parse fio --output=json JSON in file '%s': %s", filename, err)
+		// line numbers are relative to the JSON, count the garbage lines too
+		perr := jsonParseError(filename, dataBytes[offset:], err).(*ParseError)
+		if perr.Line > 0 {
+			perr.Line += bytes.Count(dataBytes[:offset], []byte("\n"))
+		}
+		return fdata, perr
 	}
 
 	fdata.HeaderGarbage = string(dataBytes[0:offset])
-	fdata.FooterGarbage = string(dataBytes[eof+1:])
+	if eof+1 < len(dataBytes) {
+		fdata.FooterGarbage = string(dataBytes[eof+1:])
+	}
 
-	return
+	return fdata, nil
 }
 
 // some of the bucket keys are in the form ">=50.00" which of course
@@ -0,0 +1,113 @@
+package effio
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Interrupt catches SIGINT/SIGTERM while a suite is running so the test in
+// progress can stop fio and clean up after itself instead of leaving mounts,
+// diskstats collectors and half-written metadata behind.
+// The first signal closes Done(), which tells FioCommand.Run to forward the
+// signal to fio and wait for it to exit. A second signal closes Hard(), after
+// which fio is killed outright.
+type Interrupt struct {
+	sigs chan os.Signal
+	done chan struct{}
+	hard chan struct{}
+	sig  os.Signal
+	mtx  sync.Mutex
+}
+
+// NewInterrupt starts catching SIGINT and SIGTERM. Call Stop() to go back
+// to the default behavior of exiting immediately.
+func NewInterrupt() *Interrupt {
+	intr := Interrupt{
+		sigs: make(chan os.Signal, 2),
+		done: make(chan struct{}),
+		hard: make(chan struct{}),
+	}
+
+	signal.Notify(intr.sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		count := 0
+		for sig := range intr.sigs {
+			count++
+			switch count {
+			case 1:
+				log.Printf("Received %s, stopping after fio exits. Send it again to kill fio.\n", sig)
+				intr.mtx.Lock()
+				intr.sig = sig
+				intr.mtx.Unlock()
+				close(intr.done)
+			case 2:
+				log.Printf("Received %s again, killing fio.\n", sig)
+				close(intr.hard)
+			}
+		}
+	}()
+
+	return &intr
+}
+
+// Stop catching signals.
+func (intr *Interrupt) Stop() {
+	if intr == nil {
+		return
+	}
+	signal.Stop(intr.sigs)
+	close(intr.sigs)
+}
+
+// Done returns a channel that is closed when the first signal arrives.
+// A nil Interrupt never fires.
+func (intr *Interrupt) Done() <-chan struct{} {
+	if intr == nil {
+		return nil
+	}
+	return intr.done
+}
+
+// Hard returns a channel that is closed when a second signal arrives.
+func (intr *Interrupt) Hard() <-chan struct{} {
+	if intr == nil {
+		return nil
+	}
+	return intr.hard
+}
+
+// Interrupted returns true once a signal has been received.
+func (intr *Interrupt) Interrupted() bool {
+	select {
+	case <-intr.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// Signal returns the first signal received or nil.
+func (intr *Interrupt) Signal() os.Signal {
+	if intr == nil {
+		return nil
+	}
+	intr.mtx.Lock()
+	defer intr.mtx.Unlock()
+	return intr.sig
+}
+
+// signalGroup sends sig to every process in the group p leads. fio and the
+// prepare tools run in their own group, and fio forks a process per job
+// unless thread=1 is set, so signalling only p would leave the jobs
+// running and the device busy.
+func signalGroup(p *os.Process, sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		s = syscall.SIGTERM
+	}
+	return syscall.Kill(-p.Pid, s)
+}
@@ -0,0 +1,157 @@
+package effio
+
+// The journal records the state of every test in a suite so a suite that
+// crashed, was interrupted or had a machine reboot out from under it can
+// be resumed with effio run -resume. It is rewritten every time a test
+// changes state.
+// <-path path>/<suite.Name>/journal.json
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	StatePending     = "pending"     // has not been run yet
+	StateRunning     = "running"     // fio was started
+	StateSucceeded   = "succeeded"   // fio exited 0
+	StateFailed      = "failed"      // fio or setup/teardown failed
+	StateInterrupted = "interrupted" // effio was killed or the machine went down mid-test
+)
+
+type JournalEntry struct {
+	Name       string    `json:"name"`        // FioCommand.Name
+	State      string    `json:"state"`       // one of the State* constants
+	Attempts   int       `json:"attempts"`    // number of times the test has been started
+	MinTs      time.Time `json:"min_ts"`      // start of the most recent attempt, its benchmark once it finishes
+	MaxTs      time.Time `json:"max_ts"`      // end of the most recent attempt
+	ExitStatus int       `json:"exit_status"` // fio exit status of the most recent attempt
+	Error      string    `json:"error"`       // error from the most recent attempt
+}
+
+// Journal is safe for use by tests running in parallel.
+type Journal struct {
+	Path    string                   `json:"-"`
+	Entries map[string]*JournalEntry `json:"entries"`
+	mtx     sync.Mutex
+}
+
+// LoadJournal reads the journal from fname. A missing file is not an error
+// and returns an empty journal that will be written to fname.
+// Any test that was still running when the journal was last written must
+// have been interrupted so it is marked as such.
+func LoadJournal(fname string) (*Journal, error) {
+	j := &Journal{Path: fname, Entries: make(map[string]*JournalEntry)}
+
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return j, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read journal: %w", err)
+	}
+
+	err = json.Unmarshal(data, j)
+	if err != nil {
+		return nil, jsonParseError(fname, data, err)
+	}
+
+	for _, ent := range j.Entries {
+		if ent.State == StateRunning {
+			ent.State = StateInterrupted
+		}
+	}
+
+	return j, nil
+}
+
+// Entry returns a copy of the entry for the named test, creating a pending
+// entry if there isn't one already.
+func (j *Journal) Entry(name string) JournalEntry {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	return *j.entry(name)
+}
+
+func (j *Journal) entry(name string) *JournalEntry {
+	if ent, ok := j.Entries[name]; ok {
+		return ent
+	}
+
+	ent := JournalEntry{Name: name, State: StatePending, ExitStatus: -1}
+	j.Entries[name] = &ent
+
+	return &ent
+}
+
+// Start marks the named test as running and writes the journal.
+func (j *Journal) Start(name string) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	ent := j.entry(name)
+	ent.State = StateRunning
+	ent.Attempts++
+	ent.MinTs = time.Now()
+	ent.MaxTs = time.Time{}
+	ent.ExitStatus = -1
+	ent.Error = ""
+
+	return j.write()
+}
+
+// Finish records the outcome of the named test, writes the journal and
+// returns a copy of the updated entry. minTs is when the benchmark started,
+// after any device preparation.
+func (j *Journal) Finish(name string, state string, exitStatus int, minTs time.Time, err error) (JournalEntry, error) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	ent := j.entry(name)
+	ent.State = state
+	ent.MinTs = minTs
+	ent.MaxTs = time.Now()
+	ent.ExitStatus = exitStatus
+	if err != nil {
+		ent.Error = err.Error()
+	}
+
+	return *ent, j.write()
+}
+
+// Write the journal to disk.
+func (j *Journal) Write() error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	return j.write()
+}
+
+// write the journal to a temporary file then rename it into place so a crash
+// mid-write can't leave a truncated journal behind. Caller must hold j.mtx.
+func (j *Journal) write() error {
+	js, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode journal as JSON: %s", err)
+	}
+
+	// MarshalIndent does not follow the final brace with a newline
+	js = append(js, byte('\n'))
+
+	tmp := j.Path + ".tmp"
+	err = ioutil.WriteFile(tmp, js, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+
+	err = os.Rename(tmp, j.Path)
+	if err != nil {
+		return fmt.Errorf("failed to move journal into place: %w", err)
+	}
+
+	return nil
+}
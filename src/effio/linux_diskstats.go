@@ -4,8 +4,9 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"path"
+	"path/filepath"
 	"strconv"
 	"syscall"
 	"time"
@@ -37,104 +38,219 @@ type Diskstat struct {
 
 type Diskstats []Diskstat
 
-// start a goroutine that will get stats from /proc/diskstats for the given
-// major/minor and write to the named file in CSV format every second
-// until the returned channel is closed, at which time the goroutine
-// will close the file then exit
-// finish := CollectDiskstats("/tmp/test.dat", 8, 49)
+// DiskstatsCollector is returned by CollectDiskstats so the caller can
+// stop collection and wait for the CSV file to be closed.
+type DiskstatsCollector struct {
+	finish chan struct{}
+	done   chan struct{}
+	devs   []DevNum
+	seen   map[DevNum]bool
+	err    error // set by the goroutine if collection fails
+}
+
+// DevNum is a device's major:minor, the key for rows in /proc/diskstats
+type DevNum struct {
+	Major uint
+	Minor uint
+	Name  string // kernel name, only for messages
+}
+
+func (dn DevNum) String() string {
+	return fmt.Sprintf("%d:%d (%s)", dn.Major, dn.Minor, dn.Name)
+}
+
+// start a goroutine that will get stats from /proc/diskstats for the device
+// and write to the named file in CSV format at the interval
+// until Stop() is called, at which time the goroutine
+// takes one last sample, closes the file then exits.
+// With d.DiskstatsRelated, rows for the parent disk of a partition and the
+// slaves of md/dm devices go in the same file, the name column tells them
+// apart.
+// dc, err := CollectDiskstats("/tmp/test.dat", dev, time.Second)
 // do stuff ..
-// close(finish)
-func CollectDiskstats(fname string, d Device) chan struct{} {
-	finish := make(chan struct{})
-	major, minor := d.devNums()
+// err = dc.Stop()
+func CollectDiskstats(fname string, d Device, interval time.Duration) (*DiskstatsCollector, error) {
+	devs, err := d.diskstatsDevs(DefaultSysfs)
+	if err != nil {
+		return nil, err
+	}
 
-	go func() {
-		fd, err := os.OpenFile(fname, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	return collectDiskstats(fname, DefaultProcfs, devs, interval)
+}
+
+func collectDiskstats(fname string, proc Procfs, devs []DevNum, interval time.Duration) (*DiskstatsCollector, error) {
+	dc := DiskstatsCollector{
+		finish: make(chan struct{}),
+		done:   make(chan struct{}),
+		devs:   devs,
+		seen:   make(map[DevNum]bool),
+	}
+
+	fd, err := os.OpenFile(fname, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file for writing diskstats: %w", err)
+	}
+
+	// a sample at the start and end so even short runs have a delta
+	sample := func() error {
+		stats, err := proc.Diskstats()
 		if err != nil {
-			log.Fatalf("Could not open file '%s' for writing diskstats: %s", fname, err)
+			return err
+		}
+
+		for _, st := range stats {
+			for _, dn := range devs {
+				if st.Major != dn.Major || st.Minor != dn.Minor {
+					continue
+				}
+				dc.seen[dn] = true
+
+				//                t  0  1  2  3  4  5  6  7  8  9 10 11 12 13
+				_, err = fmt.Fprintf(fd, "%d,%d,%d,%s,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d\n",
+					st.Time.UnixNano(), st.Major, st.Minor, st.Name, // t,0,1,2
+					st.ReadComplete, st.ReadMerged, st.ReadSectors, st.ReadMs, // 3,4,5,6
+					st.WriteComplete, st.WriteMerged, st.WriteSectors, st.WriteMs, // 7,8,9,10
+					st.IOPending, st.IOMs, st.IOQueueMs) // 11,12,13
+				if err != nil {
+					return err
+				}
+			}
 		}
+
+		return nil
+	}
+
+	go func() {
+		defer close(dc.done)
 		defer fd.Close()
 
+		if dc.err = sample(); dc.err != nil {
+			return
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
 		for {
 			select {
-			case <-time.After(time.Second):
-				stats := ReadDiskstats()
-				for _, st := range stats {
-					if st.Major == major && st.Minor == minor {
-						//                t  0  1  2  3  4  5  6  7  8  9 10 11 12 13
-						fmt.Fprintf(fd, "%d,%d,%d,%s,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d\n",
-							st.Time.UnixNano(), st.Major, st.Minor, st.Name, // t,0,1,2
-							st.ReadComplete, st.ReadMerged, st.ReadSectors, st.ReadMs, // 3,4,5,6
-							st.WriteComplete, st.WriteMerged, st.WriteSectors, st.WriteMs, // 7,8,9,10
-							st.IOPending, st.IOMs, st.IOQueueMs) // 11,12,13
-					}
+			case <-ticker.C:
+				if dc.err = sample(); dc.err != nil {
+					return
 				}
-			case <-finish:
+			case <-dc.finish:
+				dc.err = sample()
 				return
 			}
 		}
 	}()
 
-	return finish
+	return &dc, nil
+}
+
+// Stop collection and wait for the goroutine to close the CSV file.
+// Returns the error that stopped collection early, if any.
+// A nil collector is a no-op.
+func (dc *DiskstatsCollector) Stop() error {
+	if dc == nil {
+		return nil
+	}
+
+	close(dc.finish)
+	<-dc.done
+
+	return dc.err
 }
 
-func ReadDiskstats() (out Diskstats) {
-	data, err := ioutil.ReadFile("/proc/diskstats")
+// Unseen returns the devices that never showed up in /proc/diskstats while
+// collecting, call it after Stop(). Usually means the device numbers are
+// wrong and diskstats.csv has nothing useful for them.
+func (dc *DiskstatsCollector) Unseen() (out []DevNum) {
+	if dc == nil {
+		return nil
+	}
+
+	for _, dn := range dc.devs {
+		if !dc.seen[dn] {
+			out = append(out, dn)
+		}
+	}
+
+	return out
+}
+
+func ReadDiskstats() (Diskstats, error) {
+	return DefaultProcfs.Diskstats()
+}
+
+// Diskstats reads and parses diskstats from this procfs
+func (p Procfs) Diskstats() (Diskstats, error) {
+	fname := p.Path("diskstats")
+	data, err := ioutil.ReadFile(fname)
 	if err != nil {
-		log.Fatalf("Could not read /proc/diskstats: %s\n", err)
+		return nil, err
 	}
 
-	timestamp := time.Now()
+	return parseDiskstats(fname, data, time.Now())
+}
 
+func parseDiskstats(fname string, data []byte, timestamp time.Time) (out Diskstats, err error) {
 	// slice off the last byte, a newline, to prevent a phantom row
-	rows := bytes.Split(data[0:len(data)-1], []byte{byte('\n')})
+	rows := bytes.Split(bytes.TrimRight(data, "\n"), []byte{byte('\n')})
 
 	// bytes.Split doesn't handle variable whitespace between fields
+	// newer kernels append discard and flush stats after field 13, ignore them
 	fields := make([]string, 14)
-	field := make([]byte, 32)
-	var f, i int
-	for _, row := range rows {
-		f = 0
-		i = 0
-		for _, b := range row[0 : len(row)-1] {
-			if b != byte(' ') {
-				field[i] = b
-				i++
-			} else if i > 0 {
-				fields[f] = string(field[0:i])
-				f++
-				i = 0
+	for lno, row := range rows {
+		rfields := bytes.Fields(row)
+		if len(rfields) < len(fields) {
+			continue
+		}
+		for f := range fields {
+			fields[f] = string(rfields[f])
+		}
+
+		// hang on to the first error, the rest of the row is junk anyways
+		num := func(idx int) uint64 {
+			val, perr := strconv.ParseUint(fields[idx], 10, 64)
+			if perr != nil && err == nil {
+				err = &ParseError{fname, lno + 1, fmt.Errorf("field %d, value '%s', device '%s': %s",
+					idx, fields[idx], fields[2], perr)}
 			}
+			return val
 		}
 
 		st := Diskstat{
-			fldtoint(fields, 0),
-			fldtoint(fields, 1),
+			uint(num(0)),
+			uint(num(1)),
 			fields[2],
-			fldtoint64(fields, 3),
-			fldtoint64(fields, 4),
-			fldtoint64(fields, 5),
-			fldtoint(fields, 6),
-			fldtoint64(fields, 7),
-			fldtoint64(fields, 8),
-			fldtoint64(fields, 9),
-			fldtoint(fields, 10),
-			fldtoint(fields, 11),
-			fldtoint(fields, 12),
-			fldtoint(fields, 13),
+			num(3),
+			num(4),
+			num(5),
+			uint(num(6)),
+			num(7),
+			num(8),
+			num(9),
+			uint(num(10)),
+			uint(num(11)),
+			uint(num(12)),
+			uint(num(13)),
 			timestamp,
 			0,
 		}
 
+		if err != nil {
+			return nil, err
+		}
+
 		out = append(out, st)
 	}
 
-	return out
+	return out, nil
 }
 
-func (from *Diskstat) Delta(to Diskstat) Diskstat {
+func (from *Diskstat) Delta(to Diskstat) (Diskstat, error) {
 	if from.Major != to.Major || from.Minor != to.Minor {
-		log.Fatal("Comparing different devices doesn't make sense. %s / %s\n", from.Name, to.Name)
+		return Diskstat{}, fmt.Errorf("comparing different devices doesn't make sense: %s / %s", from.Name, to.Name)
 	}
 
 	return Diskstat{
@@ -149,42 +265,98 @@ func (from *Diskstat) Delta(to Diskstat) Diskstat {
 		to.WriteMerged - from.WriteMerged,
 		to.WriteSectors - from.WriteSectors,
 		to.WriteMs - from.WriteMs,
-		to.IOPending - from.IOPending,
+		to.IOPending, // not a counter, the number in flight at the end
 		to.IOMs - from.IOMs,
 		to.IOQueueMs - from.IOQueueMs,
 		to.Time,
 		to.Time.Sub(from.Time),
+	}, nil
+}
+
+// devNums returns the device's major/minor from the device file
+func (d *Device) devNums() (major, minor uint, err error) {
+	fi, err := os.Stat(d.Device)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not stat device file: %w", err)
 	}
+	native := fi.Sys().(*syscall.Stat_t)
+
+	return devMajor(uint64(native.Rdev)), devMinor(uint64(native.Rdev)), nil
+}
+
+// major/minor decoding, same as gnu_dev_major/gnu_dev_minor in glibc's
+// sys/sysmacros.h, including the cast of the high parts to 32 bits so they
+// don't pick up bits of the other number. The old 8 bit split breaks for
+// NVMe, dm and any minor above 255, e.g. nvme0n1p3 is 259:3 and dm-300 is
+// 253:300.
+func devMajor(dev uint64) uint {
+	return uint(uint32(dev>>8)&0xfff | uint32(dev>>32)&^0xfff)
 }
 
-func fldtoint(fields []string, idx int) uint {
-	return uint(fldtoint64(fields, idx))
+func devMinor(dev uint64) uint {
+	return uint(uint32(dev)&0xff | uint32(dev>>12)&^0xff)
 }
 
-func fldtoint64(fields []string, idx int) uint64 {
-	if len(fields[idx]) == 0 {
-		return 0
+// diskstatsDevs returns the devices to collect diskstats for: the device
+// and, with DiskstatsRelated, the disk a partition is on and everything
+// an md/dm device is built from, all the way down.
+func (d *Device) diskstatsDevs(sys Sysfs) ([]DevNum, error) {
+	major, minor, err := d.devNums()
+	if err != nil {
+		return nil, err
 	}
 
-	out, err := strconv.ParseUint(fields[idx], 10, 64)
+	real, err := filepath.EvalSymlinks(d.Device)
 	if err != nil {
-		log.Fatalf("Failed to convert field %d, value '%s', device '%s' to int: %s\n",
-			idx, fields[idx], fields[2], err)
+		real = d.Device
 	}
+	devs := []DevNum{{major, minor, path.Base(real)}}
 
-	return out
+	if !d.DiskstatsRelated || !sys.IsBlockDevice(devs[0].Name) {
+		return devs, nil
+	}
+
+	queue := []string{devs[0].Name}
+	seen := map[string]bool{devs[0].Name: true}
+	for i := 0; i < len(queue); i++ {
+		parent, err := sys.Parent(queue[i])
+		if err != nil {
+			return nil, err
+		}
+		slaves, err := sys.Slaves(queue[i])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, k := range append(slaves, parent) {
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			queue = append(queue, k)
+
+			dn, err := sysfsDevNum(sys, k)
+			if err != nil {
+				return nil, err
+			}
+			devs = append(devs, dn)
+		}
+	}
+
+	return devs, nil
 }
 
-// major/minor decoding from /usr/include/sys/sysmacros.h on linux
-func (d *Device) devNums() (major, minor uint) {
-	fi, err := os.Stat(d.Device)
+// sysfsDevNum reads major:minor from /sys/class/block/<kname>/dev
+func sysfsDevNum(sys Sysfs, kname string) (DevNum, error) {
+	dev, err := sys.BlockString(kname, "dev")
 	if err != nil {
-		log.Fatalf("Could not stat device file: %s\n", err)
+		return DevNum{}, err
+	}
+
+	dn := DevNum{Name: kname}
+	if _, err := fmt.Sscanf(dev, "%d:%d", &dn.Major, &dn.Minor); err != nil {
+		return DevNum{}, fmt.Errorf("bad device number %q for %s: %w", dev, kname, err)
 	}
-	native := fi.Sys().(*syscall.Stat_t)
-	// http://stackoverflow.com/questions/4309882/device-number-in-stat-command-output
-	major = uint(native.Rdev) >> 8 & 0xff
-	minor = uint(native.Rdev) & 0xff
 
-	return
+	return dn, nil
 }
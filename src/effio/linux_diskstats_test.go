@@ -0,0 +1,136 @@
+package effio
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDevMajorMinor(t *testing.T) {
+	// makedev from glibc's sys/sysmacros.h
+	makedev := func(major, minor uint64) uint64 {
+		return (minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32)
+	}
+
+	tests := []struct {
+		major, minor uint
+	}{
+		{8, 1},          // sda1
+		{259, 3},        // nvme0n1p3, major above 255
+		{65, 17},        // sdr1
+		{253, 300},      // dm-300, minor above 255
+		{8, 1048575},    // largest 20 bit minor
+		{4095, 0xfffff}, // largest 12 bit major
+		{4096, 1},       // major bits above 12 stay out of the minor
+		{0x12345, 0x6789abcd},
+		{0xffffffff, 0xffffffff},
+	}
+
+	for _, tt := range tests {
+		dev := makedev(uint64(tt.major), uint64(tt.minor))
+		if devMajor(dev) != tt.major || devMinor(dev) != tt.minor {
+			t.Errorf("%#x: expected %d:%d, got %d:%d", dev, tt.major, tt.minor, devMajor(dev), devMinor(dev))
+		}
+	}
+
+	// the numbers stat returns for a few real devices
+	if devMajor(0x10303) != 259 || devMinor(0x10303) != 3 {
+		t.Errorf("0x10303 should be 259:3, got %d:%d", devMajor(0x10303), devMinor(0x10303))
+	}
+	if devMajor(0x100800) != 8 || devMinor(0x100800) != 256 {
+		t.Errorf("0x100800 should be 8:256, got %d:%d", devMajor(0x100800), devMinor(0x100800))
+	}
+}
+
+func TestDiskstatsDevs(t *testing.T) {
+	fs := newFakeSysfs(t)
+
+	// md0 on sda1 and sdb1, dm-0 on md0
+	fs.device("ata/sda", map[string]string{"dev": "8:0"})
+	fs.device("ata/sda/sda1", map[string]string{"dev": "8:1", "partition": "1"})
+	fs.device("ata/sdb", map[string]string{"dev": "8:16"})
+	fs.device("ata/sdb/sdb1", map[string]string{"dev": "8:17", "partition": "1"})
+	fs.device("virtual/block/md0", map[string]string{"dev": "9:0"})
+	fs.device("virtual/block/dm-0", map[string]string{"dev": "253:0"})
+	fs.holder("sda1", "md0")
+	fs.holder("sdb1", "md0")
+	fs.holder("md0", "dm-0")
+
+	// a plain file named after the kernel device stands in for /dev/dm-0
+	devFile := path.Join(fs.root, "dev/dm-0")
+	if err := ioutil.WriteFile(devFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := Device{Device: devFile}
+	devs, err := d.diskstatsDevs(fs.sysfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devs) != 1 || devs[0].Name != "dm-0" {
+		t.Errorf("without diskstats_related only the device should be collected, got %v", devs)
+	}
+
+	d.DiskstatsRelated = true
+	devs, err = d.diskstatsDevs(fs.sysfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, dn := range devs[1:] {
+		got = append(got, dn.String())
+	}
+	expect := "9:0 (md0) 8:1 (sda1) 8:17 (sdb1) 8:0 (sda) 8:16 (sdb)"
+	if strings.Join(got, " ") != expect {
+		t.Errorf("expected %s, got %s", expect, strings.Join(got, " "))
+	}
+}
+
+func TestCollectDiskstats(t *testing.T) {
+	dir := t.TempDir()
+	proc := Procfs{Root: dir}
+	stats := "" +
+		" 259       0 nvme0n1 100 0 800 10 200 0 1600 20 0 30 30\n" +
+		" 259       3 nvme0n1p3 50 0 400 5 100 0 800 10 0 15 15 0 0 0 0\n" +
+		"   8     256 sdq 1 0 8 1 1 0 8 1 0 2 2\n"
+	if err := ioutil.WriteFile(path.Join(dir, "diskstats"), []byte(stats), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	devs := []DevNum{{259, 3, "nvme0n1p3"}, {259, 0, "nvme0n1"}, {8, 256, "sdq"}, {8, 1, "sda1"}}
+	fname := path.Join(dir, "diskstats.csv")
+	dc, err := collectDiskstats(fname, proc, devs, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := dc.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if unseen := dc.Unseen(); len(unseen) != 1 || unseen[0].Name != "sda1" {
+		t.Errorf("only sda1 should be unseen, got %v", unseen)
+	}
+
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) != 15 {
+			t.Fatalf("expected 15 fields, got %q", line)
+		}
+		counts[fields[3]]++
+	}
+	// at least the first and last samples
+	for _, name := range []string{"nvme0n1", "nvme0n1p3", "sdq"} {
+		if counts[name] < 2 {
+			t.Errorf("expected at least 2 rows for %s, got %d", name, counts[name])
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package effio
+
+// Mount options from the device JSON, e.g. "noatime,data=writeback". The
+// generic ones like noatime are flags to mount(2) and everything else is
+// handed to the filesystem as a data string, the same split mount(8) does.
+// Listing a drive more than once in the device JSON with different names
+// and mount options tests it under each configuration in one suite.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// MountOptions is the parsed form of Device.MountOptions, recorded in
+// command.json and available to templates as .MountOptions
+type MountOptions struct {
+	Flags []string `json:"flags"` // options passed as mount(2) flags, e.g. noatime
+	Data  string   `json:"data"`  // everything else, passed to the filesystem
+	flags uintptr
+}
+
+// used when the device JSON doesn't set mount_options
+const DefaultMountOptions = "noatime,nodiratime"
+
+// mount(8) options that are flags to mount(2)
+var mountFlagNames = map[string]uintptr{
+	"ro":          syscall.MS_RDONLY,
+	"nosuid":      syscall.MS_NOSUID,
+	"nodev":       syscall.MS_NODEV,
+	"noexec":      syscall.MS_NOEXEC,
+	"sync":        syscall.MS_SYNCHRONOUS,
+	"dirsync":     syscall.MS_DIRSYNC,
+	"mand":        syscall.MS_MANDLOCK,
+	"noatime":     syscall.MS_NOATIME,
+	"nodiratime":  syscall.MS_NODIRATIME,
+	"relatime":    syscall.MS_RELATIME,
+	"strictatime": syscall.MS_STRICTATIME,
+	"lazytime":    1 << 25, // MS_LAZYTIME, missing from syscall
+}
+
+// mount(8) options that are the default and don't set anything
+var mountNoopNames = map[string]bool{
+	"rw": true, "defaults": true, "async": true, "atime": true,
+	"suid": true, "dev": true, "exec": true, "nomand": true,
+}
+
+// filesystem options effio knows about, name -> regexp for the value, or
+// an empty string for options that don't take one. Options for other
+// filesystems, or ones not listed, get a warning but are still passed on
+// since the kernel is the final word.
+var fsMountOptions = map[string]map[string]string{
+	"ext4": {
+		"data": `journal|ordered|writeback`, "commit": `\d+`, "barrier": `|0|1`, "nobarrier": "",
+		"journal_async_commit": "", "journal_checksum": "", "nojournal_checksum": "",
+		"discard": "", "nodiscard": "", "delalloc": "", "nodelalloc": "",
+		"dioread_nolock": "", "dioread_lock": "", "stripe": `\d+`, "inode_readahead_blks": `\d+`,
+		"min_batch_time": `\d+`, "max_batch_time": `\d+`, "journal_ioprio": `[0-7]`,
+		"errors": `continue|remount-ro|panic`, "auto_da_alloc": `|0|1`, "noauto_da_alloc": "",
+		"init_itable": `\d*`, "noinit_itable": "", "user_xattr": "", "nouser_xattr": "",
+		"acl": "", "noacl": "", "i_version": "", "noload": "", "norecovery": "",
+	},
+	"xfs": {
+		"allocsize": `\d+[kKmMgG]?`, "attr2": "", "noattr2": "", "discard": "", "nodiscard": "",
+		"inode32": "", "inode64": "", "largeio": "", "nolargeio": "", "logbufs": `\d+`,
+		"logbsize": `\d+[kK]?`, "noalign": "", "swalloc": "", "sunit": `\d+`, "swidth": `\d+`,
+		"wsync": "", "nouuid": "", "filestreams": "", "ikeep": "", "noikeep": "",
+		"norecovery": "", "barrier": "", "nobarrier": "",
+	},
+	"btrfs": {
+		"compress": `|zlib(:\d)?|lzo|zstd(:\d+)?|no`, "compress-force": `|zlib(:\d)?|lzo|zstd(:\d+)?`,
+		"ssd": "", "nossd": "", "ssd_spread": "", "nossd_spread": "", "nodatacow": "", "datacow": "",
+		"nodatasum": "", "datasum": "", "space_cache": `|v1|v2`, "nospace_cache": "",
+		"discard": `|sync|async`, "nodiscard": "", "autodefrag": "", "noautodefrag": "",
+		"commit": `\d+`, "thread_pool": `\d+`, "max_inline": `\d+[kKmMgG]?`,
+		"flushoncommit": "", "noflushoncommit": "", "barrier": "", "nobarrier": "",
+	},
+}
+
+// options that are accepted but don't do what they used to
+var fsMountOptionNotes = map[string]map[string]string{
+	"xfs": {
+		"barrier":   "removed in Linux 4.19, newer kernels refuse to mount",
+		"nobarrier": "removed in Linux 4.19, newer kernels refuse to mount",
+		"noattr2":   "deprecated, attr2 is always on with v5 filesystems",
+	},
+}
+
+// ParseMountOptions splits a comma separated options string into flags and
+// data. An empty string means DefaultMountOptions. Errors are only for
+// things no filesystem would take, see Validate() for the rest.
+func ParseMountOptions(opts string) (mo MountOptions, err error) {
+	if opts == "" {
+		opts = DefaultMountOptions
+	}
+
+	var data []string
+	for _, opt := range strings.Split(opts, ",") {
+		switch {
+		case opt == "":
+			return mo, fmt.Errorf("empty option in mount options %q", opts)
+		case strings.ContainsAny(opt, " \t\n"):
+			return mo, fmt.Errorf("mount option %q contains whitespace", opt)
+		case mountNoopNames[opt]:
+		case mountFlagNames[opt] != 0:
+			mo.flags |= mountFlagNames[opt]
+			mo.Flags = append(mo.Flags, opt)
+		default:
+			data = append(data, opt)
+		}
+	}
+	mo.Data = strings.Join(data, ",")
+
+	return mo, nil
+}
+
+// Validate checks the options make sense for benchmarking on the given
+// filesystem. Warnings are for options effio doesn't know about, which
+// might still be fine.
+func (mo MountOptions) Validate(fstype string) (errs, warnings []error) {
+	atimes := 0
+	for _, flag := range mo.Flags {
+		switch flag {
+		case "ro":
+			errs = append(errs, fmt.Errorf("mount option ro makes the filesystem read-only, fio can't write test files"))
+		case "noatime", "relatime", "strictatime":
+			atimes++
+		}
+	}
+	if atimes > 1 {
+		errs = append(errs, fmt.Errorf("mount options %s conflict, pick one of noatime, relatime and strictatime", strings.Join(mo.Flags, ",")))
+	}
+
+	if mo.Data == "" {
+		return errs, warnings
+	}
+
+	known, ok := fsMountOptions[fstype]
+	if !ok {
+		warnings = append(warnings, fmt.Errorf("can't check mount options %q for filesystem %q", mo.Data, fstype))
+		return errs, warnings
+	}
+
+	for _, opt := range strings.Split(mo.Data, ",") {
+		kv := strings.SplitN(opt, "=", 2)
+		re, ok := known[kv[0]]
+		if !ok {
+			warnings = append(warnings, fmt.Errorf("unknown %s mount option %q", fstype, kv[0]))
+			continue
+		}
+
+		val := ""
+		if len(kv) == 2 {
+			val = kv[1]
+		}
+		if re == "" && len(kv) == 2 {
+			errs = append(errs, fmt.Errorf("%s mount option %s doesn't take a value", fstype, kv[0]))
+		} else if !regexp.MustCompile(`^(?:` + re + `)$`).MatchString(val) {
+			errs = append(errs, fmt.Errorf("invalid value %q for %s mount option %s", val, fstype, kv[0]))
+		}
+
+		if note, ok := fsMountOptionNotes[fstype][kv[0]]; ok {
+			warnings = append(warnings, fmt.Errorf("%s mount option %s: %s", fstype, kv[0], note))
+		}
+	}
+
+	return errs, warnings
+}
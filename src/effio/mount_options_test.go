@@ -0,0 +1,139 @@
+package effio
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	tests := []struct {
+		opts  string
+		flags uintptr
+		names string
+		data  string
+		err   string
+	}{
+		{"", syscall.MS_NOATIME | syscall.MS_NODIRATIME, "noatime,nodiratime", "", ""},
+		{"defaults", 0, "", "", ""},
+		{"rw,noatime,data=writeback,commit=60", syscall.MS_NOATIME, "noatime", "data=writeback,commit=60", ""},
+		{"lazytime,compress=zstd:3", 1 << 25, "lazytime", "compress=zstd:3", ""},
+		{"noatime,,nobarrier", 0, "", "", "empty option"},
+		{"noatime, nobarrier", 0, "", "", "whitespace"},
+	}
+
+	for _, tt := range tests {
+		mo, err := ParseMountOptions(tt.opts)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: expected an error mentioning %q, got %v", tt.opts, tt.err, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%q: unexpected error %s", tt.opts, err)
+			continue
+		}
+
+		if mo.flags != tt.flags || strings.Join(mo.Flags, ",") != tt.names || mo.Data != tt.data {
+			t.Errorf("%q: expected flags %#x %q data %q, got %#x %q %q", tt.opts, tt.flags, tt.names, tt.data, mo.flags, mo.Flags, mo.Data)
+		}
+	}
+}
+
+func TestMountOptionsValidate(t *testing.T) {
+	tests := []struct {
+		opts, fstype   string
+		errs, warnings int
+		contains       string
+	}{
+		{"noatime,data=ordered,commit=30,journal_ioprio=3", "ext4", 0, 0, ""},
+		{"noatime,logbsize=256k,inode64", "xfs", 0, 0, ""},
+		{"ssd,compress=zstd:1,space_cache=v2", "btrfs", 0, 0, ""},
+		{"ro", "ext4", 1, 0, "read-only"},
+		{"noatime,relatime", "ext4", 1, 0, "conflict"},
+		{"data=sometimes", "ext4", 1, 0, "invalid value"},
+		{"inode64=1", "xfs", 1, 0, "doesn't take a value"},
+		{"commit=", "ext4", 1, 0, "invalid value"},
+		{"fast_commit", "ext4", 0, 1, "unknown ext4"},
+		{"nobarrier", "xfs", 0, 1, "4.19"},
+		{"noatime,cache=loose", "9p", 0, 1, "can't check"},
+	}
+
+	for _, tt := range tests {
+		mo, err := ParseMountOptions(tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errs, warnings := mo.Validate(tt.fstype)
+		if len(errs) != tt.errs || len(warnings) != tt.warnings {
+			t.Errorf("%s %q: expected %d errors and %d warnings, got %v and %v", tt.fstype, tt.opts, tt.errs, tt.warnings, errs, warnings)
+			continue
+		}
+		if tt.contains != "" && !strings.Contains(errs2string(append(errs, warnings...)), tt.contains) {
+			t.Errorf("%s %q: expected a problem mentioning %q, got %v %v", tt.fstype, tt.opts, tt.contains, errs, warnings)
+		}
+	}
+}
+
+func errs2string(errs []error) (out string) {
+	for _, err := range errs {
+		out += err.Error() + "\n"
+	}
+	return out
+}
+
+// the same drive listed twice with different mount options becomes two sets
+// of tests with the options in their configs and command.json
+func TestMountOptionsSuite(t *testing.T) {
+	dir := t.TempDir()
+	tmpl := "[{{ .Name }}]\ndirectory={{ .Device.Mountpoint }}\n; mount {{ .MountOptions.Data }}\nwrite_lat_log=lat\nwrite_bw_log=bw\nwrite_iops_log=iops\n"
+	if err := ioutil.WriteFile(path.Join(dir, "rr.fio"), []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmpls, err := LoadFioConfDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devs := Devices{
+		{Name: "ssd-ordered", Device: "/dev/sdz", Mountpoint: "/mnt/sdz", Filesystem: "ext4", DoMount: true,
+			MountOptions: "noatime,data=ordered"},
+		{Name: "ssd-writeback", Device: "/dev/sdz", Mountpoint: "/mnt/sdz", Filesystem: "ext4", DoMount: true,
+			MountOptions: "noatime,data=writeback,barrier=2"},
+	}
+
+	suite, err := NewSuite("mount", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite.Populate(devs, tmpls)
+	if len(suite.FioCommands) != 2 {
+		t.Fatalf("expected 2 tests, got %d", len(suite.FioCommands))
+	}
+
+	for i, fcmd := range suite.FioCommands {
+		data, err := fcmd.RenderFioConf()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := strings.TrimPrefix(devs[i].MountOptions, "noatime,")
+		if !strings.Contains(string(data), "; mount "+want+"\n") {
+			t.Errorf("%s: mount options missing from config:\n%s", fcmd.Name, data)
+		}
+		if fcmd.MountOptions.Data != want {
+			t.Errorf("%s: expected data %q, got %q", fcmd.Name, want, fcmd.MountOptions.Data)
+		}
+	}
+
+	// barrier=2 isn't valid for ext4
+	if errs := suite.FioCommands[0].Validate(false); len(errs) != 0 {
+		t.Errorf("unexpected problems %v", errs)
+	}
+	errs := suite.FioCommands[1].Validate(false)
+	if len(errs) != 1 || IsWarning(errs[0]) || !strings.Contains(errs[0].Error(), "barrier") {
+		t.Errorf("expected one error about barrier, got %v", errs)
+	}
+}
@@ -0,0 +1,290 @@
+package effio
+
+// exercises effio run -> summarize-all -> serve with the fio simulator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const simTestFio = `[global]
+rw=randrw
+rwmixread=70
+blocksize={{ .Device.Blocksize }}
+iodepth=4
+numjobs=2
+
+[{{ .Name }}]
+write_bw_log={{ .FioBWLog }}
+write_lat_log={{ .FioLatLog }}
+write_iops_log={{ .FioIopsLog }}
+`
+
+// runSimSuite runs a two device, one template suite with the simulator
+// and returns it
+func runSimSuite(t *testing.T, dir string, sim *SimRunner) Suite {
+	return runSimSuiteFio(t, dir, simTestFio, sim)
+}
+
+// runSimSuiteFio is runSimSuite() with a different template
+func runSimSuiteFio(t *testing.T, dir, fio string, sim *SimRunner) Suite {
+	fioDir := path.Join(dir, "fio")
+	if err := os.MkdirAll(fioDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(fioDir, "sim.fio"), []byte(fio), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpls, err := LoadFioConfDir(fioDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no device or mountpoint, so nothing gets mounted
+	devs := Devices{
+		{Name: "sim0", Blocksize: 4096},
+		{Name: "sim1", Blocksize: 512},
+	}
+
+	suite, err := NewSuite("pipeline", path.Join(dir, "suites"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite.Populate(devs, tmpls)
+
+	if err := suite.WriteAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	failed, err := suite.Run(RunOpts{Parallel: 2, Runner: sim})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed != 0 {
+		t.Fatalf("%d simulated tests failed", failed)
+	}
+
+	return suite
+}
+
+func TestSimPipeline(t *testing.T) {
+	dir := t.TempDir()
+	sim := &SimRunner{Samples: 1000, Seed: 1}
+	suite := runSimSuite(t, dir, sim)
+
+	for _, fcmd := range suite.FioCommands {
+		if fcmd.State != StateSucceeded || fcmd.ExitStatus != 0 {
+			t.Errorf("%s: state %s exit status %d, expected succeeded 0", fcmd.Name, fcmd.State, fcmd.ExitStatus)
+		}
+
+		fdata, err := LoadFioJsonData(path.Join(fcmd.Path, fcmd.FioJson))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fdata.Jobs) != 1 || fdata.Jobs[0].Name != fcmd.Name {
+			t.Errorf("%s: output.json should have one job named after the test", fcmd.Name)
+		}
+	}
+
+	if _, err := os.Stat(suite.HostJson); err != nil {
+		t.Errorf("WriteAll did not write host.json: %s", err)
+	}
+
+	// summarize-all
+	outDir := path.Join(dir, "data")
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sets, err := InventoryCSVFiles(suite.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 devices x bw, lat, iops
+	if len(sets) != 6 {
+		t.Fatalf("expected 6 log sets, got %d", len(sets))
+	}
+
+	for _, set := range sets {
+		// numjobs=2
+		if len(set.Files) != 2 {
+			t.Errorf("%s: expected 2 per-job logs, got %d", set.Path(), len(set.Files))
+		}
+
+		outpath, err := set.WriteSummary(outDir, SummarizeOpts{Bins: 10, Jobs: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadFile(outpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var smry LogSummaries
+		if err := json.Unmarshal(data, &smry); err != nil {
+			t.Fatalf("%s: %s", outpath, err)
+		}
+
+		if smry.Summary.Count != uint64(2*sim.Samples) {
+			t.Errorf("%s: expected %d records, got %d", outpath, 2*sim.Samples, smry.Summary.Count)
+		}
+		if len(smry.Jobs) != 2 {
+			t.Errorf("%s: expected 2 job summaries, got %d", outpath, len(smry.Jobs))
+		}
+		if smry.FioCommand.State != StateSucceeded {
+			t.Errorf("%s: command.json was not attached to the summary", outpath)
+		}
+		if smry.FioJsonData.FioVersion != "fio-sim" {
+			t.Errorf("%s: output.json was not attached to the summary", outpath)
+		}
+		if smry.Host == nil || smry.Host.FioVersion != "fio-sim" || smry.DeviceSnapshot == nil {
+			t.Errorf("%s: host and device snapshots were not attached to the summary", outpath)
+		}
+
+		// lognormal with a mean of 500usec, the average should land nearby
+		if smry.LogType == "lat" && (smry.Summary.Average < 450 || smry.Summary.Average > 550) {
+			t.Errorf("%s: average latency %f is too far from 500", outpath, smry.Summary.Average)
+		}
+	}
+
+	// serve
+	cmd := Cmd{PathFlag: outDir}
+	w := httptest.NewRecorder()
+	cmd.InventoryDataHandler(w, httptest.NewRequest("GET", "/inventory", nil))
+	if w.Code != 200 {
+		t.Fatalf("/inventory returned %d: %s", w.Code, w.Body.String())
+	}
+
+	inv := make(map[string][]string)
+	if err := json.Unmarshal(w.Body.Bytes(), &inv); err != nil {
+		t.Fatal(err)
+	}
+	for _, ltype := range []string{"bw", "lat", "iops"} {
+		if len(inv[ltype]) != 2 {
+			t.Errorf("/inventory should list 2 %s summaries, got %v", ltype, inv[ltype])
+		}
+	}
+}
+
+// the same seed must produce the same data, otherwise summaries can't be
+// compared between runs
+// fio works out envvars and percentages itself, effio can't convert them
+// but the suite still has to write and run
+func TestSimEnvvarConfig(t *testing.T) {
+	t.Setenv("EFFIO_TEST_IODEPTH", "8")
+	fio := strings.Replace(simTestFio, "iodepth=4", "iodepth=${EFFIO_TEST_IODEPTH}\nsize=80%", 1)
+
+	dir := t.TempDir()
+	suite := runSimSuiteFio(t, dir, fio, &SimRunner{Samples: 100, Seed: 1})
+
+	for _, fcmd := range suite.FioCommands {
+		if fcmd.State != StateSucceeded {
+			t.Errorf("%s: state %s, expected succeeded", fcmd.Name, fcmd.State)
+		}
+
+		conf, err := ioutil.ReadFile(path.Join(fcmd.Path, fcmd.FioFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(conf), "iodepth=${EFFIO_TEST_IODEPTH}") {
+			t.Errorf("%s: config.fio should be written with the envvar as is", fcmd.Name)
+		}
+
+		saved, err := LoadFioCommandJson(path.Join(fcmd.Path, fcmd.CmdJson))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(saved.FioJobs) != 1 {
+			t.Fatalf("%s: expected 1 job in command.json, got %d", fcmd.Name, len(saved.FioJobs))
+		}
+		jo := saved.FioJobs[0]
+		if jo.Iodepth != 0 || jo.Size != 0 || jo.Numjobs != 2 {
+			t.Errorf("%s: expected iodepth 0, size 0, numjobs 2, got %+v", fcmd.Name, jo)
+		}
+		if jo.Unparsed["iodepth"] != "${EFFIO_TEST_IODEPTH}" || jo.Unparsed["size"] != "80%" {
+			t.Errorf("%s: raw values missing from unparsed: %v", fcmd.Name, jo.Unparsed)
+		}
+	}
+}
+
+// a resumed suite's suite.json should still show the tests that were
+// skipped as succeeded, and failed tests get run again
+func TestSimResume(t *testing.T) {
+	dir := t.TempDir()
+	sim := &SimRunner{Samples: 100, Seed: 1}
+	first := runSimSuite(t, dir, sim)
+
+	// pretend the second test failed in a few earlier runs, attempts
+	// from those don't count against -retries
+	journal, err := LoadJournal(first.JournalJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rerun := first.FioCommands[1].Name
+	journal.Entries[rerun].State = StateFailed
+	journal.Entries[rerun].Attempts = 3
+	if err := journal.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpls, err := LoadFioConfDir(path.Join(dir, "fio"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite, err := NewSuite("pipeline", path.Join(dir, "suites"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite.Populate(Devices{{Name: "sim0", Blocksize: 4096}, {Name: "sim1", Blocksize: 512}}, tmpls)
+	if suite.Journal, err = LoadJournal(suite.JournalJson); err != nil {
+		t.Fatal(err)
+	}
+	if err := suite.WriteAll(); err != nil {
+		t.Fatal(err)
+	}
+	if failed, err := suite.Run(RunOpts{Resume: true, Runner: sim}); err != nil || failed != 0 {
+		t.Fatalf("resume: %d failed, %v", failed, err)
+	}
+
+	saved, err := LoadSuiteJson(suite.SuiteJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, fcmd := range saved.FioCommands {
+		if fcmd.State != StateSucceeded || fcmd.ExitStatus != 0 || fcmd.MinTs.IsZero() || fcmd.MaxTs.IsZero() {
+			t.Errorf("%s: state %s exit status %d min_ts %s max_ts %s, expected a finished test", fcmd.Name, fcmd.State, fcmd.ExitStatus, fcmd.MinTs, fcmd.MaxTs)
+		}
+
+		was := first.FioCommands[i]
+		if fcmd.Name != rerun && !fcmd.MinTs.Equal(was.MinTs) {
+			t.Errorf("%s: skipped test should keep min_ts %s, got %s", fcmd.Name, was.MinTs, fcmd.MinTs)
+		}
+		if fcmd.Name == rerun && !fcmd.MinTs.After(was.MinTs) {
+			t.Errorf("%s: should have been run again", fcmd.Name)
+		}
+	}
+}
+
+func TestSimDeterministic(t *testing.T) {
+	read := func(dir string) []byte {
+		suite := runSimSuite(t, dir, &SimRunner{Dist: "exponential", Samples: 200, Seed: 42})
+		data, err := ioutil.ReadFile(path.Join(suite.FioCommands[0].Path, "lat_lat.2.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	a := read(t.TempDir())
+	b := read(t.TempDir())
+	if string(a) != string(b) {
+		t.Error("simulator output differs between runs with the same seed")
+	}
+}
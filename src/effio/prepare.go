@@ -0,0 +1,189 @@
+package effio
+
+// Putting devices in a known state before testing. SSD results depend a lot
+// on what the drive went through before the test, so the device JSON can ask
+// for the device to be discarded, filled sequentially and reformatted before
+// each suite or each test. All of it destroys whatever is on the device so it
+// has to be marked destroyable and can't be mounted anywhere.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	PrepareSuite = "suite" // once, before the first test on the device
+	PrepareTest  = "test"  // before every test on the device
+)
+
+// PreparePolicy is the "prepare" object in device JSON. Steps run in the
+// order discard, precondition, mkfs.
+type PreparePolicy struct {
+	When         string   `json:"when"`         // suite (default) or test
+	Discard      bool     `json:"discard"`      // blkdiscard the whole device
+	Precondition int      `json:"precondition"` // number of sequential write passes over the device
+	Mkfs         bool     `json:"mkfs"`         // run mkfs.<filesystem>
+	MkfsOptions  []string `json:"mkfs_options"` // e.g. ["-F", "-E", "nodiscard"]
+}
+
+// PrepareStep is the record of one step in command.json
+type PrepareStep struct {
+	Step    string    `json:"step"` // discard, precondition or mkfs
+	Command []string  `json:"command"`
+	MinTs   time.Time `json:"min_ts"`
+	MaxTs   time.Time `json:"max_ts"`
+	Seconds float64   `json:"seconds"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// fio job for preconditioning, sequential 128k writes are the usual
+// SNIA-style fill
+var preconditionArgs = []string{
+	"--name=precondition", "--rw=write", "--bs=128k", "--iodepth=32",
+	"--ioengine=libaio", "--direct=1",
+}
+
+// Validate checks the policy makes sense for the device. It doesn't look at
+// the system, see Device.checkPrepare() for that.
+func (p *PreparePolicy) Validate(d Device) (errs []error) {
+	if p == nil {
+		return nil
+	}
+
+	if p.When != "" && p.When != PrepareSuite && p.When != PrepareTest {
+		errs = append(errs, fmt.Errorf("prepare when must be %q or %q, not %q", PrepareSuite, PrepareTest, p.When))
+	}
+	if !p.Discard && p.Precondition == 0 && !p.Mkfs {
+		errs = append(errs, errors.New("prepare has nothing to do, set discard, precondition or mkfs"))
+	}
+	if !d.Destroyable {
+		errs = append(errs, fmt.Errorf("%s has a prepare policy but is not marked destroyable, prepare erases the device", d.Name))
+	}
+	if d.Device == "" {
+		errs = append(errs, fmt.Errorf("%s has a prepare policy but no device", d.Name))
+	}
+	if p.Precondition < 0 {
+		errs = append(errs, fmt.Errorf("prepare precondition must be a number of passes, not %d", p.Precondition))
+	}
+	if p.Mkfs && d.Filesystem == "" {
+		errs = append(errs, errors.New("prepare mkfs needs a filesystem in the device json"))
+	}
+	if !p.Mkfs && (p.Discard || p.Precondition > 0) && d.DoMount {
+		errs = append(errs, fmt.Errorf("prepare on %s would destroy the filesystem effio mounts, add mkfs", d.Name))
+	}
+
+	return errs
+}
+
+// checkPrepare makes sure it's safe to erase the device right now
+func (d *Device) checkPrepare() error {
+	for _, err := range d.Prepare.Validate(*d) {
+		return err
+	}
+
+	// -force doesn't apply here, mkfs on a mounted device is never right
+	uses, err := DeviceUses(DefaultProcfs, DefaultSysfs, d.Device)
+	if err != nil {
+		return err
+	} else if len(uses) > 0 {
+		return fmt.Errorf("refusing to erase it, %s", strings.Join(uses, ", "))
+	}
+
+	return nil
+}
+
+// PrepareDevice runs the device's prepare policy and records each step in
+// PrepareSteps. It stops at the first step that fails and returns a
+// *PrepareError, or ErrInterrupted.
+func (fcmd *FioCommand) PrepareDevice(intr *Interrupt) error {
+	d := &fcmd.Device
+	p := d.Prepare
+	fcmd.PrepareSteps = nil
+	fcmd.prepared = false
+
+	if p == nil {
+		return nil
+	}
+
+	if err := d.checkPrepare(); err != nil {
+		return &PrepareError{Device: d.Device, Step: "check", Err: err}
+	}
+
+	var steps [][]string
+	if p.Discard {
+		steps = append(steps, []string{"discard", "blkdiscard", d.Device})
+	}
+	if p.Precondition > 0 {
+		args := append([]string{"precondition", "fio"}, preconditionArgs...)
+		args = append(args, "--filename="+d.Device, "--loops="+strconv.Itoa(p.Precondition))
+		steps = append(steps, args)
+	}
+	if p.Mkfs {
+		args := append([]string{"mkfs", "mkfs." + d.Filesystem}, p.MkfsOptions...)
+		steps = append(steps, append(args, d.Device))
+	}
+
+	for _, step := range steps {
+		fcmd.Printf("Prepare %s: %s\n", step[0], strings.Join(step[1:], " "))
+
+		ps := PrepareStep{Step: step[0], Command: step[1:], MinTs: time.Now()}
+		err := runPrepareStep(step[1:], intr)
+		ps.MaxTs = time.Now()
+		ps.Seconds = ps.MaxTs.Sub(ps.MinTs).Seconds()
+		if err != nil {
+			ps.Error = err.Error()
+		}
+		fcmd.PrepareSteps = append(fcmd.PrepareSteps, ps)
+
+		if err == ErrInterrupted {
+			return err
+		} else if err != nil {
+			return &PrepareError{Device: d.Device, Step: step[0], Err: err}
+		}
+	}
+
+	fcmd.prepared = true
+	return nil
+}
+
+// runPrepareStep runs a command, passing along interrupts like
+// FioCommand.Run does
+func runPrepareStep(args []string, intr *Interrupt) error {
+	var output bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-exited:
+		if err != nil {
+			return fmt.Errorf("%s: %s", err, bytes.TrimSpace(output.Bytes()))
+		}
+		return nil
+	case <-intr.Done():
+		signalGroup(cmd.Process, intr.Signal())
+		select {
+		case <-exited:
+		case <-intr.Hard():
+			signalGroup(cmd.Process, syscall.SIGKILL)
+			<-exited
+		}
+		return ErrInterrupted
+	}
+}
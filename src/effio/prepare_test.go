@@ -0,0 +1,181 @@
+package effio
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakePrepareTools puts blkdiscard, fio and mkfs.ext4 scripts that log their
+// arguments at the front of PATH and returns the log file
+func fakePrepareTools(t *testing.T, dir string) string {
+	bin := path.Join(dir, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	log := path.Join(dir, "prepare.log")
+	script := "#!/bin/sh\necho \"$(basename $0) $*\" >> " + log + "\n"
+	for _, name := range []string{"blkdiscard", "fio", "mkfs.ext4"} {
+		if err := ioutil.WriteFile(path.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+	return log
+}
+
+func TestPreparePolicyValidate(t *testing.T) {
+	ok := Device{Name: "d", Device: "/dev/sdz", Filesystem: "ext4", Destroyable: true}
+	mounted := ok
+	mounted.DoMount = true
+
+	tests := []struct {
+		name     string
+		policy   PreparePolicy
+		dev      Device
+		contains string
+	}{
+		{"ok", PreparePolicy{Discard: true, Precondition: 2, Mkfs: true}, ok, ""},
+		{"ok mounted", PreparePolicy{When: PrepareTest, Discard: true, Mkfs: true}, mounted, ""},
+		{"not destroyable", PreparePolicy{Discard: true}, Device{Name: "d", Device: "/dev/sdz"}, "not marked destroyable"},
+		{"bad when", PreparePolicy{When: "always", Discard: true}, ok, "prepare when"},
+		{"nothing to do", PreparePolicy{}, ok, "nothing to do"},
+		{"no fs", PreparePolicy{Mkfs: true}, Device{Name: "d", Device: "/dev/sdz", Destroyable: true}, "needs a filesystem"},
+		{"no mkfs", PreparePolicy{Precondition: 1}, mounted, "add mkfs"},
+	}
+
+	for _, tt := range tests {
+		errs := tt.policy.Validate(tt.dev)
+		if tt.contains == "" && len(errs) != 0 {
+			t.Errorf("%s: unexpected errors %v", tt.name, errs)
+		} else if tt.contains != "" && (len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.contains)) {
+			t.Errorf("%s: expected one error mentioning %q, got %v", tt.name, tt.contains, errs)
+		}
+	}
+}
+
+func TestPrepareSuite(t *testing.T) {
+	dir := t.TempDir()
+	log := fakePrepareTools(t, dir)
+
+	fioDir := path.Join(dir, "fio")
+	if err := os.MkdirAll(fioDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.fio", "b.fio"} {
+		if err := ioutil.WriteFile(path.Join(fioDir, name), []byte(simTestFio), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmpls, err := LoadFioConfDir(fioDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// plain files stand in for the devices, the tools never open them
+	var devFiles []string
+	for _, name := range []string{"dev0", "dev1", "dev2"} {
+		devFiles = append(devFiles, path.Join(dir, name))
+		if err := ioutil.WriteFile(path.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	devs := Devices{
+		{Name: "d0", Device: devFiles[0], Blocksize: 512, Filesystem: "ext4", Destroyable: true,
+			Prepare: &PreparePolicy{Discard: true, Precondition: 2, Mkfs: true, MkfsOptions: []string{"-F"}}},
+		{Name: "d1", Device: devFiles[1], Blocksize: 512, Destroyable: true,
+			Prepare: &PreparePolicy{When: PrepareTest, Discard: true}},
+		{Name: "d2", Device: devFiles[2], Blocksize: 512, Prepare: &PreparePolicy{Discard: true}},
+		// never validated, Run() shouldn't fall over on it
+		{Name: "d3", Blocksize: 512, Destroyable: true, Prepare: &PreparePolicy{Discard: true}},
+	}
+
+	suite, err := NewSuite("prepare", path.Join(dir, "suites"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite.Populate(devs, tmpls)
+	if err := suite.WriteAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	failed, err := suite.Run(RunOpts{Parallel: 3, Runner: &SimRunner{Samples: 10}, Prepare: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// d2 isn't destroyable and d3 has no device so their tests fail
+	if failed != 4 {
+		t.Errorf("expected 4 failed tests, got %d", failed)
+	}
+
+	data, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d0, d1 []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "fio --version" {
+			continue // the host snapshot
+		} else if strings.Contains(line, devFiles[0]) {
+			d0 = append(d0, strings.Fields(line)[0])
+		} else if strings.Contains(line, devFiles[1]) {
+			d1 = append(d1, strings.Fields(line)[0])
+		} else {
+			t.Errorf("unexpected command %q", line)
+		}
+	}
+
+	// once for the suite, in order
+	if strings.Join(d0, " ") != "blkdiscard fio mkfs.ext4" {
+		t.Errorf("d0 should be prepared once per suite, got %v", d0)
+	}
+	// once per test
+	if strings.Join(d1, " ") != "blkdiscard blkdiscard" {
+		t.Errorf("d1 should be prepared before each test, got %v", d1)
+	}
+
+	var steps []string
+	for _, fcmd := range suite.FioCommands {
+		loaded, err := LoadFioCommandJson(path.Join(fcmd.Path, fcmd.CmdJson))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ps := range loaded.PrepareSteps {
+			if ps.MaxTs.Before(ps.MinTs) || ps.Seconds < 0 {
+				t.Errorf("%s: bad timing in %+v", fcmd.Name, ps)
+			}
+			steps = append(steps, fcmd.Device.Name+":"+ps.Step)
+
+			// the benchmark's timestamps don't include preparing
+			if ps.MaxTs.After(loaded.MinTs) {
+				t.Errorf("%s: %s ended at %s, after the benchmark started at %s", fcmd.Name, ps.Step, ps.MaxTs, loaded.MinTs)
+			}
+		}
+		if len(loaded.PrepareSteps) > 0 && (loaded.PrepareTs.After(loaded.PrepareSteps[0].MinTs) || loaded.PrepareElapsed <= 0) {
+			t.Errorf("%s: prepare started at %s and took %gs", fcmd.Name, loaded.PrepareTs, loaded.PrepareElapsed)
+		}
+
+		if fcmd.Device.Name == "d2" && fcmd.State != StateFailed {
+			t.Errorf("%s should have failed, it's not destroyable", fcmd.Name)
+		}
+	}
+	sort.Strings(steps)
+	if strings.Join(steps, " ") != "d0:discard d0:mkfs d0:precondition d1:discard d1:discard" {
+		t.Errorf("unexpected steps in command.json: %v", steps)
+	}
+
+	fcmd := &FioCommand{Name: "x", Device: devs[2]}
+	err = fcmd.PrepareDevice(nil)
+	var perr *PrepareError
+	if !errors.As(err, &perr) || perr.Step != "check" || len(fcmd.PrepareSteps) != 0 {
+		t.Errorf("expected a check failure with no steps run, got %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package effio
+
+// Reading from /proc. Like Sysfs, the root is configurable so the parsers
+// can be tested against files copied from other machines.
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type Procfs struct {
+	Root string // normally /proc
+}
+
+var DefaultProcfs = Procfs{Root: "/proc"}
+
+func (p Procfs) Path(fpath ...string) string {
+	return path.Join(append([]string{p.Root}, fpath...)...)
+}
+
+func (p Procfs) ReadString(fpath string) (string, error) {
+	data, err := ioutil.ReadFile(p.Path(fpath))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), " \t\r\n"), nil
+}
+
+// Meminfo reads /proc/meminfo into a map of bytes, e.g. MemTotal
+func (p Procfs) Meminfo() (map[string]int64, error) {
+	fname := p.Path("meminfo")
+	fd, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	out := make(map[string]int64)
+	scanner := bufio.NewScanner(fd)
+	for lno := 1; scanner.Scan(); lno++ {
+		// MemTotal:       16318452 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		val, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, &ParseError{File: fname, Line: lno, Err: err}
+		}
+		if len(fields) == 3 && fields[2] == "kB" {
+			val *= 1024
+		}
+
+		out[strings.TrimSuffix(fields[0], ":")] = val
+	}
+
+	return out, scanner.Err()
+}
+
+// MountInfo is one line of /proc/self/mountinfo, see proc(5)
+type MountInfo struct {
+	ID           int      `json:"id"`
+	ParentID     int      `json:"parent_id"`
+	MajorMinor   string   `json:"major_minor"` // e.g. 8:1
+	Root         string   `json:"root"`        // path within the filesystem, / unless it's a bind mount
+	Mountpoint   string   `json:"mountpoint"`
+	Options      string   `json:"options"` // per-mount options, e.g. rw,noatime
+	Optional     []string `json:"optional"`
+	FsType       string   `json:"fstype"`
+	Source       string   `json:"source"`        // e.g. /dev/sda1
+	SuperOptions string   `json:"super_options"` // per-superblock options, e.g. rw,errors=remount-ro
+}
+
+// Mountinfo reads /proc/self/mountinfo
+func (p Procfs) Mountinfo() ([]MountInfo, error) {
+	fname := p.Path("self/mountinfo")
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseMountinfo(fname, data)
+}
+
+// ParseMountinfo parses the contents of a mountinfo file, e.g.
+// 36 35 98:0 /mnt1 /mnt/parent rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+// the optional fields before the - can be any length
+func ParseMountinfo(fname string, data []byte) (out []MountInfo, err error) {
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		perr := func(format string, args ...interface{}) error {
+			return &ParseError{File: fname, Line: i + 1, Err: fmt.Errorf(format, args...)}
+		}
+
+		fields := strings.Fields(line)
+		sep := -1
+		for j := 6; j < len(fields); j++ {
+			if fields[j] == "-" {
+				sep = j
+				break
+			}
+		}
+		if sep == -1 || len(fields) < sep+3 {
+			return nil, perr("expected at least 10 fields separated by a -, got %q", line)
+		}
+
+		mi := MountInfo{
+			MajorMinor: fields[2],
+			Root:       unescapeMountinfo(fields[3]),
+			Mountpoint: unescapeMountinfo(fields[4]),
+			Options:    fields[5],
+			Optional:   fields[6:sep],
+			FsType:     fields[sep+1],
+			Source:     unescapeMountinfo(fields[sep+2]),
+		}
+		if len(fields) > sep+3 {
+			mi.SuperOptions = fields[sep+3]
+		}
+
+		if mi.ID, err = strconv.Atoi(fields[0]); err != nil {
+			return nil, perr("invalid mount id %q", fields[0])
+		}
+		if mi.ParentID, err = strconv.Atoi(fields[1]); err != nil {
+			return nil, perr("invalid parent id %q", fields[1])
+		}
+
+		out = append(out, mi)
+	}
+
+	return out, nil
+}
+
+// spaces, tabs, newlines and backslashes are octal escaped, e.g. \040
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		out.WriteByte(s[i])
+	}
+
+	return out.String()
+}
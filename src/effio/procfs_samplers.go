@@ -0,0 +1,221 @@
+package effio
+
+// Samplers for the files in /proc that say the most about why I/O was slow,
+// see collector.go for how they're run.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StatSampler reads /proc/stat: the total CPU time in each state, context
+// switches, interrupts and the number of running and blocked processes.
+// cpu_busy_pct and cpu_iowait_pct are worked out from the previous sample.
+type StatSampler struct {
+	prev []float64 // cpu line from the last sample
+}
+
+var statCPUKeys = []string{"user", "nice", "system", "idle", "iowait", "irq", "softirq", "steal"}
+
+func (*StatSampler) Name() string { return "stat" }
+
+func (*StatSampler) Counter(key string) bool {
+	switch key {
+	case "ctxt", "intr", "processes":
+		return true
+	}
+	return strings.HasPrefix(key, "cpu_") && !strings.HasSuffix(key, "_pct")
+}
+
+func (s *StatSampler) Sample(proc Procfs) (out []SampleValue, err error) {
+	data, err := proc.ReadString("stat")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "cpu":
+			// cpu  user nice system idle iowait irq softirq steal guest guest_nice
+			// guest time is already counted in user
+			cpu := make([]float64, len(statCPUKeys))
+			for i := range statCPUKeys {
+				if i+1 < len(fields) {
+					if cpu[i], err = strconv.ParseFloat(fields[i+1], 64); err != nil {
+						return nil, fmt.Errorf("bad cpu line in /proc/stat: %w", err)
+					}
+				}
+				out = append(out, SampleValue{"cpu_" + statCPUKeys[i], cpu[i]})
+			}
+
+			if s.prev != nil {
+				var total, idle, iowait float64
+				for i := range cpu {
+					total += cpu[i] - s.prev[i]
+				}
+				idle = cpu[3] - s.prev[3]
+				iowait = cpu[4] - s.prev[4]
+				if total > 0 {
+					out = append(out, SampleValue{"cpu_busy_pct", 100 * (total - idle - iowait) / total})
+					out = append(out, SampleValue{"cpu_iowait_pct", 100 * iowait / total})
+				}
+			}
+			s.prev = cpu
+		case "ctxt", "intr", "processes", "procs_running", "procs_blocked":
+			// intr is followed by a count for every interrupt, the first is the total
+			val, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad %s line in /proc/stat: %w", fields[0], err)
+			}
+			out = append(out, SampleValue{fields[0], val})
+		}
+	}
+
+	return out, nil
+}
+
+// MeminfoSampler reads /proc/meminfo, every value in bytes
+type MeminfoSampler struct{}
+
+func (MeminfoSampler) Name() string        { return "meminfo" }
+func (MeminfoSampler) Counter(string) bool { return false }
+
+func (MeminfoSampler) Sample(proc Procfs) (out []SampleValue, err error) {
+	mem, err := proc.Meminfo()
+	if err != nil {
+		return nil, err
+	}
+
+	for key, val := range mem {
+		out = append(out, SampleValue{key, float64(val)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+
+	return out, nil
+}
+
+// VmstatSampler reads /proc/vmstat: paging, reclaim, writeback and the
+// like. nr_* are current values, nearly everything else is a counter.
+type VmstatSampler struct{}
+
+func (VmstatSampler) Name() string { return "vmstat" }
+
+func (VmstatSampler) Counter(key string) bool {
+	return !strings.HasPrefix(key, "nr_") || key == "nr_dirtied" || key == "nr_written"
+}
+
+func (VmstatSampler) Sample(proc Procfs) (out []SampleValue, err error) {
+	data, err := proc.ReadString("vmstat")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		val, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s line in /proc/vmstat: %w", fields[0], err)
+		}
+		out = append(out, SampleValue{fields[0], val})
+	}
+
+	return out, nil
+}
+
+// InterruptsSampler reads /proc/interrupts summed across CPUs. Numbered
+// interrupts are keyed by number and device, e.g. 130:nvme0q1, so the
+// ones for the device under test are easy to find.
+type InterruptsSampler struct{}
+
+func (InterruptsSampler) Name() string        { return "interrupts" }
+func (InterruptsSampler) Counter(string) bool { return true }
+
+func (InterruptsSampler) Sample(proc Procfs) (out []SampleValue, err error) {
+	data, err := proc.ReadString("interrupts")
+	if err != nil {
+		return nil, err
+	}
+
+	//            CPU0       CPU1
+	//   0:         44          0   IO-APIC   2-edge      timer
+	// LOC:    1234567    1234000   Local timer interrupts
+	lines := strings.Split(strings.TrimSpace(data), "\n")
+	cpus := len(strings.Fields(lines[0]))
+	if cpus == 0 {
+		return nil, fmt.Errorf("no CPU header in /proc/interrupts")
+	}
+
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasSuffix(fields[0], ":") {
+			continue
+		}
+		key := strings.TrimSuffix(fields[0], ":")
+
+		var total float64
+		n := 1
+		for ; n < len(fields) && n <= cpus; n++ {
+			val, err := strconv.ParseFloat(fields[n], 64)
+			if err != nil {
+				break
+			}
+			total += val
+		}
+
+		if _, err := strconv.Atoi(key); err == nil && n < len(fields) {
+			key += ":" + fields[len(fields)-1]
+		}
+		out = append(out, SampleValue{strings.Replace(key, ",", ";", -1), total})
+	}
+
+	return out, nil
+}
+
+// PressureSampler reads /proc/pressure/<resource>, e.g. io. Only kernels
+// 4.20+ with PSI enabled have it.
+// some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+// full avg10=0.00 avg60=0.00 avg300=0.00 total=0
+// avg* are percentages, total is usec spent stalled.
+type PressureSampler struct {
+	Resource string
+}
+
+func (ps PressureSampler) Name() string         { return "pressure_" + ps.Resource }
+func (PressureSampler) Counter(key string) bool { return strings.HasSuffix(key, "_total") }
+
+func (ps PressureSampler) Sample(proc Procfs) (out []SampleValue, err error) {
+	data, err := proc.ReadString("pressure/" + ps.Resource)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, kv := range fields[1:] {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			val, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad value %q in /proc/pressure/%s: %w", kv, ps.Resource, err)
+			}
+			out = append(out, SampleValue{fields[0] + "_" + parts[0], val})
+		}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,42 @@
+package effio
+
+// A Runner executes the benchmark for one FioCommand after the suite has
+// written its config.fio, command.json and run.sh. FioRunner runs the real
+// fio against real devices. SimRunner (runner_sim.go) pretends to be fio so
+// the whole run -> summarize-all -> serve pipeline can be exercised without
+// spare disks or fio installed.
+
+import (
+	"fmt"
+	"time"
+)
+
+type Runner interface {
+	// Run the benchmark, writing fio's files into fcmd.Path and setting
+	// fcmd.ExitStatus. Returns ErrInterrupted when intr fires.
+	Run(fcmd *FioCommand, intr *Interrupt) error
+}
+
+// FioRunner mounts the device, collects diskstats and system metrics and
+// runs fio. See FioCommand.Run().
+type FioRunner struct {
+	SampleInterval time.Duration // default 1s
+}
+
+func (fr FioRunner) Run(fcmd *FioCommand, intr *Interrupt) error {
+	fcmd.SampleInterval = fr.SampleInterval
+	return fcmd.Run(intr)
+}
+
+// NewRunner returns the runner for the -runner flag, "fio" or "sim".
+// The simulator is returned with its defaults.
+func NewRunner(name string) (Runner, error) {
+	switch name {
+	case "", "fio":
+		return FioRunner{}, nil
+	case "sim":
+		return &SimRunner{}, nil
+	default:
+		return nil, fmt.Errorf("unknown runner '%s', must be fio or sim", name)
+	}
+}
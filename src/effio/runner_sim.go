@@ -0,0 +1,310 @@
+package effio
+
+// SimRunner is a fake fio. It parses the rendered config.fio for the job
+// names, rw, blocksize, numjobs, iodepth and write_*_log options, then writes
+// the same files fio >= 2.1.10 would: output.json and one bw/lat/iops log
+// per job clone, e.g. lat_lat.1.log. Latencies are drawn from a configurable
+// distribution and bw/iops are derived from them. Nothing is mounted and
+// diskstats are not collected.
+// Data is deterministic for a given Seed and test name so tests can compare
+// summaries across runs.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"regexp"
+)
+
+type SimRunner struct {
+	Dist    string  // latency distribution: lognormal (default), normal, exponential or uniform
+	Mean    float64 // mean latency in usec, default 500
+	Stddev  float64 // standard deviation in usec, default Mean/4, ignored by exponential
+	Samples int     // number of log records per job clone, default 2000
+	Seed    int64   // mixed with the test name so every test gets different data
+}
+
+// latency samplers by name, each returns usec for a given mean and stddev
+var simDists = map[string]func(rng *rand.Rand, mean, stddev float64) float64{
+	"normal": func(rng *rand.Rand, mean, stddev float64) float64 {
+		return rng.NormFloat64()*stddev + mean
+	},
+	"lognormal": func(rng *rand.Rand, mean, stddev float64) float64 {
+		sigma2 := math.Log(1 + (stddev*stddev)/(mean*mean))
+		mu := math.Log(mean) - sigma2/2
+		return math.Exp(mu + math.Sqrt(sigma2)*rng.NormFloat64())
+	},
+	"exponential": func(rng *rand.Rand, mean, stddev float64) float64 {
+		return rng.ExpFloat64() * mean
+	},
+	"uniform": func(rng *rand.Rand, mean, stddev float64) float64 {
+		// a uniform distribution of width w has a stddev of w/sqrt(12)
+		half := stddev * math.Sqrt(3)
+		return mean - half + rng.Float64()*2*half
+	},
+}
+
+// one [section] of an fio config, options from [global] included
+type simJob struct {
+	name      string
+	rw        string
+	bs        int
+	numjobs   int
+	iodepth   int
+	rwmixread int
+	logs      map[string]string // log type (bw, lat, iops) -> base name
+}
+
+// per-direction totals for output.json
+type simStats struct {
+	count  int
+	bytes  int
+	sum    float64
+	sumsq  float64
+	min    float64
+	max    float64
+	lastTs float64 // usec
+}
+
+// Validate checks the options and fills in the defaults.
+func (sr *SimRunner) Validate() error {
+	if sr.Dist == "" {
+		sr.Dist = "lognormal"
+	}
+	if _, ok := simDists[sr.Dist]; !ok {
+		return fmt.Errorf("unknown latency distribution '%s', must be lognormal, normal, exponential or uniform", sr.Dist)
+	}
+	if sr.Mean == 0 {
+		sr.Mean = 500
+	}
+	if sr.Stddev == 0 {
+		sr.Stddev = sr.Mean / 4
+	}
+	if sr.Samples == 0 {
+		sr.Samples = 2000
+	}
+	if sr.Mean < 0 || sr.Stddev < 0 || sr.Samples < 0 {
+		return fmt.Errorf("simulator mean, stddev and samples must be positive")
+	}
+
+	return nil
+}
+
+func (sr *SimRunner) Run(fcmd *FioCommand, intr *Interrupt) error {
+	fcmd.ExitStatus = -1
+
+	if err := sr.Validate(); err != nil {
+		return err
+	}
+
+	if intr.Interrupted() {
+		return ErrInterrupted
+	}
+
+	fcmd.TakeSnapshots("")
+	fcmd.Host.FioVersion = "fio-sim"
+
+	cfile := path.Join(fcmd.Path, fcmd.FioFile)
+	conf, err := ioutil.ReadFile(cfile)
+	if err != nil {
+		return fmt.Errorf("simulator could not read fio config: %w", err)
+	}
+
+	jobs, err := parseSimJobs(cfile, expandFioEnv(conf))
+	if err != nil {
+		return err
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(fcmd.Name))
+	rng := rand.New(rand.NewSource(sr.Seed ^ int64(h.Sum64())))
+	sample := simDists[sr.Dist]
+
+	out := FioJsonData{FioVersion: "fio-sim"}
+	clone := 0 // fio numbers log files across all jobs, starting at 1
+
+	for _, job := range jobs {
+		stats := []*simStats{{min: math.MaxFloat64}, {min: math.MaxFloat64}}
+
+		for i := 0; i < job.numjobs; i++ {
+			clone++
+			logs := make(map[string]*bufio.Writer)
+			files := make([]*os.File, 0, len(job.logs))
+			for ltype, base := range job.logs {
+				fname := path.Join(fcmd.Path, fmt.Sprintf("%s_%s.%d.log", base, ltype, clone))
+				fd, err := os.Create(fname)
+				if err != nil {
+					closeAll(files)
+					return fmt.Errorf("simulator could not create log: %w", err)
+				}
+				files = append(files, fd)
+				logs[ltype] = bufio.NewWriter(fd)
+			}
+
+			var ts float64 // usec since start
+			for j := 0; j < sr.Samples; j++ {
+				lat := math.Max(1, sample(rng, sr.Mean, sr.Stddev))
+				ts += lat / float64(job.iodepth)
+
+				ddir := 0
+				switch job.rw {
+				case "write", "randwrite":
+					ddir = 1
+				case "rw", "readwrite", "randrw":
+					if rng.Intn(100) >= job.rwmixread {
+						ddir = 1
+					}
+				}
+
+				iops := float64(job.iodepth) * 1e6 / lat
+				vals := map[string]float64{
+					"lat":  lat,
+					"iops": iops,
+					"bw":   iops * float64(job.bs) / 1024, // KB/s
+				}
+
+				for ltype, w := range logs {
+					fmt.Fprintf(w, "%d, %d, %d, %d\n", uint32(ts/1000), uint32(vals[ltype]), ddir, job.bs)
+				}
+
+				st := stats[ddir]
+				st.count++
+				st.bytes += job.bs
+				st.sum += lat
+				st.sumsq += lat * lat
+				st.min = math.Min(st.min, lat)
+				st.max = math.Max(st.max, lat)
+				st.lastTs = math.Max(st.lastTs, ts)
+			}
+
+			for _, w := range logs {
+				if err = w.Flush(); err != nil {
+					break
+				}
+			}
+			closeAll(files)
+			if err != nil {
+				return fmt.Errorf("simulator could not write log: %w", err)
+			}
+		}
+
+		fjob := FioJsonJob{Name: job.name}
+		fjob.Read = stats[0].jobStats()
+		fjob.Write = stats[1].jobStats()
+		out.Jobs = append(out.Jobs, fjob)
+
+		if intr.Interrupted() {
+			return ErrInterrupted
+		}
+	}
+
+	js, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return fmt.Errorf("simulator could not encode output JSON: %s", err)
+	}
+
+	err = ioutil.WriteFile(path.Join(fcmd.Path, fcmd.FioJson), append(js, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("simulator could not write output JSON: %w", err)
+	}
+
+	fcmd.ExitStatus = 0
+
+	return nil
+}
+
+func closeAll(files []*os.File) {
+	for _, fd := range files {
+		fd.Close()
+	}
+}
+
+// jobStats converts the totals to what fio reports in output.json
+func (st *simStats) jobStats() *FioJsonJobStats {
+	if st.count == 0 {
+		return &FioJsonJobStats{Slat: &FioJsonLatency{}, Clat: &FioJsonLatency{}, Lat: &FioJsonLatency{}}
+	}
+
+	n := float64(st.count)
+	mean := st.sum / n
+	lat := FioJsonLatency{
+		Min:   st.min,
+		Max:   st.max,
+		Mean:  mean,
+		Stdev: math.Sqrt(math.Max(0, st.sumsq/n-mean*mean)),
+	}
+	clat := lat
+	secs := math.Max(st.lastTs/1e6, 1e-6)
+
+	return &FioJsonJobStats{
+		IoBytes:   st.bytes,
+		Bandwidth: float64(st.bytes) / 1024 / secs,
+		Iops:      n / secs,
+		Runtime:   int(st.lastTs / 1000),
+		Slat:      &FioJsonLatency{},
+		Clat:      &clat,
+		Lat:       &lat,
+	}
+}
+
+// fio replaces ${VAR} in job files with the environment variable, the
+// simulator does the same before parsing
+var fioEnvRe = regexp.MustCompile(`\$\{([A-Za-z0-9_]+)\}`)
+
+func expandFioEnv(data []byte) []byte {
+	return fioEnvRe.ReplaceAllFunc(data, func(m []byte) []byte {
+		return []byte(os.Getenv(string(m[2 : len(m)-1])))
+	})
+}
+
+// parseSimJobs pulls out the handful of options the simulator cares about
+// with [global] applied, see FioConfig.JobOptions()
+func parseSimJobs(fname string, data []byte) (jobs []simJob, err error) {
+	conf, err := ParseFioConfig(fname, data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sec := range conf.Jobs() {
+		// options the simulator doesn't use, e.g. size=80%, are fine
+		// unconverted, the ones it does use are checked below
+		jo, perr := conf.JobOptions(sec)
+
+		job := simJob{
+			name:      jo.Name,
+			rw:        jo.Rw,
+			bs:        int(jo.Bs),
+			numjobs:   int(jo.Numjobs),
+			iodepth:   int(jo.Iodepth),
+			rwmixread: int(jo.RwMixRead),
+			logs:      make(map[string]string),
+		}
+
+		if job.bs < 1 || job.numjobs < 1 || job.iodepth < 1 {
+			if perr != nil {
+				return nil, perr
+			}
+			return nil, &ParseError{File: fname, Line: sec.Line, Err: fmt.Errorf("[%s] bs, numjobs and iodepth must be positive", sec.Name)}
+		}
+
+		for _, ltype := range []string{"bw", "lat", "iops"} {
+			if opt, ok := conf.Lookup(sec, "write_"+ltype+"_log"); ok {
+				job.logs[ltype] = opt.Value
+			}
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	if len(jobs) == 0 {
+		return nil, &ParseError{File: fname, Err: fmt.Errorf("no jobs found")}
+	}
+
+	return jobs, nil
+}
@@ -0,0 +1,166 @@
+package effio
+
+// Keeping effio from writing over something that's in use. Before a suite
+// starts, every device with a destructive test (raw writes to the device or
+// a prepare policy) is checked against mounts, swap and holders (md, dm/LVM)
+// of the device and everything built on top of it.
+// Mounts come from /proc/self/mountinfo rather than /proc/mounts so they can
+// be matched by device number, /proc/mounts says /dev/root for the root
+// filesystem on a lot of systems.
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DeviceUses returns a description of everything using the device or its
+// partitions, e.g. "sda1 is mounted on / (the root filesystem)". Devices
+// that aren't block devices, like files and /dev/null, are never in use.
+func DeviceUses(proc Procfs, sys Sysfs, devpath string) (uses []string, err error) {
+	real, err := filepath.EvalSymlinks(devpath)
+	if err != nil {
+		return nil, err
+	}
+
+	kname := path.Base(real)
+	if !sys.IsBlockDevice(kname) {
+		return nil, nil
+	}
+
+	// the device, its partitions and whatever is built on top of any of
+	// them, e.g. sda -> sda1 -> md0 -> dm-0
+	related := []string{kname}
+	seen := map[string]bool{kname: true}
+	devnums := make(map[string]string) // major:minor -> kernel name
+	for i := 0; i < len(related); i++ {
+		k := related[i]
+
+		if num, err := sys.BlockString(k, "dev"); err == nil {
+			devnums[num] = k
+		}
+
+		parts, err := sys.Partitions(k)
+		if err != nil {
+			return nil, err
+		}
+		holders, err := sys.Holders(k)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range holders {
+			uses = append(uses, fmt.Sprintf("%s is part of %s", k, h))
+		}
+
+		for _, r := range append(parts, holders...) {
+			if !seen[r] {
+				seen[r] = true
+				related = append(related, r)
+			}
+		}
+	}
+
+	mounts, err := proc.Mountinfo()
+	if err != nil {
+		return nil, err
+	}
+	for _, mi := range mounts {
+		if k, ok := devnums[mi.MajorMinor]; ok {
+			if mi.Mountpoint == "/" {
+				uses = append(uses, fmt.Sprintf("%s is mounted on / (the root filesystem)", k))
+			} else {
+				uses = append(uses, fmt.Sprintf("%s is mounted on %s", k, mi.Mountpoint))
+			}
+		}
+	}
+
+	// Filename Type Size Used Priority
+	swaps, err := proc.ReadString("swaps")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(swaps, "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		swap, err := filepath.EvalSymlinks(unescapeMountinfo(fields[0]))
+		if err != nil {
+			continue
+		}
+		if k := path.Base(swap); seen[k] {
+			uses = append(uses, fmt.Sprintf("%s is in use as swap", k))
+		}
+	}
+
+	return uses, nil
+}
+
+// Destructive returns why the test would destroy data on the device, or an
+// empty string if it only writes files under the mountpoint.
+func (fcmd *FioCommand) Destructive() (string, error) {
+	if fcmd.Device.Prepare != nil {
+		return "the prepare policy erases the device", nil
+	}
+	if fcmd.Device.Device == "" {
+		return "", nil
+	}
+
+	data, err := fcmd.RenderFioConf()
+	if err != nil {
+		return "", err
+	}
+	conf, err := ParseFioConfig(path.Join(fcmd.Path, fcmd.FioFile), data)
+	if err != nil {
+		return "", err
+	}
+
+	for _, job := range conf.Jobs() {
+		if !fioRwWrites(conf.LookupValue(job, "rw", "read")) {
+			continue
+		}
+
+		targets, _ := fioJobTargets(conf, job)
+		for _, target := range targets {
+			if sameFile(target, fcmd.Device.Device) {
+				return fmt.Sprintf("%s writes to the raw device", fcmd.Name), nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// CheckSafety finds the devices with destructive tests that are in use and
+// returns an *UnsafeDeviceError for each of them explaining why. A config
+// that can't be rendered or parsed can't be shown to be safe, so it counts
+// as destructive: effio validate is skipped with -novalidate and nothing
+// else would stop fio from writing to the device.
+func (suite *Suite) CheckSafety(proc Procfs, sys Sysfs) (errs []error) {
+	checked := make(map[string]bool)
+
+	for _, fcmd := range suite.FioCommands {
+		dev := fcmd.Device.Device
+		if dev == "" || checked[dev] {
+			continue
+		}
+
+		why, err := fcmd.Destructive()
+		if err != nil {
+			why = fmt.Sprintf("%s can't be checked for writes to the device (%s)", fcmd.Name, err)
+		} else if why == "" {
+			continue
+		}
+		checked[dev] = true
+
+		uses, err := DeviceUses(proc, sys, dev)
+		if err != nil {
+			errs = append(errs, &UnsafeDeviceError{Device: dev, Why: why, Uses: []string{err.Error()}})
+		} else if len(uses) > 0 {
+			errs = append(errs, &UnsafeDeviceError{Device: dev, Why: why, Uses: uses})
+		}
+	}
+
+	return errs
+}
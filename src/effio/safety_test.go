@@ -0,0 +1,90 @@
+package effio
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestDeviceUses(t *testing.T) {
+	fs := newFakeSysfs(t)
+	proc := Procfs{Root: path.Join(fs.root, "proc")}
+	devDir := path.Join(fs.root, "dev")
+	fs.mkdir(devDir)
+	fs.mkdir(path.Join(proc.Root, "self"))
+
+	// sda1 is /, sda2 is swap, sdb is in md0 which is mounted, sdc is free
+	fs.device("pci0000:00/ata1/block/sda", map[string]string{"dev": "8:0"})
+	fs.device("pci0000:00/ata1/block/sda/sda1", map[string]string{"dev": "8:1", "partition": "1"})
+	fs.device("pci0000:00/ata1/block/sda/sda2", map[string]string{"dev": "8:2", "partition": "2"})
+	fs.device("pci0000:00/ata2/block/sdb", map[string]string{"dev": "8:16"})
+	fs.device("virtual/block/md0", map[string]string{"dev": "9:0", "md/level": "raid0"})
+	fs.holder("sdb", "md0")
+	fs.device("pci0000:00/ata3/block/sdc", map[string]string{"dev": "8:32"})
+
+	for _, k := range []string{"sda", "sda1", "sda2", "sdb", "md0", "sdc"} {
+		if err := os.WriteFile(path.Join(devDir, k), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// /dev/disk/by-id style link
+	if err := os.Symlink(path.Join(devDir, "sdb"), path.Join(devDir, "ata-disk-b")); err != nil {
+		t.Fatal(err)
+	}
+
+	mountinfo := "22 1 8:1 / / rw,relatime - ext4 /dev/root rw\n" +
+		"30 22 9:0 / /data rw,noatime - xfs /dev/md0 rw\n"
+	swaps := "Filename\t\t\t\tType\t\tSize\t\tUsed\t\tPriority\n" +
+		path.Join(devDir, "sda2") + "                               partition\t8388604\t\t0\t\t-2\n"
+	if err := os.WriteFile(proc.Path("self/mountinfo"), []byte(mountinfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(proc.Path("swaps"), []byte(swaps), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]string{
+		"sda":        {"sda1 is mounted on / (the root filesystem)", "sda2 is in use as swap"},
+		"sda1":       {"sda1 is mounted on / (the root filesystem)"},
+		"ata-disk-b": {"sdb is part of md0", "md0 is mounted on /data"},
+		"sdc":        nil,
+	}
+	for dev, expect := range tests {
+		uses, err := DeviceUses(proc, fs.sysfs, path.Join(devDir, dev))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(uses, "; ") != strings.Join(expect, "; ") {
+			t.Errorf("%s: expected %q, got %q", dev, expect, uses)
+		}
+	}
+
+	// raw writes to sda and a prepare policy on sdb are destructive, files
+	// under a mountpoint on sda1 and reads from sdc are not
+	tmpl := func(s string) FioConfTmpl {
+		return FioConfTmpl{tmpl: template.Must(template.New("t").Parse(s))}
+	}
+	suite := Suite{FioCommands: FioCommands{
+		{Name: "raw-sda", Device: Device{Device: path.Join(devDir, "sda")}, FioConfTmpl: tmpl("[j]\nrw=randwrite\nfilename={{ .Device.Device }}\n")},
+		{Name: "files-sda1", Device: Device{Device: path.Join(devDir, "sda1"), Mountpoint: "/"}, FioConfTmpl: tmpl("[j]\nrw=write\ndirectory=/tmp\n")},
+		{Name: "prep-sdb", Device: Device{Device: path.Join(devDir, "ata-disk-b"), Prepare: &PreparePolicy{Discard: true}}, FioConfTmpl: tmpl("[j]\nrw=read\n")},
+		{Name: "read-sdc", Device: Device{Device: path.Join(devDir, "sdc")}, FioConfTmpl: tmpl("[j]\nrw=read\nfilename={{ .Device.Device }}\n")},
+		// a config that doesn't render can't be checked, so it's refused
+		// on a device in use and left alone on a free one
+		{Name: "broken-md0", Device: Device{Device: path.Join(devDir, "md0")}, FioConfTmpl: tmpl("[j]\nrw=write\nfilename={{ .Device.Nope }}\n")},
+		{Name: "broken-sdc", Device: Device{Device: path.Join(devDir, "sdc")}, FioConfTmpl: tmpl("[j]\nrw=write\nfilename={{ .Device.Nope }}\n")},
+	}}
+
+	errs := suite.CheckSafety(proc, fs.sysfs)
+	if len(errs) != 3 {
+		t.Fatalf("expected sda, sdb and md0 to be rejected, got %v", errs)
+	}
+	for i, expect := range []string{"raw-sda writes to the raw device but sda1 is mounted on / (the root filesystem), sda2 is in use as swap",
+		"prepare policy erases the device but sdb is part of md0", "broken-md0 can't be checked for writes to the device"} {
+		if !strings.Contains(errs[i].Error(), expect) {
+			t.Errorf("expected %q in %q", expect, errs[i])
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package effio
+
+// Snapshots of the host and device configuration so results can be
+// explained months later: which kernel, scheduler, read-ahead, fio version,
+// CPU governor and mount options were in effect when a test ran.
+// Everything is best effort, whatever can't be read is listed in Errors
+// rather than stopping a suite.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+type HostSnapshot struct {
+	Time          time.Time `json:"time"`
+	Hostname      string    `json:"hostname"`
+	Kernel        string    `json:"kernel"`         // uname -r
+	KernelVersion string    `json:"kernel_version"` // uname -v
+	KernelCmdline string    `json:"kernel_cmdline"`
+	Arch          string    `json:"arch"`
+	CPUModel      string    `json:"cpu_model"`
+	CPUs          int       `json:"cpus"`
+	CPUGovernor   string    `json:"cpu_governor"` // cpu0's, empty when there's no cpufreq (e.g. most VMs)
+	MemTotal      int64     `json:"mem_total"`    // bytes
+	SwapTotal     int64     `json:"swap_total"`   // bytes
+	FioVersion    string    `json:"fio_version"`
+	Errors        []string  `json:"errors,omitempty"`
+}
+
+type DeviceSnapshot struct {
+	Time         time.Time         `json:"time"`
+	Device       string            `json:"device"` // kernel name, e.g. sda1
+	Parent       string            `json:"parent"` // whole disk, where the queue settings come from
+	Queue        map[string]string `json:"queue"`  // /sys/block/<parent>/queue files, see snapshotQueueFiles
+	Mountpoint   string            `json:"mountpoint"`
+	FsType       string            `json:"fstype"`
+	MountOptions string            `json:"mount_options"`
+	SuperOptions string            `json:"super_options"`
+	Errors       []string          `json:"errors,omitempty"`
+}
+
+// the queue settings that most often explain a difference in results
+var snapshotQueueFiles = []string{
+	"scheduler", "read_ahead_kb", "nr_requests", "max_sectors_kb",
+	"rotational", "nomerges", "rq_affinity", "add_random", "write_cache",
+	"logical_block_size", "physical_block_size",
+}
+
+// TakeHostSnapshot reads host info from proc and sys. fio --version is run
+// with fioPath unless it's empty.
+func TakeHostSnapshot(proc Procfs, sys Sysfs, fioPath string) *HostSnapshot {
+	hs := HostSnapshot{Time: time.Now(), Arch: runtime.GOARCH}
+	fail := func(err error) {
+		hs.Errors = append(hs.Errors, err.Error())
+	}
+
+	str := func(fpath string) string {
+		val, err := proc.ReadString(fpath)
+		if err != nil {
+			fail(err)
+		}
+		return val
+	}
+	hs.Hostname = str("sys/kernel/hostname")
+	hs.Kernel = str("sys/kernel/osrelease")
+	hs.KernelVersion = str("sys/kernel/version")
+	hs.KernelCmdline = str("cmdline")
+
+	if cpuinfo, err := proc.ReadString("cpuinfo"); err != nil {
+		fail(err)
+	} else {
+		for _, line := range strings.Split(cpuinfo, "\n") {
+			kv := strings.SplitN(line, ":", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch strings.TrimSpace(kv[0]) {
+			case "processor":
+				hs.CPUs++
+			case "model name", "cpu model": // x86, mips & friends
+				hs.CPUModel = strings.TrimSpace(kv[1])
+			}
+		}
+	}
+
+	gov := path.Join(sys.Root, "devices/system/cpu/cpu0/cpufreq/scaling_governor")
+	if data, err := ioutil.ReadFile(gov); err == nil {
+		hs.CPUGovernor = string(bytes.TrimSpace(data))
+	}
+
+	if mem, err := proc.Meminfo(); err != nil {
+		fail(err)
+	} else {
+		hs.MemTotal = mem["MemTotal"]
+		hs.SwapTotal = mem["SwapTotal"]
+	}
+
+	if fioPath != "" {
+		out, err := exec.Command(fioPath, "--version").Output()
+		if err != nil {
+			fail(fmt.Errorf("%s --version: %s", fioPath, err))
+		}
+		hs.FioVersion = string(bytes.TrimSpace(out))
+	}
+
+	return &hs
+}
+
+// TakeDeviceSnapshot records the queue settings for the device and how it's
+// mounted, if it is. Take it after mounting to get the mount options.
+func TakeDeviceSnapshot(proc Procfs, sys Sysfs, dev Device) *DeviceSnapshot {
+	ds := DeviceSnapshot{Time: time.Now(), Queue: make(map[string]string)}
+	fail := func(err error) {
+		ds.Errors = append(ds.Errors, err.Error())
+	}
+
+	if dev.Device != "" {
+		real, err := filepath.EvalSymlinks(dev.Device)
+		if err != nil {
+			fail(err)
+		} else {
+			ds.Device = path.Base(real)
+			if ds.Parent, err = sys.Parent(ds.Device); err != nil {
+				fail(err)
+				ds.Parent = ds.Device
+			}
+
+			for _, fname := range snapshotQueueFiles {
+				if val, err := sys.BlockString(ds.Parent, path.Join("queue", fname)); err == nil {
+					ds.Queue[fname] = val
+				}
+			}
+			if len(ds.Queue) == 0 {
+				fail(fmt.Errorf("no queue settings found for %s in %s", ds.Parent, sys.Root))
+			}
+		}
+	}
+
+	if dev.Mountpoint != "" {
+		mounts, err := proc.Mountinfo()
+		if err != nil {
+			fail(err)
+		}
+
+		// the last mount on a path is the one that's visible
+		for _, mi := range mounts {
+			if mi.Mountpoint == path.Clean(dev.Mountpoint) {
+				ds.Mountpoint = mi.Mountpoint
+				ds.FsType = mi.FsType
+				ds.MountOptions = mi.Options
+				ds.SuperOptions = mi.SuperOptions
+			}
+		}
+	}
+
+	return &ds
+}
+
+// TakeSnapshots fills in fcmd.Host and fcmd.DeviceSnapshot
+func (fcmd *FioCommand) TakeSnapshots(fioPath string) {
+	fcmd.Host = TakeHostSnapshot(DefaultProcfs, DefaultSysfs, fioPath)
+	fcmd.DeviceSnapshot = TakeDeviceSnapshot(DefaultProcfs, DefaultSysfs, fcmd.Device)
+}
@@ -0,0 +1,87 @@
+package effio
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+const testMountinfo = `22 1 8:2 / / rw,relatime shared:1 - ext4 /dev/sda2 rw,errors=remount-ro
+25 22 0:21 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw
+40 22 259:1 / /mnt/effio/samsung\04024 rw,noatime shared:30 master:2 - xfs /dev/nvme0n1p1 rw,attr2,inode64,noquota
+41 22 259:1 / /mnt/effio/samsung\04024 rw,relatime - xfs /dev/nvme0n1p1 rw,attr2,inode64,noquota
+`
+
+func TestParseMountinfo(t *testing.T) {
+	mounts, err := ParseMountinfo("mountinfo", []byte(testMountinfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 4 {
+		t.Fatalf("expected 4 mounts, got %d", len(mounts))
+	}
+
+	mi := mounts[2]
+	if mi.ID != 40 || mi.ParentID != 22 || mi.MajorMinor != "259:1" || mi.Mountpoint != "/mnt/effio/samsung 24" ||
+		mi.Options != "rw,noatime" || len(mi.Optional) != 2 || mi.FsType != "xfs" ||
+		mi.Source != "/dev/nvme0n1p1" || mi.SuperOptions != "rw,attr2,inode64,noquota" {
+		t.Errorf("unexpected mount %+v", mi)
+	}
+
+	if _, err := ParseMountinfo("bad", []byte("22 1 8:2 / / rw,relatime shared:1 ext4\n")); err == nil {
+		t.Error("a line without a - separator should fail")
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	fs := newFakeSysfs(t)
+	proc := Procfs{Root: path.Join(fs.root, "proc")}
+
+	files := map[string]string{
+		"sys/kernel/hostname":  "brak",
+		"sys/kernel/osrelease": "6.1.0-13-amd64",
+		"sys/kernel/version":   "#1 SMP PREEMPT_DYNAMIC Debian 6.1.55-1",
+		"cmdline":              "BOOT_IMAGE=/vmlinuz root=/dev/sda2 ro quiet",
+		"meminfo":              "MemTotal:       16318452 kB\nMemFree:         1010000 kB\nSwapTotal:             0 kB\nHugePages_Total:       0\n",
+		"cpuinfo":              "processor\t: 0\nmodel name\t: AMD Ryzen 7 5800X\n\nprocessor\t: 1\nmodel name\t: AMD Ryzen 7 5800X\n",
+		"self/mountinfo":       testMountinfo,
+	}
+	for name, content := range files {
+		fs.mkdir(path.Dir(proc.Path(name)))
+		if err := os.WriteFile(proc.Path(name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.files("system/cpu/cpu0/cpufreq", map[string]string{"scaling_governor": "performance"})
+
+	hs := TakeHostSnapshot(proc, fs.sysfs, "")
+	if hs.Hostname != "brak" || hs.Kernel != "6.1.0-13-amd64" || hs.CPUs != 2 || hs.CPUModel != "AMD Ryzen 7 5800X" ||
+		hs.CPUGovernor != "performance" || hs.MemTotal != 16318452*1024 || len(hs.Errors) != 0 {
+		t.Errorf("unexpected host snapshot %+v", hs)
+	}
+
+	fs.device("pci0000:00/nvme/nvme0/nvme0n1", map[string]string{
+		"queue/scheduler":     "[none] mq-deadline",
+		"queue/read_ahead_kb": "128",
+	})
+	fs.device("pci0000:00/nvme/nvme0/nvme0n1/nvme0n1p1", map[string]string{"partition": "1"})
+
+	// the device file only has to resolve to something named after the device
+	fs.mkdir(path.Join(fs.root, "dev"))
+	devFile := path.Join(fs.root, "dev/nvme0n1p1")
+	if err := os.WriteFile(devFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := TakeDeviceSnapshot(proc, fs.sysfs, Device{Device: devFile, Mountpoint: "/mnt/effio/samsung 24/"})
+	if ds.Device != "nvme0n1p1" || ds.Parent != "nvme0n1" || ds.Queue["scheduler"] != "[none] mq-deadline" || ds.Queue["read_ahead_kb"] != "128" {
+		t.Errorf("unexpected device info in %+v", ds)
+	}
+	// the second mount on the same path wins
+	if ds.FsType != "xfs" || ds.MountOptions != "rw,relatime" || ds.SuperOptions != "rw,attr2,inode64,noquota" {
+		t.Errorf("unexpected mount info in %+v", ds)
+	}
+	if len(ds.Errors) != 0 {
+		t.Errorf("unexpected errors %v", ds.Errors)
+	}
+}
@@ -13,34 +13,51 @@ package effio
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"time"
 )
 
 type Suite struct {
-	Name        string      `json:"name"`         // a name given to the suite on the command line
-	Path        string      `json:"path"`         // path for writing benchmark data out
-	MinTs       time.Time   `json:"min_ts"`       // time the suite was started
-	MaxTs       time.Time   `json:"max_ts"`       // time the suite finished
-	EffioCmd    []string    `json:"effio_cmd"`    // os.Args() of the effio command used
-	SuiteJson   string      `json:"suite_json"`   // metadata about the suite of tests
-	FioCommands FioCommands `json:"fio_commands"` // fio commands run/to be run
+	Name        string        `json:"name"`         // a name given to the suite on the command line
+	Path        string        `json:"path"`         // path for writing benchmark data out
+	MinTs       time.Time     `json:"min_ts"`       // time the suite was started
+	MaxTs       time.Time     `json:"max_ts"`       // time the suite finished
+	EffioCmd    []string      `json:"effio_cmd"`    // os.Args() of the effio command used
+	SuiteJson   string        `json:"suite_json"`   // metadata about the suite of tests
+	JournalJson string        `json:"journal_json"` // state of each test, see journal.go
+	HostJson    string        `json:"host_json"`    // host snapshot taken by WriteAll, see snapshot.go
+	Host        *HostSnapshot `json:"host"`         // same as host.json
+	FioCommands FioCommands   `json:"fio_commands"` // fio commands run/to be run
+	Journal     *Journal      `json:"-"`            // loaded by Run()
+}
+
+// options for Suite.Run()
+type RunOpts struct {
+	Rerun    bool   // run every test, even ones with an output.json
+	Resume   bool   // use the journal to pick up where a previous run left off
+	Retries  int    // number of times to retry a failed test
+	Parallel int    // max tests to run at once, tests never share a device, <= 1 is sequential
+	Runner   Runner // runs each test, defaults to FioRunner
+	Prepare  bool   // apply device prepare policies, see prepare.go
 }
 
 // NewSuite returns an initialized Suite with the given
 // id and the Created field set to the current time.
-func NewSuite(name string, pathArg string) Suite {
+func NewSuite(name string, pathArg string) (Suite, error) {
 	absPath, err := filepath.Abs(pathArg)
 	if err != nil {
-		log.Fatalf("Could not determine the absolute path of '%s': %s\n", pathArg, err)
+		return Suite{}, fmt.Errorf("could not determine the absolute path of '%s': %s", pathArg, err)
 	}
 
 	spath := path.Join(absPath, name)
 	fname := path.Join(absPath, name, "suite.json")
+	jname := path.Join(absPath, name, "journal.json")
+	hname := path.Join(absPath, name, "host.json")
 
 	return Suite{
 		Name:        name,
@@ -48,36 +65,250 @@ func NewSuite(name string, pathArg string) Suite {
 		MinTs:       time.Now(),
 		EffioCmd:    os.Args,
 		SuiteJson:   fname,
+		JournalJson: jname,
+		HostJson:    hname,
 		FioCommands: FioCommands{},
-	}
+	}, nil
 }
 
-// Run the whole suite one at a time letting fio write its output into
-// the suite directories. Repeated runs will overwrite files; behavior
+// Run the whole suite letting fio write its output into the suite
+// directories. Repeated runs will overwrite files; behavior
 // is dependent on what fio does with existing files for now.
-func (suite *Suite) Run(rerun bool) {
+// Tests run one at a time in order unless opts.Parallel > 1, in which case
+// up to that many run at once as long as no two of them share a device or
+// mountpoint.
+// The state of each test is recorded in the journal as it goes. A test
+// failing does not stop the suite, the number of failed tests is returned.
+// SIGINT/SIGTERM stop the running tests cleanly and the suite returns
+// ErrInterrupted. suite.json is rewritten at the end either way.
+// Errors writing the journal or metadata stop the suite once running
+// tests finish and are returned.
+func (suite *Suite) Run(opts RunOpts) (failed int, err error) {
+	if suite.Journal == nil {
+		suite.Journal, err = LoadJournal(suite.JournalJson)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if opts.Parallel < 1 {
+		opts.Parallel = 1
+	}
+
+	if opts.Runner == nil {
+		opts.Runner = FioRunner{}
+	}
+
+	intr := NewInterrupt()
+	defer intr.Stop()
+
+	// record every test as pending up front so the journal is complete
+	queue := make(FioCommands, 0, len(suite.FioCommands))
 	for _, fcmd := range suite.FioCommands {
-		// rerun = true means all benchmarks get re-run
-		// when false, only benchmarks with missing or empty output.json get run
-		if !rerun {
-			if fcmd.FioJsonSize() > 0 {
+		suite.Journal.Entry(fcmd.Name)
+		if suite.shouldRun(fcmd, opts) {
+			queue = append(queue, fcmd)
+		} else {
+			suite.restoreState(fcmd)
+		}
+	}
+	if err := suite.Journal.Write(); err != nil {
+		return 0, err
+	}
+
+	type result struct {
+		fcmd   *FioCommand
+		failed bool
+		err    error
+	}
+
+	results := make(chan result)
+	busy := make(map[string]bool)       // device & mountpoint keys of running tests
+	prepared := make(map[string]string) // device key -> name of the Device it was last prepared as
+	running := 0
+
+	for len(queue) > 0 || running > 0 {
+		// start as many tests as the cap and the available devices allow,
+		// in suite order
+		for i := 0; i < len(queue) && running < opts.Parallel && !intr.Interrupted() && err == nil; {
+			fcmd := queue[i]
+			keys := fcmd.Device.busyKeys()
+			if anyBusy(busy, keys) {
+				i++
 				continue
 			}
+
+			for _, key := range keys {
+				busy[key] = true
+			}
+			queue = append(queue[:i], queue[i+1:]...)
+			running++
+
+			// tests on the same device never run at the same time so
+			// the suite-wide prepare is done by the time the next starts.
+			// A drive listed more than once, e.g. with different mount
+			// options, is prepared again when the configuration changes.
+			prepare := false
+			if p := fcmd.Device.Prepare; opts.Prepare && p != nil {
+				// without a device or mountpoint there's nothing to keep
+				// track of, PrepareDevice() fails the test
+				prepare = p.When == PrepareTest || len(keys) == 0 || prepared[keys[0]] != fcmd.Device.Name
+			}
+
+			go func() {
+				failed, err := suite.runTest(fcmd, opts, intr, prepare)
+				results <- result{fcmd, failed, err}
+			}()
+		}
+
+		if running == 0 {
+			// only happens when interrupted before everything was started
+			break
+		}
+
+		res := <-results
+		running--
+		for _, key := range res.fcmd.Device.busyKeys() {
+			delete(busy, key)
+		}
+		if keys := res.fcmd.Device.busyKeys(); res.fcmd.prepared && len(keys) > 0 {
+			prepared[keys[0]] = res.fcmd.Device.Name
+		}
+
+		if res.failed {
+			failed++
 		}
+		if res.err != nil && err == nil {
+			err = res.err
+		}
+	}
+
+	if intr.Interrupted() && err == nil {
+		err = ErrInterrupted
+	}
+
+	suite.MaxTs = time.Now()
+
+	// the final suite.json has the end time and the state of every test
+	// so even an interrupted suite can be summarized
+	if werr := suite.WriteSuiteJson(); werr != nil && err == nil {
+		err = werr
+	}
 
-		fmt.Printf("Running benchmark %q ...\n", fcmd.Name)
+	return failed, err
+}
+
+// runTest runs one test, retrying failures as allowed by opts.Retries, and
+// keeps command.json and the journal up to date. Returns failed = true when
+// the test is out of attempts, or ErrInterrupted.
+// When prepare is true the device's prepare policy runs first, and again
+// before each retry when the policy is per-test. A failed prepare counts as
+// a failed attempt.
+func (suite *Suite) runTest(fcmd *FioCommand, opts RunOpts, intr *Interrupt, prepare bool) (failed bool, err error) {
+	// the journal's attempts include earlier runs, retries are per run
+	for attempt := 1; ; attempt++ {
+		fcmd.Printf("Running benchmark ...\n")
+		if err := suite.Journal.Start(fcmd.Name); err != nil {
+			return false, err
+		}
+		// preparing can take longer than the benchmark, it gets its own
+		// timestamps so MinTs/MaxTs are only the benchmark
+		var ferr error
+		fcmd.PrepareTs, fcmd.PrepareElapsed = time.Time{}, 0
+		if prepare {
+			fcmd.PrepareTs = time.Now()
+			ferr = fcmd.PrepareDevice(intr)
+			fcmd.PrepareElapsed = time.Since(fcmd.PrepareTs).Seconds()
+			if fcmd.prepared && fcmd.Device.Prepare.When != PrepareTest {
+				prepare = false
+			}
+		}
 		fcmd.MinTs = time.Now()
-		fcmd.Run()
+		if ferr == nil {
+			ferr = opts.Runner.Run(fcmd, intr)
+		}
 		fcmd.MaxTs = time.Now()
 		elapsed := fcmd.MaxTs.Sub(fcmd.MinTs)
-		fmt.Printf("Finished benchmark %q in %s.\n", fcmd.Name, elapsed.String())
+
+		switch ferr {
+		case nil:
+			fcmd.State = StateSucceeded
+		case ErrInterrupted:
+			fcmd.State = StateInterrupted
+		default:
+			fcmd.State = StateFailed
+		}
+
+		if err := fcmd.WriteFcmdJson(); err != nil {
+			return false, err
+		}
+
+		ent, err := suite.Journal.Finish(fcmd.Name, fcmd.State, fcmd.ExitStatus, fcmd.MinTs, ferr)
+		if err != nil {
+			return false, err
+		}
+
+		if ferr == nil {
+			fcmd.Printf("Finished benchmark in %s.\n", elapsed.String())
+			return false, nil
+		} else if ferr == ErrInterrupted {
+			fcmd.Printf("Benchmark was interrupted after %s.\n", elapsed.String())
+			return false, ErrInterrupted
+		}
+
+		fcmd.Printf("Benchmark failed after %s (attempt %d): %s\n", elapsed.String(), ent.Attempts, ferr)
+
+		if attempt > opts.Retries || intr.Interrupted() {
+			return true, nil
+		}
 	}
+}
 
-	suite.MaxTs = time.Now()
+func anyBusy(busy map[string]bool, keys []string) bool {
+	for _, key := range keys {
+		if busy[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldRun decides whether a test needs to be run.
+// With opts.Resume, the journal decides: succeeded tests are skipped and
+// everything else, failed tests included, runs again. opts.Retries only
+// counts attempts in this run, see runTest(). Otherwise tests with an
+// output.json are skipped unless opts.Rerun is set.
+func (suite *Suite) shouldRun(fcmd *FioCommand, opts RunOpts) bool {
+	if opts.Resume {
+		return suite.Journal.Entry(fcmd.Name).State != StateSucceeded
+	}
+
+	// rerun = true means all benchmarks get re-run
+	// when false, only benchmarks with missing or empty output.json get run
+	return opts.Rerun || fcmd.FioJsonSize() == 0
+}
+
+// restoreState fills in the state of a test that isn't being run so the
+// final suite.json doesn't show it as pending. command.json has it when
+// WriteAll() left it alone, otherwise the journal does.
+func (suite *Suite) restoreState(fcmd *FioCommand) {
+	saved, err := LoadFioCommandJson(path.Join(fcmd.Path, fcmd.CmdJson))
+	if err != nil || saved.State == "" || saved.State == StatePending {
+		ent := suite.Journal.Entry(fcmd.Name)
+		if ent.State == StatePending {
+			return
+		}
+		saved.State, saved.MinTs, saved.MaxTs, saved.ExitStatus = ent.State, ent.MinTs, ent.MaxTs, ent.ExitStatus
+	}
+
+	fcmd.State = saved.State
+	fcmd.MinTs = saved.MinTs
+	fcmd.MaxTs = saved.MaxTs
+	fcmd.ExitStatus = saved.ExitStatus
 }
 
 // Populate the suite with the (cartesian) product of Devices x FioConfTmpls
-// to get all combinations (in memory).
+// x sweep parameters to get all combinations (in memory).
 func (suite *Suite) Populate(dl Devices, ftl FioConfTmpls) {
 	for _, tp := range ftl {
 		for _, dev := range dl {
@@ -85,56 +316,143 @@ func (suite *Suite) Populate(dl Devices, ftl FioConfTmpls) {
 				continue
 			}
 
-			// These conventions could be defined higher up in the call stack
-			// but this makes things a little easier to modify down the road.
-			fcmdName := fmt.Sprintf("%s-%s", dev.Name, tp.Name)
-			fcmdPath := path.Join(suite.Path, fcmdName)
-			args := []string{"--output-format=json", "--output=output.json", "config.fio"}
-
-			// fio adds _$type.log to log file names so only provide the base name
-			fcmd := FioCommand{
-				Name:        fcmdName,
-				FioName:     tp.Name,
-				SuiteName:   suite.Name,
-				Path:        fcmdPath,
-				FioArgs:     args,
-				FioFile:     "config.fio",
-				FioJson:     "output.json",
-				FioBWLog:    "bw",
-				FioLatLog:   "lat",
-				FioIopsLog:  "iops",
-				CmdJson:     "command.json",
-				CmdScript:   "run.sh",
-				FioConfTmpl: tp,
-				Device:      dev,
+			for _, params := range tp.Sweep.Expand() {
+				suite.populateOne(dev, tp, params)
 			}
-
-			suite.FioCommands = append(suite.FioCommands, &fcmd)
 		}
 	}
 }
 
+// populateOne adds the test for one device, template and set of sweep
+// parameters to the suite.
+func (suite *Suite) populateOne(dev Device, tp FioConfTmpl, params Params) {
+	// These conventions could be defined higher up in the call stack
+	// but this makes things a little easier to modify down the road.
+	fcmdName := fmt.Sprintf("%s-%s", dev.Name, tp.Name)
+	if suffix := params.Suffix(); suffix != "" {
+		fcmdName = fmt.Sprintf("%s-%s", fcmdName, suffix)
+	}
+	fcmdPath := path.Join(suite.Path, fcmdName)
+	args := []string{"--output-format=json", "--output=output.json", "config.fio"}
+
+	// fio adds _$type.log to log file names so only provide the base name
+	fcmd := FioCommand{
+		Name:        fcmdName,
+		FioName:     tp.Name,
+		SuiteName:   suite.Name,
+		Path:        fcmdPath,
+		FioArgs:     args,
+		FioFile:     "config.fio",
+		FioJson:     "output.json",
+		FioBWLog:    "bw",
+		FioLatLog:   "lat",
+		FioIopsLog:  "iops",
+		CmdJson:     "command.json",
+		CmdScript:   "run.sh",
+		FioConfTmpl: tp,
+		Params:      params,
+		Device:      dev,
+		ExitStatus:  -1,
+		State:       StatePending,
+	}
+
+	// bad options are reported by Validate() and Mount()
+	fcmd.MountOptions, _ = ParseMountOptions(dev.MountOptions)
+
+	suite.FioCommands = append(suite.FioCommands, &fcmd)
+}
+
 // WriteAll() writes a suite out to a set of directories and files.
-func (suite *Suite) WriteAll() {
-	suite.mkdirAll()
+// When the suite has a journal loaded, tests that already succeeded are left
+// alone so resuming a suite doesn't clobber their command.json.
+func (suite *Suite) WriteAll() error {
+	if err := suite.mkdirAll(); err != nil {
+		return err
+	}
+
+	// fio not being installed is caught later, the snapshot doesn't care
+	fioPath, _ := exec.LookPath("fio")
+	suite.Host = TakeHostSnapshot(DefaultProcfs, DefaultSysfs, fioPath)
+	if err := suite.WriteHostJson(); err != nil {
+		return err
+	}
 
-	suite.WriteSuiteJson()
+	if err := suite.WriteSuiteJson(); err != nil {
+		return err
+	}
 
 	for _, fcmd := range suite.FioCommands {
-		fcmd.WriteFioConf()
-		fcmd.WriteFcmdJson()
-		fcmd.WriteCmdScript()
+		if suite.Journal != nil && suite.Journal.Entry(fcmd.Name).State == StateSucceeded {
+			continue
+		}
+
+		if err := fcmd.WriteFioConf(); err != nil {
+			return err
+		}
+		if err := fcmd.WriteFcmdJson(); err != nil {
+			return err
+		}
+		if err := fcmd.WriteCmdScript(); err != nil {
+			return err
+		}
 	}
+
+	return nil
+}
+
+// DryRun() renders every fio config and run script in memory and prints
+// the directory layout the suite would be written to. When verbose is true,
+// the rendered config.fio and run.sh for each test are printed as well.
+// Template errors do not stop the dry run, all of them are returned at the end
+// so a large suite can be fixed in one go.
+func (suite *Suite) DryRun(w io.Writer, verbose bool) (errs []error) {
+	fmt.Fprintf(w, "%s/\n", suite.Path)
+	fmt.Fprintf(w, "    %s\n", path.Base(suite.SuiteJson))
+	fmt.Fprintf(w, "    %s\n", path.Base(suite.HostJson))
+
+	// render once, the configs are printed below
+	confs := make([][]byte, len(suite.FioCommands))
+	rendered := make([]bool, len(suite.FioCommands))
+	for i, fcmd := range suite.FioCommands {
+		conf, err := fcmd.RenderFioConf()
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			confs[i], rendered[i] = conf, true
+		}
+
+		fmt.Fprintf(w, "    %s/\n", path.Base(fcmd.Path))
+		for _, fname := range []string{fcmd.FioFile, fcmd.CmdJson, fcmd.CmdScript} {
+			fmt.Fprintf(w, "        %s\n", fname)
+		}
+	}
+
+	if verbose {
+		for i, fcmd := range suite.FioCommands {
+			if !rendered[i] {
+				continue
+			}
+
+			fmt.Fprintf(w, "\n==> %s <==\n", path.Join(fcmd.Path, fcmd.FioFile))
+			w.Write(confs[i])
+			fmt.Fprintf(w, "\n==> %s <==\n", path.Join(fcmd.Path, fcmd.CmdScript))
+			w.Write(fcmd.RenderCmdScript())
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d tests, %d template errors\n", len(suite.FioCommands), len(errs))
+
+	return errs
 }
 
 // WriteSuiteJson() dumps the suite data structure to a JSON file. This
 // file is used by some effio subcommands, such as run_suite and various
 // reports.
 // <suite path>/<suite id>/suite.json
-func (suite *Suite) WriteSuiteJson() {
+func (suite *Suite) WriteSuiteJson() error {
 	js, err := json.MarshalIndent(suite, "", "  ")
 	if err != nil {
-		log.Fatalf("Failed to encode suite data as JSON: %s\n", err)
+		return fmt.Errorf("failed to encode suite data as JSON: %s", err)
 	}
 
 	// MarshalIndent does not follow the final brace with a newline
@@ -142,19 +460,55 @@ func (suite *Suite) WriteSuiteJson() {
 
 	err = ioutil.WriteFile(suite.SuiteJson, js, 0644)
 	if err != nil {
-		log.Fatalf("Failed to write suite JSON data file '%s': %s\n", suite.SuiteJson, err)
+		return fmt.Errorf("failed to write suite JSON data file: %w", err)
+	}
+
+	return nil
+}
+
+// WriteHostJson() writes the host snapshot to host.json next to suite.json
+// so it's easy to find without digging through the whole suite.
+func (suite *Suite) WriteHostJson() error {
+	js, err := json.MarshalIndent(suite.Host, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode host snapshot as JSON: %s", err)
+	}
+	js = append(js, byte('\n'))
+
+	err = ioutil.WriteFile(suite.HostJson, js, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write host snapshot: %w", err)
 	}
+
+	return nil
+}
+
+// LoadSuiteJson() loads a suite.json written by WriteSuiteJson().
+func LoadSuiteJson(fname string) (suite Suite, err error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return suite, fmt.Errorf("could not read suite JSON: %w", err)
+	}
+
+	err = json.Unmarshal(data, &suite)
+	if err != nil {
+		return suite, jsonParseError(fname, data, err)
+	}
+
+	return suite, nil
 }
 
 // mkdirAll() creates the directory structure of a test suite
 // under directory 'path'. This must be called before the Write*()
 // methods or they will fail. It only makes sense to call this after
 // Populate().
-func (suite *Suite) mkdirAll() {
+func (suite *Suite) mkdirAll() error {
 	for _, fcmd := range suite.FioCommands {
 		err := os.MkdirAll(fcmd.Path, 0755)
 		if err != nil {
-			log.Fatalf("Failed to create directory '%s': %s\n", fcmd.Path, err)
+			return fmt.Errorf("failed to create test directory: %w", err)
 		}
 	}
+
+	return nil
 }
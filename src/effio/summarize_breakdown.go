@@ -0,0 +1,152 @@
+package effio
+
+// Summaries of a log split up by direction and block size. Mixed workloads
+// (rw=randrw, bssplit=...) put everything in one log, so without these
+// there's no way to tell the 4k read P99 from the 64k write P99.
+
+import (
+	"fmt"
+	"sort"
+)
+
+// LogBreakdown is the summary of the records with one direction, one block
+// size or one of each. An empty Ddir or a Bsz of 0 means any.
+type LogBreakdown struct {
+	Ddir    string   `json:"ddir,omitempty"` // read, write or trim
+	Bsz     uint32   `json:"bsz,omitempty"`  // block size in bytes
+	Summary LogSmry  `json:"summary"`
+	Pcntl   LogPcntl `json:"percentiles"`
+}
+
+// breakdownKey is one group of records, ddir -1 and bsz 0 are any
+type breakdownKey struct {
+	ddir int
+	bsz  uint32
+}
+
+// the groups come in this order: by direction, by block size, by both
+const (
+	byDdir = iota
+	byBsz
+	byDdirBsz
+)
+
+// keyFor returns the group lr goes in for each kind of breakdown.
+// ok is false when a kind doesn't apply: logs without block sizes only get
+// broken down by direction.
+func keyFor(lr LogRec, kind int) (key breakdownKey, ok bool) {
+	switch kind {
+	case byDdir:
+		return breakdownKey{int(lr.Ddir), 0}, true
+	case byBsz:
+		return breakdownKey{-1, lr.Bsz}, lr.Bsz > 0
+	default:
+		return breakdownKey{int(lr.Ddir), lr.Bsz}, lr.Bsz > 0
+	}
+}
+
+// sortBreakdownKeys puts keys of the same kind in direction then block
+// size order
+func sortBreakdownKeys(keys []breakdownKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ddir != keys[j].ddir {
+			return keys[i].ddir < keys[j].ddir
+		}
+		return keys[i].bsz < keys[j].bsz
+	})
+}
+
+func ddirName(ddir int) string {
+	switch ddir {
+	case -1:
+		return ""
+	case 0:
+		return "read"
+	case 1:
+		return "write"
+	case 2:
+		return "trim"
+	}
+	return fmt.Sprintf("ddir%d", ddir)
+}
+
+func newLogBreakdown(key breakdownKey, smry LogSmry) LogBreakdown {
+	pcntl := smry.Pcntl
+	smry.Pcntl = nil
+	return LogBreakdown{Ddir: ddirName(key.ddir), Bsz: key.bsz, Summary: smry, Pcntl: pcntl}
+}
+
+// Breakdown summarizes lrs for every direction, every block size and every
+// direction and block size pair that has records. One kind of breakdown is
+// done at a time so there's never more than one copy of lrs around.
+func (lrs LogRecs) Breakdown(method string) (out []LogBreakdown) {
+	for kind := byDdir; kind <= byDdirBsz; kind++ {
+		groups := make(map[breakdownKey]LogRecs)
+		for _, lr := range lrs {
+			if key, ok := keyFor(lr, kind); ok {
+				groups[key] = append(groups[key], lr)
+			}
+		}
+
+		keys := make([]breakdownKey, 0, len(groups))
+		for key := range groups {
+			keys = append(keys, key)
+		}
+		sortBreakdownKeys(keys)
+
+		for _, key := range keys {
+			out = append(out, newLogBreakdown(key, groups[key].bucketSummary(method)))
+		}
+	}
+
+	return out
+}
+
+// FindBreakdown returns the breakdown for ddir ("" for any) and bsz (0 for any)
+func (ld *LogSummaries) FindBreakdown(ddir string, bsz uint32) (LogBreakdown, bool) {
+	for _, bd := range ld.Breakdown {
+		if bd.Ddir == ddir && bd.Bsz == bsz {
+			return bd, true
+		}
+	}
+	return LogBreakdown{}, false
+}
+
+// breakdownSketches is Breakdown() for SummarizeStream()
+type breakdownSketches map[breakdownKey]*logSketch
+
+func (bs breakdownSketches) add(lr LogRec) {
+	for kind := byDdir; kind <= byDdirBsz; kind++ {
+		key, ok := keyFor(lr, kind)
+		if !ok {
+			continue
+		}
+		if bs[key] == nil {
+			bs[key] = &logSketch{}
+		}
+		bs[key].add(lr)
+	}
+}
+
+func (bs breakdownSketches) breakdown(method string) (out []LogBreakdown) {
+	var kinds [3][]breakdownKey
+	for key := range bs {
+		switch {
+		case key.bsz == 0:
+			kinds[byDdir] = append(kinds[byDdir], key)
+		case key.ddir == -1:
+			kinds[byBsz] = append(kinds[byBsz], key)
+		default:
+			kinds[byDdirBsz] = append(kinds[byDdirBsz], key)
+		}
+	}
+
+	for _, keys := range kinds {
+		sortBreakdownKeys(keys)
+		for _, key := range keys {
+			out = append(out, newLogBreakdown(key, bs[key].summary(method)))
+		}
+	}
+
+	return out
+}
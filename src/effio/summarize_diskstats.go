@@ -0,0 +1,255 @@
+package effio
+
+// Post-processing for the diskstats.csv written by CollectDiskstats().
+// The raw counters are cumulative so each pair of samples is turned into
+// a Delta() and from there into the same numbers iostat -x prints, which
+// makes it possible to compare fio's latency with what the kernel saw.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DiskstatsMetrics are the iostat -x style numbers for one interval or
+// for a whole test. MB are 2^20 bytes and sectors are always 512 bytes in
+// /proc/diskstats, same as iostat.
+type DiskstatsMetrics struct {
+	Time          time.Time `json:"time"`    // end of the interval
+	Elapsed       float64   `json:"elapsed"` // seconds from the first sample to the end of the interval
+	Seconds       float64   `json:"seconds"` // length of the interval
+	ReadsPerSec   float64   `json:"reads_per_sec"`
+	WritesPerSec  float64   `json:"writes_per_sec"`
+	ReadMBPerSec  float64   `json:"read_mb_per_sec"`
+	WriteMBPerSec float64   `json:"write_mb_per_sec"`
+	ReadMerges    float64   `json:"read_merges_per_sec"`
+	WriteMerges   float64   `json:"write_merges_per_sec"`
+	ReadAwait     float64   `json:"read_await"`  // ms per completed read, queue time included
+	WriteAwait    float64   `json:"write_await"` // ms per completed write
+	Await         float64   `json:"await"`       // ms per completed read or write
+	AvgRqSize     float64   `json:"avg_rq_size"` // sectors per request
+	AvgQuSize     float64   `json:"avg_qu_size"` // average number of requests in flight
+	Util          float64   `json:"util"`        // % of the interval the device was busy
+	InFlight      uint      `json:"in_flight"`   // requests in flight at the end of the interval
+}
+
+// DiskstatsSummary is everything one device did during a test, a test with
+// diskstats_related set has one for each related device
+type DiskstatsSummary struct {
+	Name      string             `json:"name"` // kernel name, e.g. sda1
+	Major     uint               `json:"major"`
+	Minor     uint               `json:"minor"`
+	Samples   int                `json:"samples"`   // rows in diskstats.csv
+	Total     DiskstatsMetrics   `json:"total"`     // first sample to last
+	Peak      DiskstatsMetrics   `json:"peak"`      // highest value of each metric across the intervals
+	Intervals []DiskstatsMetrics `json:"intervals"` // one per pair of samples
+}
+
+// LoadDiskstatsCSV reads a diskstats.csv written by CollectDiskstats()
+func LoadDiskstatsCSV(fname string) (out Diskstats, err error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	for lno, row := range bytes.Split(bytes.TrimRight(data, "\n"), []byte{'\n'}) {
+		fields := strings.Split(string(row), ",")
+		if len(fields) != 15 {
+			return nil, &ParseError{fname, lno + 1, fmt.Errorf("expected 15 fields, got %d", len(fields))}
+		}
+
+		// hang on to the first error, the rest of the row is junk anyways
+		num := func(idx int) uint64 {
+			val, perr := strconv.ParseUint(fields[idx], 10, 64)
+			if perr != nil && err == nil {
+				err = &ParseError{fname, lno + 1, fmt.Errorf("field %d, value '%s': %s", idx, fields[idx], perr)}
+			}
+			return val
+		}
+
+		//   t 0 1 2 3 4 5 6 7 8 9 10 11 12 13, fields are shifted by one
+		st := Diskstat{
+			uint(num(1)),
+			uint(num(2)),
+			fields[3],
+			num(4),
+			num(5),
+			num(6),
+			uint(num(7)),
+			num(8),
+			num(9),
+			num(10),
+			uint(num(11)),
+			uint(num(12)),
+			uint(num(13)),
+			uint(num(14)),
+			time.Unix(0, int64(num(0))),
+			0,
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, st)
+	}
+
+	return out, nil
+}
+
+// ByDevice splits samples by device, keeping the order they were seen in
+func (ds Diskstats) ByDevice() (out []Diskstats) {
+	idx := make(map[[2]uint]int)
+
+	for _, st := range ds {
+		key := [2]uint{st.Major, st.Minor}
+		if i, ok := idx[key]; ok {
+			out[i] = append(out[i], st)
+		} else {
+			idx[key] = len(out)
+			out = append(out, Diskstats{st})
+		}
+	}
+
+	return out
+}
+
+// Deltas returns the change between each pair of samples of one device.
+// Intervals where a counter went backwards (a wrap, or the device went
+// away and came back) are dropped.
+func (ds Diskstats) Deltas() (out Diskstats, err error) {
+	for i := 1; i < len(ds); i++ {
+		if ds[i].before(ds[i-1]) {
+			continue
+		}
+
+		delta, err := ds[i-1].Delta(ds[i])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, delta)
+	}
+
+	return out, nil
+}
+
+// before is true when any counter in st is lower than in prev
+func (st Diskstat) before(prev Diskstat) bool {
+	return st.ReadComplete < prev.ReadComplete || st.ReadMerged < prev.ReadMerged ||
+		st.ReadSectors < prev.ReadSectors || st.ReadMs < prev.ReadMs ||
+		st.WriteComplete < prev.WriteComplete || st.WriteMerged < prev.WriteMerged ||
+		st.WriteSectors < prev.WriteSectors || st.WriteMs < prev.WriteMs ||
+		st.IOMs < prev.IOMs || st.IOQueueMs < prev.IOQueueMs ||
+		!st.Time.After(prev.Time)
+}
+
+// Metrics converts a Delta() into per-second rates and averages
+func (delta Diskstat) Metrics() (m DiskstatsMetrics) {
+	m.Time = delta.Time
+	m.Seconds = delta.Duration.Seconds()
+	m.InFlight = delta.IOPending
+	if m.Seconds <= 0 {
+		return m
+	}
+
+	ms := m.Seconds * 1000
+	reads := float64(delta.ReadComplete)
+	writes := float64(delta.WriteComplete)
+
+	m.ReadsPerSec = reads / m.Seconds
+	m.WritesPerSec = writes / m.Seconds
+	m.ReadMBPerSec = float64(delta.ReadSectors) / 2048 / m.Seconds
+	m.WriteMBPerSec = float64(delta.WriteSectors) / 2048 / m.Seconds
+	m.ReadMerges = float64(delta.ReadMerged) / m.Seconds
+	m.WriteMerges = float64(delta.WriteMerged) / m.Seconds
+	if reads > 0 {
+		m.ReadAwait = float64(delta.ReadMs) / reads
+	}
+	if writes > 0 {
+		m.WriteAwait = float64(delta.WriteMs) / writes
+	}
+	if reads+writes > 0 {
+		m.Await = float64(delta.ReadMs+delta.WriteMs) / (reads + writes)
+		m.AvgRqSize = float64(delta.ReadSectors+delta.WriteSectors) / (reads + writes)
+	}
+	m.AvgQuSize = float64(delta.IOQueueMs) / ms
+	// io_ticks is in jiffies, rounding can push it a hair over 100%
+	m.Util = 100 * float64(delta.IOMs) / ms
+	if m.Util > 100 {
+		m.Util = 100
+	}
+
+	return m
+}
+
+// SummarizeDiskstats computes the intervals, totals and peaks for each
+// device in the samples
+func SummarizeDiskstats(ds Diskstats) (out []DiskstatsSummary, err error) {
+	for _, dev := range ds.ByDevice() {
+		first, last := dev[0], dev[len(dev)-1]
+		smry := DiskstatsSummary{
+			Name:      last.Name,
+			Major:     last.Major,
+			Minor:     last.Minor,
+			Samples:   len(dev),
+			Intervals: []DiskstatsMetrics{},
+		}
+
+		deltas, err := dev.Deltas()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, delta := range deltas {
+			m := delta.Metrics()
+			m.Elapsed = m.Time.Sub(first.Time).Seconds()
+			smry.Intervals = append(smry.Intervals, m)
+			smry.Peak.max(m)
+		}
+
+		if len(dev) > 1 && !last.before(first) {
+			total, err := first.Delta(last)
+			if err != nil {
+				return nil, err
+			}
+			smry.Total = total.Metrics()
+			smry.Total.Elapsed = smry.Total.Seconds
+		}
+
+		out = append(out, smry)
+	}
+
+	return out, nil
+}
+
+// max keeps the higher of each value, Time and Elapsed are the end of
+// the last interval
+func (m *DiskstatsMetrics) max(o DiskstatsMetrics) {
+	fmax := func(a *float64, b float64) {
+		if b > *a {
+			*a = b
+		}
+	}
+
+	m.Time = o.Time
+	m.Elapsed = o.Elapsed
+	fmax(&m.Seconds, o.Seconds)
+	fmax(&m.ReadsPerSec, o.ReadsPerSec)
+	fmax(&m.WritesPerSec, o.WritesPerSec)
+	fmax(&m.ReadMBPerSec, o.ReadMBPerSec)
+	fmax(&m.WriteMBPerSec, o.WriteMBPerSec)
+	fmax(&m.ReadMerges, o.ReadMerges)
+	fmax(&m.WriteMerges, o.WriteMerges)
+	fmax(&m.ReadAwait, o.ReadAwait)
+	fmax(&m.WriteAwait, o.WriteAwait)
+	fmax(&m.Await, o.Await)
+	fmax(&m.AvgRqSize, o.AvgRqSize)
+	fmax(&m.AvgQuSize, o.AvgQuSize)
+	fmax(&m.Util, o.Util)
+	if o.InFlight > m.InFlight {
+		m.InFlight = o.InFlight
+	}
+}
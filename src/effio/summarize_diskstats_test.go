@@ -0,0 +1,111 @@
+package effio
+
+import (
+	"io/ioutil"
+	"math"
+	"path"
+	"testing"
+)
+
+// two samples a second apart for nvme0n1p1, one for sda and a counter reset
+// on nvme0n1p1 at the end
+const testDiskstatsCSV = "" +
+	"1000000000,259,1,nvme0n1p1,1000,10,8000,500,2000,20,16000,1000,0,100,1500\n" +
+	"1000000000,8,0,sda,1,0,8,1,1,0,8,1,0,2,2\n" +
+	"2000000000,259,1,nvme0n1p1,1100,30,10048,700,2100,60,18048,1300,4,600,4000\n" +
+	"4000000000,259,1,nvme0n1p1,1300,70,14144,1100,2300,140,22144,1900,2,1100,6000\n" +
+	"5000000000,259,1,nvme0n1p1,10,0,80,5,10,0,80,5,0,10,10\n"
+
+func TestSummarizeDiskstats(t *testing.T) {
+	fname := path.Join(t.TempDir(), "diskstats.csv")
+	if err := ioutil.WriteFile(fname, []byte(testDiskstatsCSV), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ds, err := LoadDiskstatsCSV(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 5 || ds[1].Name != "sda" || ds[2].Time.UnixNano() != 2000000000 {
+		t.Fatalf("CSV loaded wrong: %+v", ds)
+	}
+
+	smrys, err := SummarizeDiskstats(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(smrys) != 2 || smrys[0].Name != "nvme0n1p1" || smrys[1].Name != "sda" {
+		t.Fatalf("expected nvme0n1p1 and sda, got %+v", smrys)
+	}
+
+	near := func(what string, got, expect float64) {
+		if math.Abs(got-expect) > 0.001 {
+			t.Errorf("%s: expected %g, got %g", what, expect, got)
+		}
+	}
+
+	nvme := smrys[0]
+	if nvme.Samples != 4 || len(nvme.Intervals) != 2 {
+		t.Fatalf("the reset should drop the last interval, got %d samples %d intervals", nvme.Samples, len(nvme.Intervals))
+	}
+
+	// first second: 100 reads of 2048 sectors total, 200ms reading
+	m := nvme.Intervals[0]
+	near("r/s", m.ReadsPerSec, 100)
+	near("w/s", m.WritesPerSec, 100)
+	near("rMB/s", m.ReadMBPerSec, 1)
+	near("wMB/s", m.WriteMBPerSec, 1)
+	near("rrqm/s", m.ReadMerges, 20)
+	near("wrqm/s", m.WriteMerges, 40)
+	near("r_await", m.ReadAwait, 2)
+	near("w_await", m.WriteAwait, 3)
+	near("await", m.Await, 2.5)
+	near("avgrq-sz", m.AvgRqSize, 20.48)
+	near("avgqu-sz", m.AvgQuSize, 2.5)
+	near("util", m.Util, 50)
+	near("elapsed", m.Elapsed, 1)
+	if m.InFlight != 4 {
+		t.Errorf("in flight should be the value at the end of the interval, got %d", m.InFlight)
+	}
+
+	// then two seconds at 100% busy
+	m = nvme.Intervals[1]
+	near("seconds", m.Seconds, 2)
+	near("elapsed", m.Elapsed, 3)
+	near("r/s", m.ReadsPerSec, 100)
+	near("util", m.Util, 25)
+
+	near("peak util", nvme.Peak.Util, 50)
+	near("peak w_await", nvme.Peak.WriteAwait, 3)
+	if nvme.Peak.InFlight != 4 {
+		t.Errorf("peak in flight should be 4, got %d", nvme.Peak.InFlight)
+	}
+
+	// the reset makes the last sample useless for the total
+	if nvme.Total.Seconds != 0 {
+		t.Errorf("no total expected across a counter reset, got %+v", nvme.Total)
+	}
+
+	if smrys[1].Samples != 1 || len(smrys[1].Intervals) != 0 || smrys[1].Total.Seconds != 0 {
+		t.Errorf("a single sample has no intervals, got %+v", smrys[1])
+	}
+
+	// totals without the reset
+	smrys, err = SummarizeDiskstats(ds[:4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	near("total seconds", smrys[0].Total.Seconds, 3)
+	near("total r/s", smrys[0].Total.ReadsPerSec, 100)
+	near("total util", smrys[0].Total.Util, 1000.0/30)
+}
+
+func TestLoadDiskstatsCSVBad(t *testing.T) {
+	fname := path.Join(t.TempDir(), "diskstats.csv")
+	if err := ioutil.WriteFile(fname, []byte("1,2,3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDiskstatsCSV(fname); err == nil {
+		t.Error("expected a parse error for a short row")
+	}
+}
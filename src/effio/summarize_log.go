@@ -1,34 +1,51 @@
 package effio
 
 import (
+	"bytes"
 	"fmt"
 	"math"
 	"sort"
+	"strconv"
+	"time"
 )
 
-// Log Record: The 4 fields from fio's latency logs and an index cache
+// Log Record: The 4 fields from fio's latency logs, the job index and an index cache
 // This is where most of the memory goes
+// The fields are ordered so it packs into 20 bytes.
 type LogRec struct {
 	Time uint32 `json:"time"`  // time offset from beginning of fio run
 	Val  uint32 `json:"value"` // latency value in usec
-	Ddir uint8  `json:"ddir"`  // 0 = read, 1 = write, 2 = trim
-	Bsz  uint16 `json:"bsz"`   // block size
+	Bsz  uint32 `json:"bsz"`   // block size in bytes, 64k doesn't fit in 16 bits
 	Idx  uint32 `json:"idx"`   // save the original index in LogRecs
+	Job  uint16 `json:"job"`   // fio job index from the log name, 0 for fio <= 2.1.9
+	Ddir uint8  `json:"ddir"`  // 0 = read, 1 = write, 2 = trim
+}
+
+// LogRecs are values rather than pointers: sorting moves whole records and
+// a copy of the slice can be sorted without disturbing the original
+type LogRecs []LogRec
+
+// Percentile is one entry in a LogPcntl. Val depends on the PcntlMethod and
+// usually isn't a value from the log. Time and Idx are from the record
+// nearest to the percentile, Idx being its rank (0 is the lowest value).
+type Percentile struct {
+	Time uint32  `json:"time"`
+	Val  float64 `json:"value"`
+	Idx  uint32  `json:"idx"`
 }
-type LogPcntl map[float64]*LogRec // .MarshalJSON() at EOF
-type LogRecs []*LogRec
+type LogPcntl map[float64]Percentile // .MarshalJSON() at EOF
 
 // default to sorting by time order
 func (p LogRecs) Len() int           { return len(p) }
 func (p LogRecs) Less(i, j int) bool { return p[i].Time < p[j].Time }
-func (p LogRecs) Swap(i, j int)      { p[i].Time, p[j].Time = p[j].Time, p[i].Time }
+func (p LogRecs) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
 // sorts by value for indexing percentiles
 type LogRecsByVal LogRecs
 
 func (p LogRecsByVal) Len() int           { return len(p) }
 func (p LogRecsByVal) Less(i, j int) bool { return p[i].Val < p[j].Val }
-func (p LogRecsByVal) Swap(i, j int)      { p[i].Val, p[j].Val = p[j].Val, p[i].Val }
+func (p LogRecsByVal) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
 // Log Bucket Summary: a handful of useful values for each bucket in
 // the LogBin.
@@ -55,18 +72,43 @@ func NewLogBin(size int) LogBin {
 	return lhg
 }
 
+// Log Job Summary: the summary of one fio job's records when a log was
+// merged from per-job files
+type LogJobSummary struct {
+	Job     uint16   `json:"job"`
+	Summary LogSmry  `json:"summary"`
+	Pcntl   LogPcntl `json:"percentiles"`
+	Bin     LogBin   `json:"bin"`
+}
+
 type LogSummaries struct {
-	Name    string `json:"name"`     // base name of the logfile (e.g. lat_lat.log)
-	Path    string `json:"path"`     // full path to the file read
-	LogType string `json:"log_type"` // e.g. bw, lat, slat, clat, iops
+	Name    string   `json:"name"`     // base name of the logfile (e.g. lat_lat.log or lat_lat.*.log)
+	Path    string   `json:"path"`     // full path to the file read
+	Files   []string `json:"files"`    // all files merged to create the summary, one per job
+	LogType string   `json:"log_type"` // e.g. bw, lat, slat, clat, iops
 	// the fio command used to generate the file
 	FioCommand FioCommand `json:"fio_command"`
 	// data from the output of fio --output=json
 	FioJsonData FioJsonData `json:"fio_data"`
+	// host and device configuration at the time of the test, see snapshot.go
+	Host           *HostSnapshot   `json:"host"`
+	DeviceSnapshot *DeviceSnapshot `json:"device_snapshot"`
+	// what the kernel saw on the device(s), from diskstats.csv
+	Diskstats []DiskstatsSummary `json:"diskstats,omitempty"`
+	// CPU, memory, interrupts etc. while the test ran, see collector.go
+	System []SystemSummary `json:"system,omitempty"`
 	// the global summary
 	Summary LogSmry `json:"summary"`
 	// all 99 percentiles + 99.9, 99.99, and 99.999%
 	Pcntl LogPcntl `json:"percentiles"`
+	// summary and percentiles for each direction, block size and pair of
+	// the two in the log, see summarize_breakdown.go
+	Breakdown []LogBreakdown `json:"breakdown"`
+	// steady state detected on the bw/iops logs, with -steady
+	SteadyState *SteadyState `json:"steady_state,omitempty"`
+	// every bin covers the same fixed window of fio time, bin i is from
+	// i * bin_width seconds. Windows without records have a count of 0.
+	BinWidth float64 `json:"bin_width"`
 	// bin across all samples, then by io direction
 	Bin  LogBin `json:"bin"`       // binned version of all records
 	RBin LogBin `json:"read_bin"`  // read ops
@@ -81,20 +123,25 @@ type LogSummaries struct {
 	P99RBin LogBin `json:"p99_read_bin"`  // >P99 / read
 	P99WBin LogBin `json:"p99_write_bin"` // >P99 / write
 	P99TBin LogBin `json:"p99_trim_bin"`  // >P99 / trim
+	// optional per-job breakdown, see SummarizeJobs()
+	Jobs []LogJobSummary `json:"jobs,omitempty"`
 }
 
 // Summarizes the LogRecs data into a LogSmry.
-// First argument is the number of samples to put in the summaries.
-// Second argument is the number of buckets in the bins.
+// opts.BinWidth or opts.Bins set up the bins, see binning(), and
+// opts.PcntlMethod is how percentiles are computed. lrs must be in time
+// order and isn't modified.
 // This does all the work in 3 passes, the first getting avg/min/max.
-// Then the values are sorted to access the percentiles by index.
+// Then a copy of the records is sorted by value for the percentiles.
 // The final pass computes the standard deviation, which requires the average
 // from the first pass.
-func (lrs LogRecs) Summarize(bins int) (ld LogSummaries) {
-	if bins > len(lrs) {
-		bins = len(lrs)
-	}
+func (lrs LogRecs) Summarize(opts SummarizeOpts) LogSummaries {
+	ld := lrs.summarize(opts.binning(lrs[len(lrs)-1].Time), opts.PcntlMethod)
+	ld.Breakdown = lrs.Breakdown(opts.PcntlMethod)
+	return ld
+}
 
+func (lrs LogRecs) summarize(tb timeBins, method string) (ld LogSummaries) {
 	smry := LogSmry{
 		Max:     0,
 		Min:     math.MaxUint32,
@@ -133,244 +180,240 @@ func (lrs LogRecs) Summarize(bins int) (ld LogSummaries) {
 	// assign the completed summary to the return struct
 	ld.Summary = smry
 
-	// warning: will do some sorting on slices, keep it at the bottom of this func
-	ld.Bin, ld.RBin, ld.WBin, ld.TBin = lrs.Bins(bins)
+	ld.BinWidth = tb.seconds()
+	ld.Bin, ld.RBin, ld.WBin, ld.TBin = lrs.Bins(tb, method)
 
-	// populates the percentiles map with another pass over lrs
-	ld.Pcntl = percentiles(lrs)
+	ld.Pcntl = percentiles(lrs.sortedByVal(), method)
 
-	// Find the index of the 1st percentile, then build bins on the slice from 0 to P1
-	p1idx := ld.Pcntl[1].Idx
-	p1lrs := lrs[:p1idx]
-	ld.P1Bin, ld.P1RBin, ld.P1WBin, ld.P1TBin = p1lrs.Bins(bins)
-
-	// Find the index of the 99th percentile, then build bins on the slice from P99 to the last sample
-	p99idx := ld.Pcntl[99].Idx
-	p99lrs := lrs[p99idx:]
-	ld.P99Bin, ld.P99RBin, ld.P99WBin, ld.P99TBin = p99lrs.Bins(bins)
+	// outliers are picked by value but the bins need them in time order
+	p1, p99 := ld.Pcntl[1].Val, ld.Pcntl[99].Val
+	var p1lrs, p99lrs LogRecs
+	for _, lr := range lrs {
+		if float64(lr.Val) < p1 {
+			p1lrs = append(p1lrs, lr)
+		} else if float64(lr.Val) > p99 {
+			p99lrs = append(p99lrs, lr)
+		}
+	}
+	ld.P1Bin, ld.P1RBin, ld.P1WBin, ld.P1TBin = p1lrs.Bins(tb, method)
+	ld.P99Bin, ld.P99RBin, ld.P99WBin, ld.P99TBin = p99lrs.Bins(tb, method)
 
 	return
 }
 
-// sorts lrs to value order then re-sorts back to time before returning
-func percentiles(lrs LogRecs) LogPcntl {
-	sort.Sort(LogRecsByVal(lrs))
-	defer sort.Sort(lrs)
-
-	out := make(LogPcntl)
+// sortedByVal returns a copy of lrs sorted by value
+func (lrs LogRecs) sortedByVal() LogRecs {
+	sorted := make(LogRecs, len(lrs))
+	copy(sorted, lrs)
+	sort.Sort(LogRecsByVal(sorted))
+	return sorted
+}
 
-	pctl_idx := func(pc float64) int {
-		idx := math.Floor(float64(len(lrs)) * (pc / 100))
-		out := int(idx)
-		return out
-	}
+// ByJob splits the records by fio job index, keeping them in time order.
+func (lrs LogRecs) ByJob() map[uint16]LogRecs {
+	out := make(map[uint16]LogRecs)
 
-	var i float64
-	for i = 1; i <= 99; i += 1 {
-		idx := pctl_idx(i)
-		out[i] = lrs[idx]
-		out[i].Idx = uint32(idx) // track index for sorting as needed later
+	for _, lr := range lrs {
+		out[lr.Job] = append(out[lr.Job], lr)
 	}
 
-	out[99.9] = lrs[pctl_idx(99.9)]
-	out[99.99] = lrs[pctl_idx(99.99)]
-	out[99.999] = lrs[pctl_idx(99.999)]
-
 	return out
 }
 
-func (lrs LogRecs) Bins(bins int) (all, read, write, trim LogBin) {
-	all = NewLogBin(bins)   // all-IO bin
-	read = NewLogBin(bins)  // reads bin
-	write = NewLogBin(bins) // writes bin
-	trim = NewLogBin(bins)  // trims bin
+// SummarizeJobs summarizes each fio job's records separately, in job order.
+// The jobs' bins are on the same time axis as the bins for all of lrs.
+func (lrs LogRecs) SummarizeJobs(opts SummarizeOpts) []LogJobSummary {
+	tb := opts.binning(lrs[len(lrs)-1].Time)
+	byJob := lrs.ByJob()
 
-	// one pass to count each direction of IO
-	var all_count, read_count, write_count, trim_count int
-	for _, lr := range lrs {
-		all_count++
-		if lr.Ddir == 0 {
-			read_count++
-		} else if lr.Ddir == 1 {
-			write_count++
-		} else if lr.Ddir == 2 {
-			trim_count++
+	jobs := make([]int, 0, len(byJob))
+	for job := range byJob {
+		jobs = append(jobs, int(job))
+	}
+	sort.Ints(jobs)
+
+	out := make([]LogJobSummary, len(jobs))
+	for i, job := range jobs {
+		ld := byJob[uint16(job)].summarize(tb, opts.PcntlMethod)
+		out[i] = LogJobSummary{
+			Job:     uint16(job),
+			Summary: ld.Summary,
+			Pcntl:   ld.Pcntl,
+			Bin:     ld.Bin,
 		}
 	}
 
-	var arec, rrec, wrec, trec int // next record index
-	var acnt, rcnt, wcnt, tcnt int // bucket counter
-
-	// bucketSize() returns floored (count / buckets) with error checking
-	// when these buckets are filled, they are aggregated then reused
-	abkt := make(LogRecs, bucketSize(bins, all_count))
-	rbkt := make(LogRecs, bucketSize(bins, read_count))
-	wbkt := make(LogRecs, bucketSize(bins, write_count))
-	tbkt := make(LogRecs, bucketSize(bins, trim_count))
-
-	// TODO: document this algorithm for one pass bucket filling
-	for i, lr := range lrs {
-		// check bounds on each call: when bin_width * bins < record_count
-		// care must be taken to not call updateBucket which may try to write
-		// a bin entry beyond the end of the slice
-		if arec < len(abkt) && acnt < bins {
-			arec, acnt = abkt.updateBucket(arec, acnt, all, lrs, i)
-		}
+	return out
+}
 
-		if lr.Ddir == 0 && rrec < len(rbkt) && rcnt < bins {
-			rrec, rcnt = rbkt.updateBucket(rrec, rcnt, read, lrs, i)
-		} else if lr.Ddir == 1 && wrec < len(wbkt) && wcnt < bins {
-			wrec, wcnt = wbkt.updateBucket(wrec, wcnt, write, lrs, i)
-		} else if lr.Ddir == 2 && trec < len(tbkt) && tcnt < bins {
-			trec, tcnt = tbkt.updateBucket(trec, tcnt, trim, lrs, i)
-		}
+// timeBins is the time axis shared by all the bins in a summary: bin i
+// covers fio time [i * width, (i + 1) * width) in msec
+type timeBins struct {
+	width uint32 // msec
+	count int
+}
+
+// binning sets up the bins for a log that ends at lastTs (msec since fio
+// started). opts.BinWidth is used as is, when it's 0 the width is picked so
+// the log fits in exactly opts.Bins bins.
+func (opts SummarizeOpts) binning(lastTs uint32) (tb timeBins) {
+	if opts.BinWidth > 0 {
+		tb.width = uint32(opts.BinWidth / time.Millisecond)
+	} else if opts.Bins > 0 {
+		// ceil((lastTs + 1) / Bins), the +1 is for the bin starting at 0
+		bins := uint64(opts.Bins)
+		tb.width = uint32((uint64(lastTs) + bins) / bins)
+		tb.count = opts.Bins
 	}
 
-	return
-}
+	// fio's logs are in msec, so that's as small as it goes
+	if tb.width == 0 {
+		tb.width = 1
+	}
 
-// compute the bucket size
-// always take the floor of the value; a short bucket will have
-// a count that is skewed by the sample count. Since bucket count
-// is usually pretty small, 10-100, it's better to simply drop samples
-// that would be in a complete bucket rather than keeping them and having
-// all my graphs take a dive on the last sample
-func bucketSize(buckets int, available int) int {
-	if available < buckets {
-		return 0
+	if tb.count == 0 {
+		tb.count = int(lastTs/tb.width) + 1
 	}
+	return tb
+}
 
-	return int(math.Floor(float64(available) / float64(buckets)))
+// index returns the bin a record at fio time ts goes in
+func (tb timeBins) index(ts uint32) int {
+	return int(ts / tb.width)
 }
 
-// Adds the value to the bucket at index bktidx using the LogRec at lrs[lridx].
-// When full, summarized into smry[smry_idx]. Returns updated index values for
-// use in the next iteration.
-//
-// It is safe to use the same bucket on each iteration to save allocation.
-//
-// bktidx: current bucket index
-// hgidx: current bin index
-// bin: destination bin (list) - written to!
-// lrs: source data slice
-// lridx: current index into the source data slice
-// Returns: (new bucket index, new bin index)
-func (bucket LogRecs) updateBucket(bktidx int, hgidx int, bin LogBin, lrs LogRecs, lridx int) (int, int) {
-	// if the bucket is len 0, there weren't enough samples
-	if len(bucket) == 0 {
-		return 0, 0
-	}
+func (tb timeBins) seconds() float64 {
+	return float64(tb.width) / 1000
+}
 
-	// at max_lridx all buckets are full; remaining records must be dropped
-	max_lridx := (len(lrs) - (len(lrs) % len(bucket))) - 1
+// Bins splits lrs into fixed time windows for all IO and for each
+// direction. Every bin has tb.count entries so the directions line up,
+// windows without records are left empty. lrs isn't modified, records that
+// aren't in time order are binned from a sorted copy.
+func (lrs LogRecs) Bins(tb timeBins, method string) (all, read, write, trim LogBin) {
+	if !sort.IsSorted(lrs) {
+		sorted := make(LogRecs, len(lrs))
+		copy(sorted, lrs)
+		sort.Stable(sorted)
+		lrs = sorted
+	}
 
-	// add the current LogRec to the bucket
-	if lridx <= max_lridx {
-		bucket[bktidx] = lrs[lridx]
+	var byDir [3]LogRecs // read, write, trim
+	for _, lr := range lrs {
+		if lr.Ddir < 3 {
+			byDir[lr.Ddir] = append(byDir[lr.Ddir], lr)
+		}
 	}
 
-	// advance the bucket index, stay on the same summary index
-	if bktidx < len(bucket)-1 && lridx < max_lridx {
-		return bktidx + 1, hgidx
-		// discard leftover records after filling all buckets: see bucketSize()
-	} else if lridx > max_lridx {
-		return bktidx, hgidx
-		// bucket is full or end of data, sum it & advance to the next bin entry
-	} else if bktidx == len(bucket)-1 || lridx == max_lridx {
-		hs := LogSmry{
-			Max:   0,
-			Min:   math.MaxUint32,
-			MinTs: math.MaxUint32,
-			MaxTs: 0,
+	all = lrs.fillBin(tb, method)
+	read = byDir[0].fillBin(tb, method)
+	write = byDir[1].fillBin(tb, method)
+	trim = byDir[2].fillBin(tb, method)
+
+	return
+}
+
+// fillBin summarizes each run of records in the same window into its bin
+// entry, lrs must be in time order. Records past the last window are
+// dropped.
+func (lrs LogRecs) fillBin(tb timeBins, method string) LogBin {
+	bin := NewLogBin(tb.count)
+
+	for start := 0; start < len(lrs); {
+		idx := tb.index(lrs[start].Time)
+		end := start + 1
+		for end < len(lrs) && tb.index(lrs[end].Time) == idx {
+			end++
+		}
+
+		if idx < len(bin) {
+			hs := lrs[start:end].bucketSummary(method)
+			bin[idx] = &hs
 		}
+		start = end
+	}
 
-		// finding max/min ts by indices would usually work, but the backing LogRecs
-		// is sorted in place at times, so be safe and do it the hard way
+	return bin
+}
 
-		// count and sum up all entries, find min/max timestamp
-		for _, lr := range bucket {
-			hs.Sum += uint64(lr.Val)
-			hs.Count++
+// bucketSummary summarizes one bucket of records in time order, an empty
+// bucket gets an empty summary
+func (bucket LogRecs) bucketSummary(method string) LogSmry {
+	if len(bucket) == 0 {
+		return LogSmry{}
+	}
 
-			if lr.Val > hs.Max {
-				hs.Max = lr.Val
-			}
+	hs := LogSmry{
+		Max:   0,
+		Min:   math.MaxUint32,
+		MinTs: math.MaxUint32,
+		MaxTs: 0,
+	}
 
-			if lr.Val < hs.Min {
-				hs.Min = lr.Val
-			}
+	// count and sum up all entries, find min/max timestamp
+	for _, lr := range bucket {
+		hs.Sum += uint64(lr.Val)
+		hs.Count++
 
-			if lr.Time > hs.MaxTs {
-				hs.MaxTs = lr.Time
-			}
+		if lr.Val > hs.Max {
+			hs.Max = lr.Val
+		}
 
-			if lr.Time < hs.MinTs {
-				hs.MinTs = lr.Time
-			}
+		if lr.Val < hs.Min {
+			hs.Min = lr.Val
 		}
 
-		// get the median/p50 and average values
-		hs.Median = uint64(bucket[(len(bucket)-1)/2].Val)
-		hs.Average = float64(hs.Sum) / float64(hs.Count)
-		hs.Elapsed = hs.MaxTs - hs.MinTs
+		if lr.Time > hs.MaxTs {
+			hs.MaxTs = lr.Time
+		}
 
-		// add up the squares of each value's delta from average
-		var dsum float64
-		for _, lr := range bucket {
-			dsum += math.Pow(float64(lr.Val)-hs.Average, 2)
+		if lr.Time < hs.MinTs {
+			hs.MinTs = lr.Time
 		}
+	}
 
-		// finish computing the standard deviation
-		variance := dsum / float64(hs.Count)
-		hs.Stdev = math.Sqrt(variance)
+	hs.Average = float64(hs.Sum) / float64(hs.Count)
+	hs.Elapsed = hs.MaxTs - hs.MinTs
 
-		// sort by value then get the percentiles
-		sort.Sort(bucket)
-		hs.Pcntl = percentiles(bucket)
+	// add up the squares of each value's delta from average
+	var dsum float64
+	for _, lr := range bucket {
+		dsum += math.Pow(float64(lr.Val)-hs.Average, 2)
+	}
 
-		// save to the bin summary
-		bin[hgidx] = &hs
+	// finish computing the standard deviation
+	variance := dsum / float64(hs.Count)
+	hs.Stdev = math.Sqrt(variance)
 
-		// bucket is now summed & stored at hgidx, reset the bucket index to 0
-		return 0, hgidx + 1
-	}
+	// get the median/p50 and percentiles from a copy sorted by value
+	sorted := bucket.sortedByVal()
+	hs.Median = uint64(sorted[(len(sorted)-1)/2].Val)
+	hs.Pcntl = percentiles(sorted, method)
 
-	panic("BUG! Unreachable!")
+	return hs
 }
 
 // JSON doesn't officially support anything but strings as keys
 // so the floats have to be converted with this handler.
 func (lp LogPcntl) MarshalJSON() ([]byte, error) {
-	jsonFmt := "\"%g\": {\"time\": %d, \"value\": %d, \"idx\": %d}%s"
-	max := fmt.Sprintf(jsonFmt, math.MaxFloat64, math.MaxInt32, math.MaxInt32, math.MaxInt32, ",")
-	buf := make([]byte, len(lp)*len(max)+4)
-
 	// copy the keys to a list for sorting so they're in order in the output
-	count := 0
-	keys := make([]float64, len(lp))
-	for key, _ := range lp {
-		keys[count] = key
-		count++
+	keys := make([]float64, 0, len(lp))
+	for key := range lp {
+		keys = append(keys, key)
 	}
-
 	sort.Float64s(keys)
 
-	sep := ","
-	buf[0] = '{'
-	bufidx := 1
+	var buf bytes.Buffer
+	buf.WriteByte('{')
 	for i, key := range keys {
-		if i == len(keys)-1 {
-			sep = ""
+		if i > 0 {
+			buf.WriteByte(',')
 		}
-		out := fmt.Sprintf(jsonFmt, key, lp[key].Time, lp[key].Val, lp[key].Idx, sep)
-		outbytes := []byte(out)
-		bufidx += copy(buf[bufidx:bufidx+len(outbytes)], outbytes)
+		pc := lp[key]
+		val := strconv.FormatFloat(pc.Val, 'f', -1, 64)
+		fmt.Fprintf(&buf, "\"%g\": {\"time\": %d, \"value\": %s, \"idx\": %d}", key, pc.Time, val, pc.Idx)
 	}
-	buf[bufidx] = '}'
-
-	// buf was overallocated generously, return a precisely sized array
-	out := make([]byte, bufidx+1)
-	copy(out, buf[0:bufidx+1])
+	buf.WriteByte('}')
 
-	return out, nil
+	return buf.Bytes(), nil
 }
@@ -1,29 +1,332 @@
 package effio
 
-import "testing"
-
-type testBs struct {
-	bins    int
-	records int
-	expect  int
-}
-
-var bsTestData = []testBs{
-	{1, 1, 1},
-	{1, 0, 0},
-	{10, 100, 10},
-	{10, 101, 10},
-	{10, 150, 15},
-	{10, 175, 17},
-	{101, 175, 1},
-	{100, 1750123, 17501},
-}
-
-func TestBucketSize(t *testing.T) {
-	for _, tbs := range bsTestData {
-		sz := bucketSize(tbs.bins, tbs.records)
-		if sz != tbs.expect {
-			t.Error("bucketSize(", tbs.bins, ",", tbs.records, ") should = ", tbs.expect, " but got ", sz)
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"math"
+	"path"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBinning(t *testing.T) {
+	tests := []struct {
+		opts   SummarizeOpts
+		lastTs uint32
+		width  uint32
+		count  int
+	}{
+		{SummarizeOpts{Bins: 10}, 999, 100, 10},
+		{SummarizeOpts{Bins: 10}, 1000, 101, 10},
+		{SummarizeOpts{Bins: 10}, 5, 1, 10},
+		{SummarizeOpts{Bins: 10}, 15, 2, 10},
+		{SummarizeOpts{Bins: 10}, 80, 9, 10},
+		{SummarizeOpts{Bins: 1}, 0, 1, 1},
+		{SummarizeOpts{BinWidth: time.Second}, 60000, 1000, 61},
+		{SummarizeOpts{BinWidth: 100 * time.Millisecond, Bins: 3}, 999, 100, 10},
+		{SummarizeOpts{BinWidth: 500 * time.Microsecond}, 9, 1, 10},
+	}
+
+	for _, bt := range tests {
+		tb := bt.opts.binning(bt.lastTs)
+		if tb.width != bt.width || tb.count != bt.count {
+			t.Errorf("%+v ending at %d should be %d bins of %dms, got %d of %dms", bt.opts, bt.lastTs, bt.count, bt.width, tb.count, tb.width)
+		}
+	}
+
+	if (SummarizeOpts{Bins: 0}).check() == nil || (SummarizeOpts{BinWidth: -time.Second}).check() == nil {
+		t.Error("check() accepted options without bins")
+	}
+}
+
+// directions have the same number of bins and gaps in the log are empty bins
+func TestBinsByTime(t *testing.T) {
+	lrs := LogRecs{
+		{Time: 10, Val: 1, Ddir: 0},
+		{Time: 20, Val: 2, Ddir: 1},
+		{Time: 150, Val: 3, Ddir: 0},
+		{Time: 420, Val: 4, Ddir: 0},
+		{Time: 450, Val: 5, Ddir: 1},
+	}
+
+	ld := lrs.Summarize(SummarizeOpts{BinWidth: 100 * time.Millisecond})
+	if ld.BinWidth != 0.1 {
+		t.Errorf("bin width should be 0.1s, got %g", ld.BinWidth)
+	}
+
+	expect := map[string][]uint64{
+		"all":   {2, 1, 0, 0, 2},
+		"read":  {1, 1, 0, 0, 1},
+		"write": {1, 0, 0, 0, 1},
+		"trim":  {0, 0, 0, 0, 0},
+	}
+	bins := map[string]LogBin{"all": ld.Bin, "read": ld.RBin, "write": ld.WBin, "trim": ld.TBin}
+
+	for name, counts := range expect {
+		bin := bins[name]
+		if len(bin) != len(counts) {
+			t.Errorf("%s should have %d bins, got %d", name, len(counts), len(bin))
+			continue
+		}
+		for i, count := range counts {
+			if bin[i].Count != count {
+				t.Errorf("%s[%d] should have %d records, got %d", name, i, count, bin[i].Count)
+			}
+		}
+	}
+
+	if ld.Bin[4].MinTs != 420 || ld.Bin[4].MaxTs != 450 || ld.Bin[4].Sum != 9 {
+		t.Errorf("last bin should be the records at 420 and 450, got %+v", *ld.Bin[4])
+	}
+
+	// jobs interleaved in one file, a window can show up again later
+	mixed := LogRecs{lrs[0], lrs[2], lrs[1], lrs[3], lrs[4]}
+	all, _, _, _ := mixed.Bins(timeBins{width: 100, count: 5}, PcntlLinear)
+	if all[0].Count != 2 || all[1].Count != 1 || mixed[1].Time != 150 {
+		t.Errorf("out of order records should be binned by time without changing lrs, got %d and %d", all[0].Count, all[1].Count)
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	// 10, 20, ... 100
+	vals := make([]float64, 10)
+	for i := range vals {
+		vals[i] = float64((i + 1) * 10)
+	}
+	valueAt := func(rank uint64) float64 { return vals[rank] }
+
+	tests := []struct {
+		method string
+		pc     float64
+		val    float64
+		rank   uint64
+	}{
+		{PcntlLinear, 50, 55, 5}, // h = 4.5, rounds up
+		{PcntlLinear, 25, 32.5, 2},
+		{PcntlLinear, 1, 10.9, 0},
+		{PcntlLinear, 99.999, 99.9991, 9},
+		{"", 50, 55, 5},
+		{PcntlNearest, 50, 50, 4},
+		{PcntlNearest, 1, 10, 0},
+		{PcntlNearest, 99, 100, 9},
+		{PcntlLower, 50, 60, 5},
+		{PcntlLower, 1, 10, 0},
+		{PcntlLower, 99.999, 100, 9},
+	}
+
+	for _, qt := range tests {
+		val, rank := quantile(qt.method, uint64(len(vals)), qt.pc, valueAt)
+		if math.Abs(val-qt.val) > 1e-9 || rank != qt.rank {
+			t.Errorf("%s P%g should be %g at rank %d, got %g at %d", qt.method, qt.pc, qt.val, qt.rank, val, rank)
+		}
+	}
+
+	if checkPcntlMethod("median") == nil {
+		t.Error("checkPcntlMethod accepted an unknown method")
+	}
+}
+
+// sorting used to swap only one field of each record
+func TestLogRecsSort(t *testing.T) {
+	lrs := LogRecs{{Time: 3, Val: 10}, {Time: 1, Val: 30}, {Time: 2, Val: 20}}
+
+	sorted := lrs.sortedByVal()
+	for i, lr := range sorted {
+		if lr.Val != uint32(10*(i+1)) || lr.Time != uint32(3-i) {
+			t.Errorf("record %d is time %d value %d after sorting by value", i, lr.Time, lr.Val)
+		}
+	}
+	if lrs[0].Time != 3 || lrs[0].Val != 10 {
+		t.Error("sortedByVal modified the original records")
+	}
+
+	sort.Sort(lrs)
+	for i, lr := range lrs {
+		if lr.Time != uint32(i+1) || lr.Val != uint32(30-10*i) {
+			t.Errorf("record %d is time %d value %d after sorting by time", i, lr.Time, lr.Val)
+		}
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/summarize")
+
+// goldenSummary is the part of LogSummaries checked against the golden
+// files. Bins don't have their percentiles, they're the same code as the
+// top level ones and would make the files huge.
+type goldenSummary struct {
+	Summary  LogSmry  `json:"summary"`
+	Pcntl    LogPcntl `json:"percentiles"`
+	BinWidth float64  `json:"bin_width"`
+	Bins     []LogBin `json:"bins"` // all, read, write, trim then the same for P1 and P99
+}
+
+// the logs in testdata/summarize are 1000 records 1ms apart with values
+// picked so the percentiles are known, see expectations below
+var goldenLogs = []struct {
+	name    string
+	pcntl   map[float64]float64 // linear
+	p1, p99 uint64              // records in the outlier bins
+}{
+	{"constant", map[float64]float64{1: 500, 50: 500, 99.999: 500}, 0, 0},
+	// 1 to 1000, reads and writes alternate
+	{"uniform", map[float64]float64{1: 10.99, 25: 250.75, 50: 500.5, 99: 990.01}, 10, 10},
+	// i at time i, so the outliers are the first and last 10ms
+	{"ramp", map[float64]float64{1: 10.99, 50: 500.5, 99: 990.01}, 10, 10},
+	// 900 reads at 100 and 100 writes at 10000
+	{"bimodal", map[float64]float64{1: 100, 50: 100, 90: 1090, 95: 10000}, 0, 0},
+	// exponential with a mean of 100, P50 is 100 * ln(2) less the rounding down to whole usec
+	{"exponential", map[float64]float64{50: 68.5, 90: 229.6, 99: 455.1}, 10, 10},
+}
+
+func TestSummarizeGolden(t *testing.T) {
+	for _, gl := range goldenLogs {
+		lrs, err := LoadFioLog(path.Join("testdata/summarize", gl.name+".log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ld := lrs.Summarize(SummarizeOpts{BinWidth: 200 * time.Millisecond})
+
+		for pc, expect := range gl.pcntl {
+			if got := ld.Pcntl[pc].Val; math.Abs(got-expect) > 0.5 {
+				t.Errorf("%s: P%g should be %g, got %g", gl.name, pc, expect, got)
+			}
+		}
+
+		var p1, p99 uint64
+		for i := range ld.P1Bin {
+			p1 += ld.P1Bin[i].Count
+			p99 += ld.P99Bin[i].Count
+		}
+		if p1 != gl.p1 || p99 != gl.p99 {
+			t.Errorf("%s: expected %d/%d records in the P1/P99 bins, got %d/%d", gl.name, gl.p1, gl.p99, p1, p99)
+		}
+
+		gs := goldenSummary{Summary: ld.Summary, Pcntl: ld.Pcntl, BinWidth: ld.BinWidth}
+		for _, bin := range []LogBin{ld.Bin, ld.RBin, ld.WBin, ld.TBin, ld.P1Bin, ld.P1RBin, ld.P1WBin, ld.P1TBin,
+			ld.P99Bin, ld.P99RBin, ld.P99WBin, ld.P99TBin} {
+			out := make(LogBin, len(bin))
+			for i, smry := range bin {
+				cp := *smry
+				cp.Pcntl = nil
+				out[i] = &cp
+			}
+			gs.Bins = append(gs.Bins, out)
+		}
+
+		js, err := json.MarshalIndent(gs, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		js = append(js, '\n')
+
+		fname := path.Join("testdata/summarize", gl.name+".json")
+		if *updateGolden {
+			if err := ioutil.WriteFile(fname, js, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		expect, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(js, expect) {
+			t.Errorf("%s: summary doesn't match %s, run go test -update if the change is intended\n%s", gl.name, fname, js)
+		}
+	}
+}
+
+// the outlier bins have to keep records whole and in time order
+func TestSummarizeOutliers(t *testing.T) {
+	lrs, err := LoadFioLog("testdata/summarize/ramp.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ld := lrs.Summarize(SummarizeOpts{BinWidth: 200 * time.Millisecond})
+
+	// ramp.log has value == time, 1 to 1000, so the outliers are 1-10 and
+	// 991-1000, the last of which is in a bin of its own
+	p1 := ld.P1Bin[0]
+	if p1.Count != 10 || p1.MinTs != 1 || p1.MaxTs != 10 || p1.Min != 1 || p1.Max != 10 {
+		t.Errorf("P1 bin should be records 1 to 10, got %+v", *p1)
+	}
+	p99 := ld.P99Bin[4]
+	if p99.Count != 9 || p99.MinTs != 991 || p99.MaxTs != 999 || p99.Min != 991 || p99.Max != 999 {
+		t.Errorf("P99 bin 4 should be records 991 to 999, got %+v", *p99)
+	}
+	if last := ld.P99Bin[5]; last.Count != 1 || last.Min != 1000 {
+		t.Errorf("P99 bin 5 should be record 1000, got %+v", *last)
+	}
+	for i := 0; i < 4; i++ {
+		if ld.P1Bin[i+1].Count != 0 || ld.P99Bin[i].Count != 0 {
+			t.Errorf("P1 bin %d and P99 bin %d should be empty", i+1, i)
+		}
+	}
+
+	if pc := ld.Pcntl[50]; pc.Idx != 500 || pc.Time != 501 {
+		t.Errorf("P50 should be the record at rank 500, time 501, got %+v", pc)
+	}
+}
+
+func TestBreakdown(t *testing.T) {
+	// bimodal.log is 900 reads at 100 and 100 writes at 10000, all 4k
+	lrs, err := LoadFioLog("testdata/summarize/bimodal.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a 64k trim for good measure, fio logs block sizes in bytes
+	dir := t.TempDir()
+	fname := path.Join(dir, "lat_lat.1.log")
+	if err := ioutil.WriteFile(fname, []byte("1001, 5000, 2, 65536\n1002, 7000, 2, 65536\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	trims, err := LoadFioLog(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lrs = append(lrs, trims...)
+
+	ld := lrs.Summarize(SummarizeOpts{Bins: 10})
+
+	tests := []struct {
+		ddir  string
+		bsz   uint32
+		count uint64
+		p50   float64
+		p99   float64
+	}{
+		{"read", 0, 900, 100, 100},
+		{"write", 0, 100, 10000, 10000},
+		{"trim", 0, 2, 6000, 6980},
+		{"", 4096, 1000, 100, 10000},
+		{"", 65536, 2, 6000, 6980},
+		{"read", 4096, 900, 100, 100},
+		{"write", 4096, 100, 10000, 10000},
+		{"trim", 65536, 2, 6000, 6980},
+	}
+
+	if len(ld.Breakdown) != len(tests) {
+		t.Errorf("expected %d breakdowns, got %d", len(tests), len(ld.Breakdown))
+	}
+	for i, bt := range tests {
+		bd, ok := ld.FindBreakdown(bt.ddir, bt.bsz)
+		if !ok {
+			t.Errorf("no breakdown for ddir '%s' bsz %d", bt.ddir, bt.bsz)
+			continue
+		}
+		if i < len(ld.Breakdown) && (ld.Breakdown[i].Ddir != bt.ddir || ld.Breakdown[i].Bsz != bt.bsz) {
+			t.Errorf("breakdown %d should be '%s' %d, got '%s' %d", i, bt.ddir, bt.bsz, ld.Breakdown[i].Ddir, ld.Breakdown[i].Bsz)
+		}
+		if bd.Summary.Count != bt.count || bd.Pcntl[50].Val != bt.p50 || math.Abs(bd.Pcntl[99].Val-bt.p99) > 1e-9 {
+			t.Errorf("'%s' %d should be %d records with P50 %g and P99 %g, got %d %g %g", bt.ddir, bt.bsz,
+				bt.count, bt.p50, bt.p99, bd.Summary.Count, bd.Pcntl[50].Val, bd.Pcntl[99].Val)
 		}
 	}
 }
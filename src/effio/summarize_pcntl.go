@@ -0,0 +1,81 @@
+package effio
+
+// Percentiles for the summaries. A percentile usually falls between two
+// records, e.g. P50 of 1000 records is somewhere between the 500th and
+// 501st, and there are a bunch of ways to pick a value for it. effio used to
+// take the record at floor(n * p), which is kept around as "lower" so
+// summaries can be compared with old ones, but the default is to
+// interpolate between the two records the same way numpy, R (type 7) and
+// spreadsheets do.
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	PcntlLinear  = "linear"  // interpolate between the records either side, the default
+	PcntlNearest = "nearest" // nearest rank, always a value from the log
+	PcntlLower   = "lower"   // the record at floor(n * p), what effio did before
+)
+
+// pcntlKeys are the percentiles in every LogPcntl:
+// all 99 percentiles + 99.9, 99.99, and 99.999%
+var pcntlKeys = func() []float64 {
+	keys := make([]float64, 0, 102)
+	for i := 1.0; i <= 99; i++ {
+		keys = append(keys, i)
+	}
+	return append(keys, 99.9, 99.99, 99.999)
+}()
+
+// checkPcntlMethod returns an error for unknown methods, "" is linear
+func checkPcntlMethod(method string) error {
+	switch method {
+	case "", PcntlLinear, PcntlNearest, PcntlLower:
+		return nil
+	}
+	return fmt.Errorf("unknown percentile method '%s', must be linear, nearest or lower", method)
+}
+
+// quantile returns the value of percentile pc of n values using method.
+// valueAt returns the value with the given rank, 0 being the lowest, so
+// this works for sorted records and for histograms. rank is the rank of
+// the value nearest to the percentile.
+func quantile(method string, n uint64, pc float64, valueAt func(rank uint64) float64) (val float64, rank uint64) {
+	p := pc / 100
+	last := float64(n - 1)
+
+	switch method {
+	case PcntlLower:
+		rank = uint64(math.Min(math.Floor(float64(n)*p), last))
+		return valueAt(rank), rank
+	case PcntlNearest:
+		rank = uint64(math.Max(math.Ceil(float64(n)*p)-1, 0))
+		return valueAt(rank), rank
+	}
+
+	h := last * p
+	lo := uint64(math.Floor(h))
+	val = valueAt(lo)
+	if frac := h - float64(lo); frac > 0 && lo+1 < n {
+		val += frac * (valueAt(lo+1) - val)
+	}
+
+	return val, uint64(math.Floor(h + 0.5))
+}
+
+// percentiles computes every percentile in pcntlKeys from records that are
+// already sorted by value, see LogRecs.sortedByVal(). sorted isn't modified
+// and the LogPcntl doesn't point into it.
+func percentiles(sorted LogRecs, method string) LogPcntl {
+	out := make(LogPcntl, len(pcntlKeys))
+	valueAt := func(rank uint64) float64 { return float64(sorted[rank].Val) }
+
+	for _, pc := range pcntlKeys {
+		val, rank := quantile(method, uint64(len(sorted)), pc, valueAt)
+		out[pc] = Percentile{Time: sorted[rank].Time, Val: val, Idx: uint32(rank)}
+	}
+
+	return out
+}
@@ -0,0 +1,241 @@
+package effio
+
+// Steady state detection, roughly the way the SNIA Solid State Storage
+// Performance Test Specification (PTS) does it. SSDs can take minutes to
+// settle after the device is prepared, much longer than fio's ramp_time,
+// so the first part of a run usually isn't what the device does over time.
+//
+// The bw or iops log is cut into rounds of fixed length and each round is
+// averaged. Steady state is the first window of rounds where:
+//   - the range of the rounds is within 20% of the window's average
+//   - the best-fit line through the rounds doesn't move more than 10% of
+//     the average across the window
+// Everything before the window is warm-up. Latency logs don't say much
+// about steady state on their own so they use the iops (or bw) log from the
+// same test.
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+const (
+	DefaultSteadyRound  = 10 * time.Second
+	DefaultSteadyWindow = 5 // rounds, same as the PTS
+
+	steadyMaxRange     = 0.20 // of the window average
+	steadyMaxExcursion = 0.10
+)
+
+// SteadyState is the result of steady state detection on one log. When
+// it's not Detected the window fields describe the last window checked,
+// which shows how close it got.
+type SteadyState struct {
+	Detected     bool      `json:"detected"`
+	Source       string    `json:"source"`        // log detection ran on, e.g. .../iops_iops.*.log
+	Round        float64   `json:"round"`         // seconds in each round
+	Rounds       []float64 `json:"rounds"`        // average value of each complete round, 0 if it had no records
+	Window       int       `json:"window"`        // rounds in the measurement window
+	Start        uint32    `json:"start"`         // fio time (msec) the window starts at, before this is warm-up
+	End          uint32    `json:"end"`           // fio time (msec) the window ends at
+	Average      float64   `json:"average"`       // of the rounds in the window
+	RangePct     float64   `json:"range_pct"`     // max - min of the rounds as a % of the average
+	ExcursionPct float64   `json:"excursion_pct"` // change of the best-fit line across the window as a % of the average
+	// Trimmed is true when the summary, percentiles, bins and breakdown
+	// only have the records from Start on
+	Trimmed bool `json:"trimmed"`
+	// both sets of figures are always here: every record, and from Start on
+	All         LogSmry  `json:"all"`
+	AllPcntl    LogPcntl `json:"all_percentiles"`
+	Steady      LogSmry  `json:"steady"`
+	SteadyPcntl LogPcntl `json:"steady_percentiles"`
+}
+
+// steadySource returns the set to detect steady state with: the set itself
+// for bw and iops logs, otherwise the iops or bw logs in the same directory
+func (set *FioLogSet) steadySource() (FioLogSet, error) {
+	if set.LogType == "bw" || set.LogType == "iops" {
+		return *set, nil
+	}
+
+	for _, base := range []string{"iops_iops", "bw_bw"} {
+		src, err := FindFioLogSet(path.Join(set.Dir, base+".log"))
+		if err != nil {
+			return src, err
+		}
+		if len(src.Files) > 0 {
+			return src, nil
+		}
+	}
+
+	return FioLogSet{}, fmt.Errorf("no bw or iops logs next to %s to detect steady state with: %w", set.Path(), os.ErrNotExist)
+}
+
+// DetectSteadyState reads the bw or iops logs for the set, see
+// steadySource(), and finds the first window of rounds that's steady.
+// round and window of 0 are DefaultSteadyRound and DefaultSteadyWindow.
+func (set *FioLogSet) DetectSteadyState(round time.Duration, window int) (ss SteadyState, err error) {
+	if round == 0 {
+		round = DefaultSteadyRound
+	}
+	if window == 0 {
+		window = DefaultSteadyWindow
+	}
+
+	src, err := set.steadySource()
+	if err != nil {
+		return ss, err
+	}
+
+	width := uint32(round / time.Millisecond)
+	if width == 0 {
+		width = 1
+	}
+
+	var sums []float64
+	var counts []uint64
+	err = StreamFioLogs(src.Files, true, func(lr LogRec) error {
+		idx := int(lr.Time / width)
+		for len(sums) <= idx {
+			sums = append(sums, 0)
+			counts = append(counts, 0)
+		}
+		sums[idx] += float64(lr.Val)
+		counts[idx]++
+		return nil
+	})
+	if err != nil {
+		return ss, err
+	}
+
+	// the last round is cut short by the end of the run
+	if len(sums) > 0 {
+		sums, counts = sums[:len(sums)-1], counts[:len(counts)-1]
+	}
+
+	ss.Source = src.Path()
+	ss.Round = float64(width) / 1000
+	ss.Window = window
+	ss.Rounds = make([]float64, len(sums))
+	for i := range sums {
+		if counts[i] > 0 {
+			ss.Rounds[i] = sums[i] / float64(counts[i])
+		}
+	}
+
+	start := ss.detect()
+	ss.Start = uint32(start) * width
+	ss.End = uint32(start+window) * width
+
+	return ss, nil
+}
+
+// detect checks each window of ss.Rounds in order and stops at the first
+// steady one. Returns the index of the window's first round.
+func (ss *SteadyState) detect() (start int) {
+	for start = 0; start+ss.Window <= len(ss.Rounds); start++ {
+		ss.Average, ss.RangePct, ss.ExcursionPct = steadyWindow(ss.Rounds[start : start+ss.Window])
+		if ss.Average > 0 && ss.RangePct <= steadyMaxRange*100 && ss.ExcursionPct <= steadyMaxExcursion*100 {
+			ss.Detected = true
+			return start
+		}
+	}
+
+	// report on the last window
+	if start > 0 {
+		start--
+	}
+	return start
+}
+
+// steadyWindow returns the average of the rounds in a window, their range
+// and the excursion of the least squares line through them, both as a %
+// of the average
+func steadyWindow(ys []float64) (avg, rangePct, excursionPct float64) {
+	n := float64(len(ys))
+	min, max, avg := minMaxAvg(ys)
+	if avg <= 0 {
+		return avg, 0, 0
+	}
+
+	// slope of y = a + bx for x = 0 .. n-1
+	xavg := (n - 1) / 2
+	var sxy, sxx float64
+	for i, y := range ys {
+		dx := float64(i) - xavg
+		sxy += dx * (y - avg)
+		sxx += dx * dx
+	}
+	var slope float64
+	if sxx > 0 {
+		slope = sxy / sxx
+	}
+
+	rangePct = 100 * (max - min) / avg
+	excursionPct = 100 * math.Abs(slope) * (n - 1) / avg
+
+	return avg, rangePct, excursionPct
+}
+
+// from returns the records at or after ts, lrs must be in time order
+func (lrs LogRecs) from(ts uint32) LogRecs {
+	i := sort.Search(len(lrs), func(i int) bool { return lrs[i].Time >= ts })
+	return lrs[i:]
+}
+
+// setFigures fills in All and Steady from the records in time order. When
+// the summary is trimmed it's already of the steady records, so Steady is
+// left for steadyFrom() rather than sorting them again.
+func (ss *SteadyState) setFigures(lrs LogRecs, method string) {
+	if len(lrs) == 0 {
+		return
+	}
+
+	ss.All = lrs.bucketSummary(method)
+	ss.AllPcntl, ss.All.Pcntl = ss.All.Pcntl, nil
+
+	if ss.Trimmed {
+		return
+	}
+	if steady := lrs.from(ss.Start); ss.Detected && len(steady) > 0 {
+		ss.Steady = steady.bucketSummary(method)
+		ss.SteadyPcntl, ss.Steady.Pcntl = ss.Steady.Pcntl, nil
+	}
+}
+
+// steadyFrom fills in Steady from the summary of the trimmed records. The
+// summary doesn't have a median so it's P50.
+func (ss *SteadyState) steadyFrom(ld LogSummaries) {
+	ss.Steady = ld.Summary
+	ss.Steady.Median = uint64(math.Round(ld.Pcntl[50].Val))
+	ss.SteadyPcntl = ld.Pcntl
+}
+
+// streamFigures is setFigures() for SummarizeStream(), it reads the logs
+// once more
+func (ss *SteadyState) streamFigures(set *FioLogSet, method string) error {
+	var all, steady logSketch
+	err := StreamFioLogs(set.Files, true, func(lr LogRec) error {
+		all.add(lr)
+		if ss.Detected && lr.Time >= ss.Start {
+			steady.add(lr)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ss.All = all.summary(method)
+	ss.AllPcntl, ss.All.Pcntl = ss.All.Pcntl, nil
+	if steady.stats.count > 0 {
+		ss.Steady = steady.summary(method)
+		ss.SteadyPcntl, ss.Steady.Pcntl = ss.Steady.Pcntl, nil
+	}
+
+	return nil
+}
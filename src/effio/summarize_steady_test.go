@@ -0,0 +1,176 @@
+package effio
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSteadyWindow(t *testing.T) {
+	tests := []struct {
+		rounds       []float64
+		avg          float64
+		rangePct     float64
+		excursionPct float64
+	}{
+		{[]float64{100, 100, 100, 100, 100}, 100, 0, 0},
+		{[]float64{100, 110, 120, 130, 140}, 120, 100 * 40.0 / 120, 100 * 40.0 / 120},
+		{[]float64{140, 130, 120, 110, 100}, 120, 100 * 40.0 / 120, 100 * 40.0 / 120},
+		{[]float64{100, 120, 100, 120, 100}, 108, 100 * 20.0 / 108, 0},
+	}
+
+	for _, st := range tests {
+		avg, rangePct, excursionPct := steadyWindow(st.rounds)
+		if math.Abs(avg-st.avg) > 1e-9 || math.Abs(rangePct-st.rangePct) > 1e-9 || math.Abs(excursionPct-st.excursionPct) > 1e-9 {
+			t.Errorf("%v: expected %g %g%% %g%%, got %g %g%% %g%%", st.rounds, st.avg, st.rangePct, st.excursionPct, avg, rangePct, excursionPct)
+		}
+	}
+}
+
+func TestSteadyDetect(t *testing.T) {
+	tests := []struct {
+		rounds   []float64
+		detected bool
+		start    int
+	}{
+		// warms up then settles, the first window that fits starts on the
+		// last warm-up round
+		{[]float64{100, 200, 400, 800, 1000, 1010, 990, 1000, 1005, 995}, true, 4},
+		// never settles
+		{[]float64{100, 200, 300, 400, 500, 600, 700, 800}, false, 3},
+		// range is fine but it's still climbing
+		{[]float64{100, 104, 108, 112, 115}, false, 0},
+		// steady from the start
+		{[]float64{500, 505, 495, 500, 500, 500}, true, 0},
+		// an empty round can't be part of a steady window
+		{[]float64{500, 500, 0, 500, 500, 500, 500, 500}, true, 3},
+		// not enough rounds
+		{[]float64{500, 500}, false, 0},
+	}
+
+	for _, st := range tests {
+		ss := SteadyState{Rounds: st.rounds, Window: 5}
+		start := ss.detect()
+		if ss.Detected != st.detected || start != st.start {
+			t.Errorf("%v: expected detected %t at %d, got %t at %d", st.rounds, st.detected, st.start, ss.Detected, start)
+		}
+	}
+}
+
+// writeSteadyLogs writes 2 seconds of iops and latency logs, 1 record per
+// msec. iops climbs from 1000 to 10000 over the first 500ms then stays
+// there, latency is 5000 during the climb and 100 after.
+func writeSteadyLogs(t *testing.T, dir string) {
+	var iops, lat bytes.Buffer
+	for ts := 0; ts < 2000; ts++ {
+		if ts < 500 {
+			fmt.Fprintf(&iops, "%d, %d, 0, 4096\n", ts, 1000+18*ts)
+			fmt.Fprintf(&lat, "%d, 5000, 0, 4096\n", ts)
+		} else {
+			fmt.Fprintf(&iops, "%d, 10000, 0, 4096\n", ts)
+			fmt.Fprintf(&lat, "%d, 100, 0, 4096\n", ts)
+		}
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "iops_iops.1.log"), iops.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "lat_lat.1.log"), lat.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSummarizeSteady(t *testing.T) {
+	dir := t.TempDir()
+	writeSteadyLogs(t, dir)
+
+	set, err := FindFioLogSet(path.Join(dir, "lat_lat.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stream := range []bool{false, true} {
+		opts := SummarizeOpts{Bins: 10, Steady: true, SteadyRound: 100 * time.Millisecond, Stream: stream}
+		ld, err := set.Summarize(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ss := ld.SteadyState
+		if ss == nil || !ss.Detected {
+			t.Fatalf("stream %t: steady state wasn't detected: %+v", stream, ss)
+		}
+		// rounds 0-3 are still climbing too fast, see TestSteadyDetect
+		if ss.Start != 400 || ss.End != 900 || ss.Source != path.Join(dir, "iops_iops.1.log") || len(ss.Rounds) != 19 {
+			t.Errorf("stream %t: expected a window from 400 to 900ms of 19 rounds of iops_iops.1.log, got %d to %d of %d rounds of %s",
+				stream, ss.Start, ss.End, len(ss.Rounds), ss.Source)
+		}
+
+		if ss.Trimmed || ld.Summary.Count != 2000 {
+			t.Errorf("stream %t: the summary shouldn't be trimmed without TrimWarmup", stream)
+		}
+		if ss.All.Count != 2000 || ss.All.Sum != 500*5000+1500*100 {
+			t.Errorf("stream %t: all should be every record, got %d adding up to %d", stream, ss.All.Count, ss.All.Sum)
+		}
+		if ss.Steady.Count != 1600 || ss.Steady.Sum != 100*5000+1500*100 || ss.SteadyPcntl[50].Val != 100 {
+			t.Errorf("stream %t: steady should be the records from 400ms on, got %d adding up to %d, P50 %g",
+				stream, ss.Steady.Count, ss.Steady.Sum, ss.SteadyPcntl[50].Val)
+		}
+
+		opts.TrimWarmup = true
+		opts.Steady = false
+		ld, err = set.Summarize(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ld.SteadyState == nil || !ld.SteadyState.Trimmed {
+			t.Fatalf("stream %t: TrimWarmup should imply Steady", stream)
+		}
+		if ss := ld.SteadyState; ss.Steady.Count != 1600 || ss.Steady.Sum != ld.Summary.Sum || ss.All.Count != 2000 {
+			t.Errorf("stream %t: trimmed steady figures should match the summary, got %d adding up to %d of %d",
+				stream, ss.Steady.Count, ss.Steady.Sum, ss.All.Count)
+		}
+		// the bins are still from fio time 0, 200ms each, the warm-up ones are empty
+		if ld.Summary.Count != 1600 || ld.Summary.MinTs != 400 || ld.Bin[1].Count != 0 || ld.Bin[2].Count != 200 {
+			t.Errorf("stream %t: trimmed summary should start at 400ms, got %d records from %d, bins %d and %d",
+				stream, ld.Summary.Count, ld.Summary.MinTs, ld.Bin[1].Count, ld.Bin[2].Count)
+		}
+	}
+
+	// a lat log on its own only gets a warning
+	alone := t.TempDir()
+	data, err := ioutil.ReadFile(path.Join(dir, "lat_lat.1.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(alone, "lat_lat.1.log"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	set, err = FindFioLogSet(path.Join(alone, "lat_lat.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ld, err := set.Summarize(SummarizeOpts{Bins: 10, Steady: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ld.SteadyState != nil || ld.Summary.Count != 2000 {
+		t.Errorf("without an iops or bw log there's no steady state, got %+v", ld.SteadyState)
+	}
+
+	// a lat log with nothing usable in it is an error, not a panic
+	if err := ioutil.WriteFile(path.Join(dir, "lat_lat.1.log"), []byte("junk\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	set, err = FindFioLogSet(path.Join(dir, "lat_lat.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := set.Summarize(SummarizeOpts{Bins: 10, Steady: true, SteadyRound: 100 * time.Millisecond}); err == nil {
+		t.Error("summarizing a log without records should fail")
+	}
+}
@@ -0,0 +1,378 @@
+package effio
+
+// Summarizing fio logs without loading them. LogRecs.Summarize() needs every
+// record in memory and sorts them, which is fine for short runs but a 600s
+// latency log at a few hundred thousand IOPS is hundreds of millions of
+// records. SummarizeStream() reads the logs twice instead and only keeps
+// running totals and histograms around, so memory depends on the number of
+// bins and jobs rather than the number of records.
+//
+// Accuracy compared to the in-memory summarizer:
+//   - count, sum, min, max, average and the timestamps are exact
+//   - stdev uses Welford's method, the same to within floating point error
+//   - percentiles and bin medians come from a log-linear histogram (the same
+//     idea as HdrHistogram): values below 256 are exact and everything else
+//     is within 1/256 (0.4%) of the real value. The time of a percentile
+//     isn't known so it's always 0, idx is its rank.
+//   - bins have the same records as the in-memory ones, except for the
+//     P1/P99 outlier bins since they're cut at the histogram's P1 and P99
+// Histograms for different jobs or files can be merged, which is how the
+// per-direction totals are built.
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// 2^histSubBits buckets per power of 2, every value below 2^(histSubBits+1)
+// gets its own bucket
+const histSubBits = 7
+
+// logHistogram counts uint32 values in log-linear buckets. counts only
+// grows as far as the largest value seen, 26KB at most.
+type logHistogram struct {
+	counts []uint64
+	total  uint64
+}
+
+func histIndex(v uint32) int {
+	if v < 2<<histSubBits {
+		return int(v)
+	}
+
+	// v is in [2^(n-1), 2^n), keep its top histSubBits+1 bits
+	shift := bits.Len32(v) - histSubBits - 1
+	return 2<<histSubBits + (shift-1)<<histSubBits + int(v>>uint(shift)) - 1<<histSubBits
+}
+
+// histBounds returns the lowest and highest value that go in bucket idx
+func histBounds(idx int) (lo, hi uint32) {
+	if idx < 2<<histSubBits {
+		return uint32(idx), uint32(idx)
+	}
+
+	idx -= 2 << histSubBits
+	shift := uint(idx>>histSubBits + 1)
+	m := uint64(idx&(1<<histSubBits-1) + 1<<histSubBits)
+	return uint32(m << shift), uint32((m+1)<<shift - 1)
+}
+
+func (h *logHistogram) add(v uint32) {
+	idx := histIndex(v)
+	if idx >= len(h.counts) {
+		grown := make([]uint64, idx+1)
+		copy(grown, h.counts)
+		h.counts = grown
+	}
+	h.counts[idx]++
+	h.total++
+}
+
+func (h *logHistogram) merge(o *logHistogram) {
+	if len(o.counts) > len(h.counts) {
+		grown := make([]uint64, len(o.counts))
+		copy(grown, h.counts)
+		h.counts = grown
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.total += o.total
+}
+
+// bucketAt returns the index of the bucket with the value of the given
+// rank, 0 being the lowest value
+func (h *logHistogram) bucketAt(rank uint64) int {
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen > rank {
+			return i
+		}
+	}
+	return len(h.counts) - 1
+}
+
+// countBelow returns the number of values in buckets before idx
+func (h *logHistogram) countBelow(idx int) (n uint64) {
+	for i := 0; i < idx && i < len(h.counts); i++ {
+		n += h.counts[i]
+	}
+	return n
+}
+
+// valueAt returns the value of the given rank, the middle of its bucket
+func (h *logHistogram) valueAt(rank uint64) uint32 {
+	lo, hi := histBounds(h.bucketAt(rank))
+	return uint32((uint64(lo) + uint64(hi)) / 2)
+}
+
+// runningStats is count, sum, min, max and Welford's running mean and
+// sum of squared differences
+type runningStats struct {
+	count        uint64
+	sum          uint64
+	mean, m2     float64
+	min, max     uint32
+	minTs, maxTs uint32
+}
+
+func (rs *runningStats) add(lr LogRec) {
+	if rs.count == 0 {
+		rs.min, rs.max = lr.Val, lr.Val
+		rs.minTs, rs.maxTs = lr.Time, lr.Time
+	}
+
+	rs.count++
+	rs.sum += uint64(lr.Val)
+	delta := float64(lr.Val) - rs.mean
+	rs.mean += delta / float64(rs.count)
+	rs.m2 += delta * (float64(lr.Val) - rs.mean)
+
+	if lr.Val < rs.min {
+		rs.min = lr.Val
+	}
+	if lr.Val > rs.max {
+		rs.max = lr.Val
+	}
+	if lr.Time < rs.minTs {
+		rs.minTs = lr.Time
+	}
+	if lr.Time > rs.maxTs {
+		rs.maxTs = lr.Time
+	}
+}
+
+// logSketch is everything needed for a LogSmry
+type logSketch struct {
+	stats runningStats
+	hist  logHistogram
+}
+
+func (ls *logSketch) add(lr LogRec) {
+	ls.stats.add(lr)
+	ls.hist.add(lr.Val)
+}
+
+// value clamps a histogram value to what was actually seen
+func (ls *logSketch) value(rank uint64) uint32 {
+	v := ls.hist.valueAt(rank)
+	if v < ls.stats.min {
+		return ls.stats.min
+	} else if v > ls.stats.max {
+		return ls.stats.max
+	}
+	return v
+}
+
+// percentiles works like percentiles() on the histogram
+func (ls *logSketch) percentiles(method string) LogPcntl {
+	out := make(LogPcntl, len(pcntlKeys))
+	valueAt := func(rank uint64) float64 { return float64(ls.value(rank)) }
+
+	for _, pc := range pcntlKeys {
+		val, rank := quantile(method, ls.stats.count, pc, valueAt)
+		out[pc] = Percentile{Val: val, Idx: uint32(rank)}
+	}
+
+	return out
+}
+
+func (ls *logSketch) summary(method string) LogSmry {
+	rs := ls.stats
+	if rs.count == 0 {
+		return LogSmry{}
+	}
+
+	return LogSmry{
+		Min:     rs.min,
+		Max:     rs.max,
+		Sum:     rs.sum,
+		Count:   rs.count,
+		Median:  uint64(ls.value((rs.count - 1) / 2)),
+		Stdev:   math.Sqrt(rs.m2 / float64(rs.count)),
+		Average: rs.mean,
+		MinTs:   rs.minTs,
+		MaxTs:   rs.maxTs,
+		Elapsed: rs.maxTs - rs.minTs,
+		Pcntl:   ls.percentiles(method),
+	}
+}
+
+// streamBin fills a LogBin the same way LogRecs.Bins() does, one entry per
+// window of time. Every window has its own sketch so records can come in
+// any order, fio before 2.1.10 writes all the jobs to one file unsorted.
+type streamBin struct {
+	bin      LogBin
+	tb       timeBins
+	sketches []*logSketch // one per window, nil until it gets a record
+	method   string
+}
+
+func newStreamBin(tb timeBins, method string) *streamBin {
+	return &streamBin{
+		bin:      NewLogBin(tb.count),
+		tb:       tb,
+		sketches: make([]*logSketch, tb.count),
+		method:   method,
+	}
+}
+
+// add puts lr in the sketch for its window, records past the last window
+// are dropped
+func (sb *streamBin) add(lr LogRec) {
+	idx := sb.tb.index(lr.Time)
+	if idx >= len(sb.sketches) {
+		return
+	}
+	if sb.sketches[idx] == nil {
+		sb.sketches[idx] = &logSketch{}
+	}
+	sb.sketches[idx].add(lr)
+}
+
+// flush summarizes every window that got records into its bin entry
+func (sb *streamBin) flush() {
+	for idx, ls := range sb.sketches {
+		if ls != nil {
+			smry := ls.summary(sb.method)
+			sb.bin[idx] = &smry
+		}
+	}
+}
+
+// streamBins is a bin for every direction of IO
+type streamBins [4]*streamBin // all, read, write, trim
+
+func newStreamBins(tb timeBins, method string) (sbs streamBins) {
+	for i := range sbs {
+		sbs[i] = newStreamBin(tb, method)
+	}
+	return sbs
+}
+
+func (sbs streamBins) add(lr LogRec) {
+	sbs[0].add(lr)
+	if lr.Ddir < 3 {
+		sbs[lr.Ddir+1].add(lr)
+	}
+}
+
+func (sbs streamBins) bins() (all, read, write, trim LogBin) {
+	for _, sb := range sbs {
+		sb.flush()
+	}
+	return sbs[0].bin, sbs[1].bin, sbs[2].bin, sbs[3].bin
+}
+
+// SummarizeStream summarizes the set in two passes over the files. The
+// first gets the totals and histograms, which give the percentiles and the
+// time range for the bins, the second fills the bins.
+func (set *FioLogSet) SummarizeStream(opts SummarizeOpts) (ld LogSummaries, err error) {
+	jobs, method := opts.Jobs, opts.PcntlMethod
+
+	var total logSketch
+	byJob := make(map[uint16]*logSketch)
+	breakdown := make(breakdownSketches)
+
+	err = StreamFioLogs(set.Files, false, func(lr LogRec) error {
+		if lr.Time < opts.skipBefore {
+			return nil // warm-up
+		}
+		total.add(lr)
+		breakdown.add(lr)
+		if jobs {
+			if byJob[lr.Job] == nil {
+				byJob[lr.Job] = &logSketch{}
+			}
+			byJob[lr.Job].add(lr)
+		}
+		return nil
+	})
+	if err != nil {
+		return ld, err
+	}
+
+	if total.stats.count == 0 {
+		return ld, &ParseError{File: set.Path(), Err: fmt.Errorf("no records found")}
+	}
+
+	ld.Summary = total.summary(method)
+	ld.Pcntl = ld.Summary.Pcntl
+	ld.Summary.Pcntl = nil
+	ld.Summary.Median = 0 // not set by the in-memory summarizer either
+	ld.Breakdown = breakdown.breakdown(method)
+
+	tb := opts.binning(total.stats.maxTs)
+	ld.BinWidth = tb.seconds()
+
+	all := newStreamBins(tb, method)
+	p1bins := newStreamBins(tb, method)
+	p99bins := newStreamBins(tb, method)
+	p1, p99 := ld.Pcntl[1].Val, ld.Pcntl[99].Val
+
+	jobBins := make(map[uint16]*streamBin)
+	for job := range byJob {
+		jobBins[job] = newStreamBin(tb, method)
+	}
+
+	err = StreamFioLogs(set.Files, true, func(lr LogRec) error {
+		if lr.Time < opts.skipBefore {
+			return nil
+		}
+		all.add(lr)
+
+		if float64(lr.Val) < p1 {
+			p1bins.add(lr)
+		} else if float64(lr.Val) > p99 {
+			p99bins.add(lr)
+		}
+
+		if jb, ok := jobBins[lr.Job]; ok {
+			jb.add(lr)
+		}
+		return nil
+	})
+	if err != nil {
+		return ld, err
+	}
+
+	ld.Bin, ld.RBin, ld.WBin, ld.TBin = all.bins()
+	ld.P1Bin, ld.P1RBin, ld.P1WBin, ld.P1TBin = p1bins.bins()
+	ld.P99Bin, ld.P99RBin, ld.P99WBin, ld.P99TBin = p99bins.bins()
+	for _, jb := range jobBins {
+		jb.flush()
+	}
+
+	if jobs {
+		jobIdx := make([]int, 0, len(byJob))
+		for job := range byJob {
+			jobIdx = append(jobIdx, int(job))
+		}
+		sort.Ints(jobIdx)
+
+		for _, job := range jobIdx {
+			js := byJob[uint16(job)]
+			smry := js.summary(method)
+			pcntl := smry.Pcntl
+			smry.Pcntl = nil
+			smry.Median = 0
+
+			ld.Jobs = append(ld.Jobs, LogJobSummary{
+				Job:     uint16(job),
+				Summary: smry,
+				Pcntl:   pcntl,
+				Bin:     jobBins[uint16(job)].bin,
+			})
+		}
+	}
+
+	ld.Name = set.Name()
+	ld.Path = set.Path()
+	ld.Files = set.Files
+	ld.LogType = set.LogType
+
+	return ld, nil
+}
@@ -0,0 +1,194 @@
+package effio
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestLogHistogram(t *testing.T) {
+	vals := []uint32{0, 1, 255, 256, 257, 511, 512, 1000, 65535, 65536, 1 << 31, math.MaxUint32}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		vals = append(vals, rng.Uint32()>>uint(rng.Intn(32)))
+	}
+
+	for _, v := range vals {
+		idx := histIndex(v)
+		lo, hi := histBounds(idx)
+		if v < lo || v > hi || histIndex(lo) != idx || histIndex(hi) != idx {
+			t.Fatalf("%d: bucket %d is [%d, %d]", v, idx, lo, hi)
+		}
+
+		mid := float64((uint64(lo) + uint64(hi)) / 2)
+		if v < 256 && mid != float64(v) {
+			t.Errorf("%d should be exact, got %g", v, mid)
+		} else if math.Abs(mid-float64(v))/float64(v) > 1.0/256 {
+			t.Errorf("%d is off by more than 1/256 at %g", v, mid)
+		}
+	}
+
+	// buckets don't overlap or leave gaps
+	last := histIndex(math.MaxUint32)
+	for idx := 0; idx < last; idx++ {
+		_, hi := histBounds(idx)
+		lo, _ := histBounds(idx + 1)
+		if uint64(hi)+1 != uint64(lo) {
+			t.Fatalf("gap between bucket %d (hi %d) and %d (lo %d)", idx, hi, idx+1, lo)
+		}
+	}
+
+	var a, b logHistogram
+	for v := uint32(0); v < 1000; v++ {
+		a.add(v)
+		b.add(v * 1000)
+	}
+	a.merge(&b)
+	// 0 0 1 2 ... 998 999 1000 2000 ... 999000
+	if a.total != 2000 || a.valueAt(1) != 0 || a.valueAt(200) != 199 || math.Abs(float64(a.valueAt(1999))-999000) > 999000/256 {
+		t.Errorf("merge lost values: total %d, rank 1 %d, rank 200 %d, rank 1999 %d", a.total, a.valueAt(1), a.valueAt(200), a.valueAt(1999))
+	}
+}
+
+// the streaming summary should be the in-memory one give or take the
+// histogram's accuracy
+func TestSummarizeStream(t *testing.T) {
+	dir := t.TempDir()
+	suite := runSimSuite(t, dir, &SimRunner{Samples: 3000, Seed: 7})
+
+	sets, err := InventoryCSVFiles(suite.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, set := range sets {
+		batch, err := set.Summarize(SummarizeOpts{Bins: 10, Jobs: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, err := set.Summarize(SummarizeOpts{Bins: 10, Jobs: true, Stream: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bs, ss := batch.Summary, stream.Summary
+		if bs.Count != ss.Count || bs.Sum != ss.Sum || bs.Min != ss.Min || bs.Max != ss.Max ||
+			bs.MinTs != ss.MinTs || bs.MaxTs != ss.MaxTs || bs.Elapsed != ss.Elapsed {
+			t.Errorf("%s: exact values differ\nbatch  %+v\nstream %+v", set.Path(), bs, ss)
+		}
+		if math.Abs(bs.Average-ss.Average) > 1e-9*bs.Average || math.Abs(bs.Stdev-ss.Stdev) > 1e-6*bs.Stdev {
+			t.Errorf("%s: average/stdev %g/%g vs %g/%g", set.Path(), bs.Average, bs.Stdev, ss.Average, ss.Stdev)
+		}
+
+		for pc, bp := range batch.Pcntl {
+			got := stream.Pcntl[pc].Val
+			if math.Abs(got-bp.Val) > math.Max(1, bp.Val/256) {
+				t.Errorf("%s: P%g is %g, stream got %g", set.Path(), pc, bp.Val, got)
+			}
+		}
+
+		if len(batch.Breakdown) != len(stream.Breakdown) {
+			t.Errorf("%s: %d breakdowns, stream has %d", set.Path(), len(batch.Breakdown), len(stream.Breakdown))
+		} else {
+			for i, bb := range batch.Breakdown {
+				sb := stream.Breakdown[i]
+				if bb.Ddir != sb.Ddir || bb.Bsz != sb.Bsz || bb.Summary.Count != sb.Summary.Count || bb.Summary.Sum != sb.Summary.Sum {
+					t.Errorf("%s: breakdown %d is '%s' %d with %d records, stream has '%s' %d with %d", set.Path(), i,
+						bb.Ddir, bb.Bsz, bb.Summary.Count, sb.Ddir, sb.Bsz, sb.Summary.Count)
+				}
+			}
+		}
+		if len(batch.Breakdown) != 5 { // read, write, the block size, read and write at that size
+			t.Errorf("%s: expected 5 breakdowns, got %d", set.Path(), len(batch.Breakdown))
+		}
+
+		// bins hold the same records, only the medians and percentiles
+		// are approximate
+		sameBin := func(name string, b, s LogBin) {
+			if len(b) != len(s) {
+				t.Errorf("%s: %s has %d bins, stream has %d", set.Path(), name, len(b), len(s))
+				return
+			}
+			for i := range b {
+				if b[i].Count != s[i].Count || b[i].Sum != s[i].Sum || b[i].Min != s[i].Min || b[i].Max != s[i].Max ||
+					b[i].MinTs != s[i].MinTs || b[i].MaxTs != s[i].MaxTs {
+					t.Errorf("%s: %s[%d] differs\nbatch  %+v\nstream %+v", set.Path(), name, i, *b[i], *s[i])
+				}
+			}
+		}
+		sameBin("bin", batch.Bin, stream.Bin)
+		sameBin("read_bin", batch.RBin, stream.RBin)
+		sameBin("write_bin", batch.WBin, stream.WBin)
+		sameBin("trim_bin", batch.TBin, stream.TBin)
+
+		var p1, p99 uint64
+		for i := range stream.P1Bin {
+			p1 += stream.P1Bin[i].Count
+			p99 += stream.P99Bin[i].Count
+		}
+		if p1 == 0 || p99 == 0 {
+			t.Errorf("%s: outlier bins are empty", set.Path())
+		}
+		for _, b := range stream.P1Bin {
+			if float64(b.Max) > stream.Pcntl[1].Val {
+				t.Errorf("%s: P1 bin has %d, above P1 %g", set.Path(), b.Max, stream.Pcntl[1].Val)
+			}
+		}
+
+		if len(stream.Jobs) != len(batch.Jobs) {
+			t.Fatalf("%s: %d jobs, stream has %d", set.Path(), len(batch.Jobs), len(stream.Jobs))
+		}
+		for i := range batch.Jobs {
+			bj, sj := batch.Jobs[i], stream.Jobs[i]
+			if bj.Job != sj.Job || bj.Summary.Count != sj.Summary.Count || bj.Summary.Sum != sj.Summary.Sum {
+				t.Errorf("%s: job %d differs", set.Path(), bj.Job)
+			}
+			sameBin(fmt.Sprintf("job %d bin", bj.Job), bj.Bin, sj.Bin)
+		}
+	}
+}
+
+// fio before 2.1.10 writes every job to one file out of order, the stream
+// bins have to end up with the same records as the sorted in-memory ones
+func TestSummarizeStreamUnsorted(t *testing.T) {
+	dir := t.TempDir()
+	rng := rand.New(rand.NewSource(3))
+	var sb strings.Builder
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&sb, "%d, %d, %d, 4096\n", rng.Intn(10000), 50+rng.Intn(500), rng.Intn(2))
+	}
+	fpath := path.Join(dir, "lat_lat.log")
+	if err := ioutil.WriteFile(fpath, []byte(sb.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	set := FioLogSet{Dir: dir, Base: "lat_lat", LogType: "lat", Files: []string{fpath}}
+
+	batch, err := set.Summarize(SummarizeOpts{Bins: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := set.Summarize(SummarizeOpts{Bins: 10, Stream: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var total uint64
+	for i := range batch.Bin {
+		b, s := batch.Bin[i], stream.Bin[i]
+		if b.Count != s.Count || b.Sum != s.Sum || b.Min != s.Min || b.Max != s.Max || b.MinTs != s.MinTs || b.MaxTs != s.MaxTs {
+			t.Errorf("bin %d differs\nbatch  %+v\nstream %+v", i, *b, *s)
+		}
+		if batch.RBin[i].Count != stream.RBin[i].Count || batch.WBin[i].Count != stream.WBin[i].Count {
+			t.Errorf("bin %d has %d reads and %d writes, stream has %d and %d", i, batch.RBin[i].Count,
+				batch.WBin[i].Count, stream.RBin[i].Count, stream.WBin[i].Count)
+		}
+		total += s.Count
+	}
+	if total != 2000 {
+		t.Errorf("stream bins hold %d of 2000 records", total)
+	}
+}
@@ -1,28 +1,160 @@
 package effio
 
+// Reading block device information from sysfs. Everything goes through
+// /sys/class/block, which has entries for partitions, md and dm devices
+// as well as whole disks, unlike /sys/block. The root is configurable so
+// inventory can be tested against a fake tree.
+
 import (
 	"io/ioutil"
-	"log"
+	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 )
 
-func GetSysBlockString(device string, fpath string) string {
-	sbpath := path.Join("/sys/block", device, fpath)
-	data, err := ioutil.ReadFile(sbpath)
+// kinds of block devices, see Sysfs.Kind()
+const (
+	KindDisk      = "disk"
+	KindPartition = "partition"
+	KindMD        = "md"
+	KindDM        = "dm"
+	KindLoop      = "loop"
+)
+
+type Sysfs struct {
+	Root string // normally /sys
+}
+
+var DefaultSysfs = Sysfs{Root: "/sys"}
+
+// BlockPath returns the path to a sysfs file for a block device by its
+// kernel name, e.g. sda, sda1, nvme0n1p1, dm-0
+func (s Sysfs) BlockPath(kname string, fpath ...string) string {
+	return path.Join(append([]string{s.Root, "class/block", kname}, fpath...)...)
+}
+
+func (s Sysfs) BlockString(kname string, fpath string) (string, error) {
+	data, err := ioutil.ReadFile(s.BlockPath(kname, fpath))
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
-	return strings.TrimRight(string(data), " \t\r\n")
+	return strings.TrimRight(string(data), " \t\r\n"), nil
 }
 
-func GetSysBlockInt(device string, fpath string) int64 {
-	str := GetSysBlockString(device, fpath)
+func (s Sysfs) BlockInt(kname string, fpath string) (int64, error) {
+	str, err := s.BlockString(kname, fpath)
+	if err != nil {
+		return 0, err
+	}
+
 	out, err := strconv.ParseInt(str, 10, 64)
 	if err != nil {
-		log.Fatal(err)
+		return 0, &ParseError{File: s.BlockPath(kname, fpath), Err: err}
 	}
-	return out
+	return out, nil
+}
+
+func (s Sysfs) exists(kname string, fpath ...string) bool {
+	_, err := os.Stat(s.BlockPath(kname, fpath...))
+	return err == nil
+}
+
+// IsBlockDevice is true when sysfs knows about the device
+func (s Sysfs) IsBlockDevice(kname string) bool {
+	return kname != "" && s.exists(kname)
+}
+
+// Kind returns one of the Kind* constants
+func (s Sysfs) Kind(kname string) string {
+	switch {
+	case s.exists(kname, "partition"):
+		return KindPartition
+	case s.exists(kname, "dm"):
+		return KindDM
+	case s.exists(kname, "md"):
+		return KindMD
+	case strings.HasPrefix(kname, "loop"):
+		return KindLoop
+	default:
+		return KindDisk
+	}
+}
+
+// Parent returns the whole disk a partition is on, e.g. nvme0n1 for
+// nvme0n1p1 or sda for sda1. Any other device is its own parent.
+// The partition's sysfs directory is always inside the disk's, which is
+// more reliable than picking apart the name.
+func (s Sysfs) Parent(kname string) (string, error) {
+	if !s.exists(kname, "partition") {
+		return kname, nil
+	}
+
+	real, err := filepath.EvalSymlinks(s.BlockPath(kname))
+	if err != nil {
+		return "", err
+	}
+
+	return path.Base(path.Dir(real)), nil
+}
+
+// Partitions returns the partitions on a whole disk
+func (s Sysfs) Partitions(kname string) ([]string, error) {
+	real, err := filepath.EvalSymlinks(s.BlockPath(kname))
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(real)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, ent := range entries {
+		if _, err := os.Stat(path.Join(real, ent.Name(), "partition")); err == nil {
+			out = append(out, ent.Name())
+		}
+	}
+
+	return out, nil
+}
+
+// Holders returns the devices built on top of this one, e.g. the md array
+// or LVM volume a disk belongs to
+func (s Sysfs) Holders(kname string) ([]string, error) {
+	return s.listDir(kname, "holders")
+}
+
+// Slaves returns the devices an md or dm device is built from
+func (s Sysfs) Slaves(kname string) ([]string, error) {
+	return s.listDir(kname, "slaves")
+}
+
+func (s Sysfs) listDir(kname, dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(s.BlockPath(kname, dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	out := make([]string, len(entries))
+	for i, ent := range entries {
+		out[i] = ent.Name()
+	}
+	sort.Strings(out)
+
+	return out, nil
+}
+
+func GetSysBlockString(device string, fpath string) (string, error) {
+	return DefaultSysfs.BlockString(device, fpath)
+}
+
+func GetSysBlockInt(device string, fpath string) (int64, error) {
+	return DefaultSysfs.BlockInt(device, fpath)
 }
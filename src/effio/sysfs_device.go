@@ -0,0 +1,163 @@
+package effio
+
+// Hardware details for inventory: transport, HBA driver, firmware, serial
+// and queue settings. Most of it comes from following the device symlink
+// in /sys/class/block/<dev>/ into /sys/devices, where the path itself says
+// what bus the device hangs off of, e.g.
+//   /sys/devices/pci0000:00/0000:00:1f.2/ata1/host0/target0:0:0/0:0:0:0
+// is a SATA disk on the AHCI controller at 0000:00:1f.2.
+// All of these take the kernel name of a whole disk, see Sysfs.Parent().
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// matched in order against the device path, USB and virtio come first
+// because there are SCSI hosts under both of them
+var sysfsTransports = []struct {
+	re   *regexp.Regexp
+	name string
+}{
+	{regexp.MustCompile(`/nvme\d+/`), "NVMe"},
+	{regexp.MustCompile(`/usb\d+/`), "USB"},
+	{regexp.MustCompile(`/virtio\d+/`), "virtio"},
+	{regexp.MustCompile(`/session\d+/`), "iSCSI"},
+	{regexp.MustCompile(`/(end_device|port)-[\d:]+/`), "SAS"},
+	{regexp.MustCompile(`/ata\d+/`), "SATA"},
+}
+
+// DevicePath resolves /sys/class/block/<kname>/device to the real device
+// directory under /sys/devices
+func (s Sysfs) DevicePath(kname string) (string, error) {
+	return filepath.EvalSymlinks(s.BlockPath(kname, "device"))
+}
+
+// Transport returns one of NVMe, USB, virtio, iSCSI, SAS, SATA or MDRAID,
+// or an empty string when it can't be figured out
+func (s Sysfs) Transport(kname string) string {
+	if s.Kind(kname) == KindMD {
+		return "MDRAID"
+	}
+
+	dev, err := s.DevicePath(kname)
+	if err != nil {
+		return ""
+	}
+
+	for _, t := range sysfsTransports {
+		if t.re.MatchString(dev + "/") {
+			return t.name
+		}
+	}
+
+	return ""
+}
+
+// HBADriver returns the name of the driver for the controller the device is
+// attached to, e.g. ahci, mpt3sas, nvme, uas, virtio_blk. It walks up the
+// device path and takes the first driver that isn't a SCSI upper level
+// driver like sd.
+func (s Sysfs) HBADriver(kname string) string {
+	dev, err := s.DevicePath(kname)
+	if err != nil {
+		return ""
+	}
+
+	top := path.Join(s.Root, "devices")
+	for dir := dev; strings.HasPrefix(dir, top+"/"); dir = path.Dir(dir) {
+		target, err := os.Readlink(path.Join(dir, "driver"))
+		if err != nil {
+			continue
+		}
+
+		switch driver := path.Base(target); driver {
+		case "sd", "sr", "st", "sg":
+			continue
+		default:
+			return driver
+		}
+	}
+
+	return ""
+}
+
+// Vendor returns the SCSI vendor string. SATA disks all say "ATA" and NVMe
+// doesn't have one, so it's only useful for SAS and virtual disks. virtio
+// has a PCI vendor id in there, e.g. 0x1af4, which isn't useful either.
+func (s Sysfs) Vendor(kname string) string {
+	vendor, _ := s.BlockString(kname, "device/vendor")
+	if vendor == "ATA" || strings.HasPrefix(vendor, "0x") {
+		return ""
+	}
+	return vendor
+}
+
+// Firmware returns the firmware revision, NVMe calls it firmware_rev and
+// SCSI calls it rev
+func (s Sysfs) Firmware(kname string) string {
+	for _, fpath := range []string{"device/firmware_rev", "device/rev"} {
+		if rev, err := s.BlockString(kname, fpath); err == nil {
+			return rev
+		}
+	}
+	return ""
+}
+
+// Serial returns the device serial number. NVMe has it in plain text, SCSI
+// and SATA only have it in the unit serial number VPD page, which is only
+// readable by root on most systems.
+func (s Sysfs) Serial(kname string) string {
+	if serial, err := s.BlockString(kname, "device/serial"); err == nil {
+		return serial
+	}
+
+	// 4 byte header, length in byte 3, then the serial padded with spaces
+	data, err := ioutil.ReadFile(s.BlockPath(kname, "device/vpd_pg80"))
+	if err != nil || len(data) < 4 {
+		return ""
+	}
+	end := 4 + int(data[3])
+	if end > len(data) {
+		end = len(data)
+	}
+
+	return strings.TrimSpace(string(data[4:end]))
+}
+
+// Scheduler returns the active I/O scheduler, the one in brackets in
+// queue/scheduler, e.g. "mq-deadline" for "[mq-deadline] kyber bfq none"
+func (s Sysfs) Scheduler(kname string) (string, error) {
+	line, err := s.BlockString(kname, "queue/scheduler")
+	if err != nil {
+		return "", err
+	}
+
+	start := strings.Index(line, "[")
+	end := strings.Index(line, "]")
+	if start == -1 || end < start {
+		return line, nil // only one choice, e.g. "none"
+	}
+
+	return line[start+1 : end], nil
+}
+
+// QueueDepth returns the device's queue depth for SCSI/SATA devices, which
+// is the NCQ/TCQ depth. NVMe doesn't have one in sysfs so fall back to the
+// block layer's queue/nr_requests.
+func (s Sysfs) QueueDepth(kname string) (int64, error) {
+	if depth, err := s.BlockInt(kname, "device/queue_depth"); err == nil {
+		return depth, nil
+	}
+	return s.BlockInt(kname, "queue/nr_requests")
+}
+
+// Discard is true when the device supports discard/TRIM
+func (s Sysfs) Discard(kname string) (bool, error) {
+	max, err := s.BlockInt(kname, "queue/discard_max_bytes")
+	return max > 0, err
+}
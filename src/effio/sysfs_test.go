@@ -0,0 +1,284 @@
+package effio
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// fakeSysfs builds enough of /sys and /dev/disk/by-id for inventory in a
+// temp dir. Device directories live under devices/ like the real thing and
+// class/block has a symlink for every block device including partitions.
+type fakeSysfs struct {
+	t     *testing.T
+	root  string
+	byid  string
+	sysfs Sysfs
+}
+
+func newFakeSysfs(t *testing.T) *fakeSysfs {
+	root := t.TempDir()
+	fs := &fakeSysfs{t: t, root: root, byid: path.Join(root, "dev/disk/by-id"), sysfs: Sysfs{Root: path.Join(root, "sys")}}
+	fs.mkdir(fs.byid)
+	fs.mkdir(path.Join(root, "sys/class/block"))
+	return fs
+}
+
+func (fs *fakeSysfs) mkdir(dir string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fs.t.Fatal(err)
+	}
+}
+
+// files creates a directory at devpath (relative to sys/devices) with the
+// files given as name -> content
+func (fs *fakeSysfs) files(devpath string, files map[string]string) string {
+	dir := path.Join(fs.sysfs.Root, "devices", devpath)
+	fs.mkdir(dir)
+
+	for name, content := range files {
+		fs.mkdir(path.Dir(path.Join(dir, name)))
+		if err := os.WriteFile(path.Join(dir, name), []byte(content+"\n"), 0644); err != nil {
+			fs.t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+// link creates a symlink at devpath/name pointing to target, both relative
+// to sys/devices
+func (fs *fakeSysfs) link(devpath, name, target string) {
+	err := os.Symlink(path.Join(fs.sysfs.Root, "devices", target), path.Join(fs.sysfs.Root, "devices", devpath, name))
+	if err != nil {
+		fs.t.Fatal(err)
+	}
+}
+
+// driver binds a fake driver to the device at devpath
+func (fs *fakeSysfs) driver(devpath, driver string) {
+	fs.files(path.Join("../bus/fake/drivers", driver), nil)
+	fs.link(devpath, "driver", path.Join("../bus/fake/drivers", driver))
+}
+
+// device creates a block device directory at devpath with files like
+// files() and adds it to class/block and the by-id links
+func (fs *fakeSysfs) device(devpath string, files map[string]string, links ...string) {
+	dir := fs.files(devpath, files)
+
+	kname := path.Base(devpath)
+	if err := os.Symlink(dir, path.Join(fs.sysfs.Root, "class/block", kname)); err != nil {
+		fs.t.Fatal(err)
+	}
+
+	// /dev/disk/by-id links are relative like udev's, they don't need
+	// to resolve to anything
+	for _, link := range links {
+		if err := os.Symlink("../../"+kname, path.Join(fs.byid, link)); err != nil {
+			fs.t.Fatal(err)
+		}
+	}
+}
+
+func (fs *fakeSysfs) holder(kname, holder string) {
+	fs.mkdir(path.Join(fs.sysfs.BlockPath(kname), "holders", holder))
+	fs.mkdir(path.Join(fs.sysfs.BlockPath(holder), "slaves", kname))
+}
+
+func TestInventoryDevs(t *testing.T) {
+	fs := newFakeSysfs(t)
+
+	// NVMe namespace with one partition, only the partition is listed
+	fs.device("pci0000:00/nvme/nvme0/nvme0n1", map[string]string{
+		"size":                     "1953525168",
+		"device/model":             "Samsung SSD 970 EVO 1TB",
+		"queue/logical_block_size": "512",
+		"queue/rotational":         "0",
+	}, "nvme-Samsung_SSD_970_EVO_1TB_S123", "nvme-eui.0025385")
+	fs.device("pci0000:00/nvme/nvme0/nvme0n1/nvme0n1p1", map[string]string{
+		"size":      "1953523120",
+		"partition": "1",
+	}, "nvme-Samsung_SSD_970_EVO_1TB_S123-part1", "nvme-eui.0025385-part1")
+
+	// whole disk without partitions, model is missing
+	fs.device("pci0000:00/ata1/host0/target0:0:0/0:0:0:0/block/sda", map[string]string{
+		"size":                     "1000",
+		"queue/logical_block_size": "4096",
+		"queue/rotational":         "1",
+	}, "wwn-0x5000c500a1b2c3d4", "ata-ST4000DM000_Z1Z2")
+
+	// two partitions in an md array
+	fs.device("pci0000:00/ata2/block/sdb", map[string]string{"size": "2000", "device/model": "INTEL SSDSC2BB48"}, "ata-INTEL_SSDSC2BB48_1")
+	fs.device("pci0000:00/ata2/block/sdb/sdb1", map[string]string{"size": "1000", "partition": "1"}, "ata-INTEL_SSDSC2BB48_1-part1")
+	fs.device("pci0000:00/ata2/block/sdb/sdb2", map[string]string{"size": "1000", "partition": "2"}, "ata-INTEL_SSDSC2BB48_1-part2")
+	fs.device("virtual/block/md0", map[string]string{"size": "1000", "md/level": "raid1"}, "md-uuid-1234", "md-name-host:0")
+	fs.holder("sdb1", "md0")
+	fs.holder("sdb2", "md0")
+
+	// LVM volume on a whole disk
+	fs.device("pci0000:00/ata3/block/sdc", map[string]string{"size": "4000", "device/model": "Crucial_CT960M50"}, "ata-Crucial_CT960M50_2")
+	fs.device("virtual/block/dm-0", map[string]string{"size": "4000", "dm/name": "vg0-data", "dm/uuid": "LVM-abcdef"}, "dm-name-vg0-data", "dm-uuid-LVM-abcdef")
+	fs.holder("sdc", "dm-0")
+
+	// loop devices and links to nothing are ignored
+	fs.device("virtual/block/loop0", map[string]string{"size": "100"}, "loop-0")
+	if err := os.Symlink("../../sdx", path.Join(fs.byid, "ata-gone")); err != nil {
+		t.Fatal(err)
+	}
+
+	devs, warnings, err := fs.sysfs.InventoryDevs(fs.byid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []Device{
+		{Name: "vg0_data", Device: "dm-name-vg0-data", Brand: "Generic", Series: "LVM logical volume", Capacity: 4000 * 512, Kind: KindDM, Parent: "dm-0"},
+		{Name: "md0", Device: "md-name-host:0", Brand: "Generic", Series: "md raid1", Transport: "MDRAID", Capacity: 1000 * 512, Kind: KindMD, Parent: "md0"},
+		{Name: "samsung_ssd_970_evo_1tb", Device: "nvme-Samsung_SSD_970_EVO_1TB_S123-part1", Brand: "Samsung", Series: "Samsung SSD 970 EVO 1TB",
+			Capacity: 1953523120 * 512, Blocksize: 512, Transport: "NVMe", Kind: KindPartition, Parent: "nvme0n1"},
+		{Name: "sda", Device: "ata-ST4000DM000_Z1Z2", Brand: "Generic", Capacity: 1000 * 512, Blocksize: 4096, Rotational: true, Kind: KindDisk, Parent: "sda"},
+	}
+
+	if len(devs) != len(expect) {
+		t.Fatalf("expected %d devices, got %d: %+v", len(expect), len(devs), devs)
+	}
+
+	for i, e := range expect {
+		d := devs[i]
+		if d.Name != e.Name || path.Base(d.Device) != e.Device || d.Brand != e.Brand || d.Series != e.Series ||
+			d.Capacity != e.Capacity || d.Blocksize != e.Blocksize || d.Rotational != e.Rotational ||
+			d.Transport != e.Transport || d.Kind != e.Kind || d.Parent != e.Parent {
+			t.Errorf("device %d: expected %+v\ngot %+v", i, e, d)
+		}
+		if d.Mountpoint != "/mnt/effio/"+e.Name {
+			t.Errorf("%s: unexpected mountpoint %s", d.Name, d.Mountpoint)
+		}
+	}
+
+	// sda has no model and md/dm have no queue/ in the fake tree, these
+	// should be warnings rather than failures
+	var msgs []string
+	for _, w := range warnings {
+		msgs = append(msgs, w.Error())
+	}
+	all := strings.Join(msgs, "\n")
+	for _, want := range []string{"sda: ", "device/model", "md0: "} {
+		if !strings.Contains(all, want) {
+			t.Errorf("expected a warning mentioning %q, got:\n%s", want, all)
+		}
+	}
+}
+
+func TestSysfsParent(t *testing.T) {
+	fs := newFakeSysfs(t)
+	fs.device("pci0000:00/nvme/nvme0/nvme1n1", map[string]string{"size": "1"})
+	fs.device("pci0000:00/nvme/nvme0/nvme1n1/nvme1n1p3", map[string]string{"size": "1", "partition": "3"})
+
+	tests := map[string]string{"nvme1n1p3": "nvme1n1", "nvme1n1": "nvme1n1"}
+	for kname, expect := range tests {
+		if parent, err := fs.sysfs.Parent(kname); err != nil || parent != expect {
+			t.Errorf("Parent(%s) = (%s, %v), expected %s", kname, parent, err, expect)
+		}
+	}
+
+	if kind := fs.sysfs.Kind("nvme1n1p3"); kind != KindPartition {
+		t.Errorf("nvme1n1p3 should be a partition, not %s", kind)
+	}
+	if parts, err := fs.sysfs.Partitions("nvme1n1"); err != nil || len(parts) != 1 || parts[0] != "nvme1n1p3" {
+		t.Errorf("unexpected partitions %v (%v)", parts, err)
+	}
+}
+
+func TestSysfsHardware(t *testing.T) {
+	fs := newFakeSysfs(t)
+
+	// SATA SSD on AHCI
+	ahci := "pci0000:00/0000:00:1f.2"
+	sata := ahci + "/ata1/host0/target0:0:0/0:0:0:0"
+	fs.files(ahci, nil)
+	fs.driver(ahci, "ahci")
+	fs.files(sata, map[string]string{"vendor": "ATA     ", "model": "Samsung SSD 850 PRO 512GB", "rev": "EXM02B6Q", "queue_depth": "32"})
+	fs.driver(sata, "sd")
+	if err := os.WriteFile(path.Join(fs.sysfs.Root, "devices", sata, "vpd_pg80"), []byte("\x00\x80\x00\x10S250NXAG123456K  "), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs.device(sata+"/block/sda", map[string]string{
+		"queue/scheduler":           "[mq-deadline] kyber bfq none",
+		"queue/logical_block_size":  "512",
+		"queue/physical_block_size": "4096",
+		"queue/discard_max_bytes":   "2147450880",
+	})
+	fs.link(sata+"/block/sda", "device", sata)
+
+	// NVMe, the device link points at the controller, not the PCI device
+	pcie := "pci0000:00/0000:00:1d.0/0000:3d:00.0"
+	ctrl := pcie + "/nvme/nvme0"
+	fs.files(pcie, nil)
+	fs.driver(pcie, "nvme")
+	fs.files(ctrl, map[string]string{"model": "Samsung SSD 970 EVO 1TB", "firmware_rev": "2B2QEXE7", "serial": "S467NX0M123456"})
+	fs.device(ctrl+"/nvme0n1", map[string]string{"queue/scheduler": "[none] mq-deadline", "queue/nr_requests": "1023", "queue/discard_max_bytes": "0"})
+	fs.link(ctrl+"/nvme0n1", "device", ctrl)
+
+	// SAS disk behind an LSI HBA
+	lsi := "pci0000:00/0000:00:01.0/0000:03:00.0"
+	sas := lsi + "/host1/port-1:0/end_device-1:0/target1:0:0/1:0:0:0"
+	fs.files(lsi, nil)
+	fs.driver(lsi, "mpt3sas")
+	fs.files(sas, map[string]string{"vendor": "SEAGATE ", "model": "ST3300657SS", "rev": "0008", "queue_depth": "254"})
+	fs.driver(sas, "sd")
+	fs.device(sas+"/block/sdb", map[string]string{"queue/scheduler": "none"})
+	fs.link(sas+"/block/sdb", "device", sas)
+
+	// virtio-blk
+	virtio := "pci0000:00/0000:00:04.0/virtio1"
+	fs.files(virtio, map[string]string{"vendor": "0x1af4"})
+	fs.driver(virtio, "virtio_blk")
+	fs.device(virtio+"/block/vda", nil)
+	fs.link(virtio+"/block/vda", "device", virtio)
+
+	tests := []struct {
+		kname, transport, hba, vendor, firmware, serial, scheduler string
+		depth                                                      int64
+		discard                                                    bool
+	}{
+		{"sda", "SATA", "ahci", "", "EXM02B6Q", "S250NXAG123456K", "mq-deadline", 32, true},
+		{"nvme0n1", "NVMe", "nvme", "", "2B2QEXE7", "S467NX0M123456", "none", 1023, false},
+		{"sdb", "SAS", "mpt3sas", "SEAGATE", "0008", "", "none", 254, false},
+		{"vda", "virtio", "virtio_blk", "", "", "", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		got := []string{fs.sysfs.Transport(tt.kname), fs.sysfs.HBADriver(tt.kname), fs.sysfs.Vendor(tt.kname), fs.sysfs.Firmware(tt.kname), fs.sysfs.Serial(tt.kname)}
+		expect := []string{tt.transport, tt.hba, tt.vendor, tt.firmware, tt.serial}
+		if strings.Join(got, "|") != strings.Join(expect, "|") {
+			t.Errorf("%s: expected transport|hba|vendor|firmware|serial %s, got %s", tt.kname, strings.Join(expect, "|"), strings.Join(got, "|"))
+		}
+
+		sched, _ := fs.sysfs.Scheduler(tt.kname)
+		depth, _ := fs.sysfs.QueueDepth(tt.kname)
+		discard, _ := fs.sysfs.Discard(tt.kname)
+		if sched != tt.scheduler || depth != tt.depth || discard != tt.discard {
+			t.Errorf("%s: expected scheduler %q, depth %d, discard %t, got %q, %d, %t", tt.kname, tt.scheduler, tt.depth, tt.discard, sched, depth, discard)
+		}
+	}
+
+	models := []struct {
+		vendor, model, brand, media string
+		rpm                         int
+	}{
+		{"", "Samsung SSD 850 PRO 512GB", "Samsung", "MLC", 0},
+		{"SEAGATE", "ST3300657SS", "Seagate", "Iron", 15000},
+		{"SEAGATE", "ST600MM0006", "Seagate", "Iron", 0},
+		{"ATA", "WDC WD3000BLFS-0", "Western Digital", "Iron", 10000},
+		{"", "WDS500G3X0C-00SJG0", "Western Digital", "", 0},
+		{"NETAPP", "LUN C-Mode", "NETAPP", "", 0},
+		{"ATA", "Some Disk", "Generic", "", 0},
+	}
+	for _, m := range models {
+		dm := LookupDeviceModel(m.vendor, m.model)
+		if dm.Brand != m.brand || dm.Media != m.media || dm.RPM != m.rpm {
+			t.Errorf("%s %s: expected %s/%s/%d, got %s/%s/%d", m.vendor, m.model, m.brand, m.media, m.rpm, dm.Brand, dm.Media, dm.RPM)
+		}
+	}
+}